@@ -0,0 +1,58 @@
+package ManagedMap
+
+import (
+    "time"
+)
+
+// adaptiveTTL is a private struct holding the bounds and growth factor of a map created
+// WithAdaptiveTTL.
+type adaptiveTTL struct {
+    min time.Duration
+    max time.Duration
+    factor float64
+}
+
+// WithAdaptiveTTL returns an Option that makes the timeout of every item with a finite
+// timeout learn from how often it is read. An item starts with its timeout clamped
+// between min and max. Each read that comes within timeout/factor of the previous one,
+// or of the insert, re-arms the item with its timeout grown to min(timeout*factor, max),
+// while a read that comes later than that marks the item as rarely hit and re-arms it
+// with its timeout shrunk to max(timeout/factor, min). Hot items are kept longer and
+// cold ones die sooner, with an item that is never read expiring after its starting
+// timeout. Reads re-arm the item from a goroutine, as with SlideOnAccess, so the new
+// deadline applies shortly after the read returns.
+// Items with an infinite timeout and pinned items are not adapted. The Option does
+// nothing unless 0 < min <= max and factor > 1.
+func WithAdaptiveTTL(min, max time.Duration, factor float64) Option {
+    return func(t *managedMap) {
+        if min <= 0 || max < min || factor <= 1 {
+            return
+        }
+        t.adaptive = &adaptiveTTL{min: min, max: max, factor: factor}
+    }
+}
+
+// clamp is a private method of an adaptiveTTL that bounds d between min and max.
+func (a *adaptiveTTL) clamp(d time.Duration) time.Duration {
+    if d < a.min {
+        return a.min
+    }
+    if d > a.max {
+        return a.max
+    }
+    return d
+}
+
+// adapt is a private method of an adaptiveTTL that returns the timeout of an item after
+// hits reads, the first of which came gap after the item was last adapted.
+func (a *adaptiveTTL) adapt(timeout, gap time.Duration, hits int64) time.Duration {
+    // Only the first read can have come after a long gap, the rest are back to back
+    if gap > time.Duration(float64(timeout)/a.factor) {
+        timeout = a.clamp(time.Duration(float64(timeout) / a.factor))
+        hits--
+    }
+    for ; hits > 0; hits-- {
+        timeout = a.clamp(time.Duration(float64(timeout) * a.factor))
+    }
+    return timeout
+}
@@ -0,0 +1,31 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// WithCloseGrace returns an Option that turns operations on the map into no-ops for d
+// after the Close method has been called, instead of panicking. During the grace period
+// the map behaves as if it were empty and refuses new items: Get and the other lookups
+// return zero values and false, Has returns false, Size returns 0, Put, PutCustom and
+// Add are dropped and MoveEntry into the map returns false. Once d has passed every
+// method other than Close panics as it would without the Option. This allows concurrent
+// producers that can not be perfectly drained to shut down without recovering from the
+// panic.
+func WithCloseGrace(d time.Duration) Option {
+    return func(t *managedMap) {
+        t.closeGrace = d
+    }
+}
+
+// inGrace is a private method of a managedMap that reports whether the map has been
+// closed less than its close grace period ago. It may be called without holding the
+// lock.
+func (t *managedMap) inGrace() bool {
+    closedAt := atomic.LoadInt64(&t.closedAt)
+    if t.closeGrace <= 0 || closedAt == 0 {
+        return false
+    }
+    return time.Since(time.Unix(0, closedAt)) < t.closeGrace
+}
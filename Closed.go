@@ -0,0 +1,61 @@
+package ManagedMap
+
+import (
+    "errors"
+)
+
+// ErrClosed is returned by TryGet and TryPut when the map has been closed.
+var ErrClosed = errors.New("ManagedMap: map is closed")
+
+// TryGet is a method of a managedMap that works like Get but returns ErrClosed instead
+// of panicking when the map has been closed, including during its close grace period.
+func (t *managedMap) TryGet(key interface{}) (value interface{}, has bool, err error) {
+    err = t.try(func() {
+        value, has = t.Get(key)
+    })
+    if err != nil {
+        return nil, false, err
+    }
+    return value, has, nil
+}
+
+// TryPut is a method of a managedMap that works like Put but returns ErrClosed instead
+// of panicking when the map has been closed, including during its close grace period.
+func (t *managedMap) TryPut(key, value interface{}) error {
+    return t.try(func() {
+        t.Put(key, value)
+    })
+}
+
+// try is a private method of a managedMap that runs fn unless the map is closed,
+// returning ErrClosed if it is closed before or while fn runs. A panic from fn that is
+// not caused by the map being closed is passed on.
+func (t *managedMap) try(fn func()) (err error) {
+    if t.IsClosed() {
+        return ErrClosed
+    }
+    defer func() {
+        if r := recover(); r != nil {
+            if !t.IsClosed() {
+                panic(r)
+            }
+            err = ErrClosed
+        }
+    }()
+    fn()
+    // A close grace period hides a Close that raced with fn
+    if t.IsClosed() {
+        return ErrClosed
+    }
+    return nil
+}
+
+// IsClosed is a method of a managedMap that reports whether the Close method has been
+// called, so callers racing with shutdown can guard their calls. It takes the read lock,
+// never panics and is safe to call concurrently with Close. A map in its close grace
+// period is closed.
+func (t *managedMap) IsClosed() bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.m == nil
+}
@@ -0,0 +1,92 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// compactInterval is how often the compaction monitor checks the share of items pending
+// deletion.
+var compactInterval = time.Second
+
+// WithCompactThreshold returns an Option that starts a goroutine monitoring the items
+// that have run out of accesses or time but are still stored, for example because of a
+// coarse TTL resolution or a backlog of deletions waiting for the write lock. Once a
+// second it counts them under the read lock and, when they make up more than ratio of
+// all items, runs a compaction pass that deletes them under the write lock. Deleted
+// items are evicted as they would be otherwise, so they are flushed and may be vetoed.
+// The last count and the number of passes are reported by the PendingDeletes and
+// Compactions fields of Stats. The goroutine is stopped by the Close method.
+func WithCompactThreshold(ratio float64) Option {
+    return func(t *managedMap) {
+        t.compactThreshold = ratio
+    }
+}
+
+// monitorPending is a private method of a managedMap run in the goroutine started by
+// WithCompactThreshold. It compacts the map whenever the share of items pending deletion
+// exceeds the threshold, until the map is closed.
+func (t *managedMap) monitorPending() {
+    ticker := time.NewTicker(compactInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-t.stop:
+            return
+        case <-ticker.C:
+            if pending, total := t.countPending(); total > 0 && float64(pending)/float64(total) > t.compactThreshold {
+                t.compact()
+            }
+        }
+    }
+}
+
+// countPending is a private method of a managedMap that returns the number of items
+// pending deletion and the number of items stored, recording the former for Stats.
+func (t *managedMap) countPending() (int, int) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    pending := 0
+    for _, v := range t.m {
+        if v.pending() {
+            pending++
+        }
+    }
+    atomic.StoreInt64(&t.pending, int64(pending))
+    return pending, len(t.m)
+}
+
+// compact is a private method of a managedMap that evicts every item pending deletion.
+func (t *managedMap) compact() {
+    t.lock.Lock()
+    defer t.unlock()
+    if t.m == nil {
+        return
+    }
+    atomic.AddInt64(&t.compactions, 1)
+    t.evictPending()
+}
+
+// evictPending is a private method of a managedMap that evicts every item pending
+// deletion and returns how many were removed. The caller must hold the write lock.
+func (t *managedMap) evictPending() int {
+    evicted := 0
+    for k, v := range t.m {
+        reason := EvictExpired
+        if atomic.LoadUint64(&v.accessRemaining) == 0 {
+            reason = EvictAccessExhausted
+        } else if v.remaining() != 0 {
+            continue
+        }
+        if t.evict(k, v, reason) {
+            evicted++
+        }
+    }
+    return evicted
+}
+
+// pending is a private method of an item that reports whether it has run out of accesses
+// or time and is only waiting to be deleted.
+func (i *item) pending() bool {
+    return atomic.LoadUint64(&i.accessRemaining) == 0 || i.remaining() == 0
+}
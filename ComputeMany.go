@@ -0,0 +1,94 @@
+package ManagedMap
+
+import (
+    "errors"
+)
+
+// errNotComputed is the result of a call for a key that compute left out of its result.
+var errNotComputed = errors.New("ManagedMap: key was not computed")
+
+// GetOrComputeMany is a method of a managedMap that returns the values of keys, calling
+// compute once with every key that is missing so they can be fetched in a single batch,
+// for example with one query to a database. The values returned by compute are stored
+// with the map's default timeout and access count and the result holds the hits and the
+// computed values together. Hits consume an access like Get, computed values do not.
+// Keys that compute leaves out of its result are left out of the returned map and are
+// not stored. Concurrent calls coordinate through the map's Group like GetLoad, so a
+// missing key that another call, or a GetLoad, is already fetching is waited for rather
+// than computed again, and compute is only called with the keys no one else is fetching.
+// compute is not called if no key is missing. GetOrComputeMany will always panic when
+// called after the Close method has been called.
+func (t *managedMap) GetOrComputeMany(keys []interface{}, compute func(missing []interface{}) map[interface{}]interface{}) map[interface{}]interface{} {
+    values := make(map[interface{}]interface{}, len(keys))
+    missing := []interface{}{}
+    for _, key := range keys {
+        if value, has := t.traceGet(key); has {
+            values[key] = value
+        } else {
+            missing = append(missing, key)
+        }
+    }
+    if len(missing) == 0 {
+        return values
+    }
+    owned, calls := t.group.claim(missing)
+    if len(owned) > 0 {
+        t.group.runMany(owned, calls, compute)
+    }
+    for _, key := range missing {
+        c := calls[key]
+        <-c.done
+        if c.err == nil {
+            t.group.store(t, key, c)
+            values[key] = c.value
+        }
+    }
+    return values
+}
+
+// claim is a private method of a Group that returns the call of every key, starting a
+// call for each key that has none in flight. It also returns the keys whose calls it
+// started, which the caller must finish with runMany.
+func (g *Group) claim(keys []interface{}) ([]interface{}, map[interface{}] *call) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    owned := []interface{}{}
+    calls := make(map[interface{}] *call, len(keys))
+    for _, key := range keys {
+        if _, seen := calls[key]; seen {
+            continue
+        }
+        c, has := g.calls[key]
+        if !has {
+            c = &call{done: make(chan struct{}), stored: make(map[*managedMap] bool)}
+            g.calls[key] = c
+            owned = append(owned, key)
+        }
+        calls[key] = c
+    }
+    return owned, calls
+}
+
+// runMany is a private method of a Group that calls compute for the owned keys and hands
+// each of their calls its result. The calls are removed and their waiters are woken even
+// if compute panics.
+func (g *Group) runMany(owned []interface{}, calls map[interface{}] *call, compute func(missing []interface{}) map[interface{}]interface{}) {
+    var results map[interface{}]interface{}
+    defer func() {
+        g.lock.Lock()
+        for _, key := range owned {
+            delete(g.calls, key)
+        }
+        g.lock.Unlock()
+        for _, key := range owned {
+            c := calls[key]
+            if value, has := results[key]; has {
+                c.value = value
+            } else {
+                c.err = errNotComputed
+            }
+            close(c.done)
+        }
+    }()
+    results = compute(owned)
+}
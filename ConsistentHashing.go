@@ -0,0 +1,89 @@
+package ManagedMap
+
+import (
+    "hash/maphash"
+    "sort"
+)
+
+// WithConsistentHashing returns an Option for a shardedMap that picks the shard of a key
+// with a consistent hashing ring instead of taking its hash modulo the number of shards.
+// Every shard is placed on the ring virtualNodes times and a key belongs to the shard of
+// the first point at or after its hash, so when Reshard changes the number of shards only
+// the keys of the added or removed shards move, about 1/n of them, rather than nearly all
+// of them. More virtual nodes spread keys more evenly at the cost of a larger ring, which
+// ShardSizes helps to judge. A non positive virtualNodes uses one point per shard. The
+// Option is ignored by maps that are not sharded.
+func WithConsistentHashing(virtualNodes int) Option {
+    return func(t *managedMap) {
+        if virtualNodes <= 0 {
+            virtualNodes = 1
+        }
+        t.virtualNodes = virtualNodes
+    }
+}
+
+// virtualNode is a private struct identifying a point of a hashRing, hashed to place the
+// point on the ring.
+type virtualNode struct {
+    shard int
+    node int
+}
+
+// hashRing is a private struct holding the points of a consistent hashing ring sorted by
+// their hash, along with the shard each point belongs to and the number of points of
+// each shard.
+type hashRing struct {
+    hashes []uint64
+    shards []int
+    virtualNodes int
+}
+
+// newHashRing is a private function that returns the ring of shards shards with
+// virtualNodes points each. A point only depends on its shard and its number, so a ring
+// of more shards keeps every point of a ring of fewer.
+func newHashRing(seed maphash.Seed, shards, virtualNodes int) *hashRing {
+    type point struct {
+        hash uint64
+        shard int
+    }
+    points := make([]point, 0, shards * virtualNodes)
+    for shard := 0; shard < shards; shard++ {
+        for node := 0; node < virtualNodes; node++ {
+            points = append(points, point{maphash.Comparable(seed, virtualNode{shard, node}), shard})
+        }
+    }
+    sort.Slice(points, func(i, j int) bool {
+        return points[i].hash < points[j].hash
+    })
+    r := &hashRing{hashes: make([]uint64, len(points)), shards: make([]int, len(points)), virtualNodes: virtualNodes}
+    for i, p := range points {
+        r.hashes[i], r.shards[i] = p.hash, p.shard
+    }
+    return r
+}
+
+// lookup is a private method of a hashRing that returns the shard owning hash, the shard
+// of the first point at or after it, wrapping around to the first point.
+func (r *hashRing) lookup(hash uint64) int {
+    i := sort.Search(len(r.hashes), func(i int) bool {
+        return r.hashes[i] >= hash
+    })
+    if i == len(r.hashes) {
+        i = 0
+    }
+    return r.shards[i]
+}
+
+// ShardSizes is a method of a shardedMap that returns the number of items in each shard,
+// to check how evenly keys are spread between them. The shards are counted one after
+// another like Size. ShardSizes will always panic when called after the Close method has
+// been called.
+func (t *shardedMap) ShardSizes() []int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    sizes := make([]int, len(t.shards))
+    for i, shard := range t.shards {
+        sizes[i] = shard.Size()
+    }
+    return sizes
+}
@@ -0,0 +1,70 @@
+package ManagedMap
+
+import (
+    "context"
+)
+
+// GetContext is a method of a managedMap that works like Get but gives up once ctx is
+// done, returning ctx.Err(). This bounds how long a caller waits on a map whose lock is
+// held for a long time, for example by a slow WithOnExpire callback or a sweep of many
+// items. A lookup that is given up on still runs to completion in the background and may
+// consume an access. GetContext returns ErrClosed instead of panicking when the map has
+// been closed.
+func (t *managedMap) GetContext(ctx context.Context, key interface{}) (interface{}, bool, error) {
+    var value interface{}
+    var has bool
+    err := t.withContext(ctx, func() error {
+        return t.try(func() {
+            value, has = t.Get(key)
+        })
+    })
+    if err != nil {
+        return nil, false, err
+    }
+    return value, has, nil
+}
+
+// PutContext is a method of a managedMap that works like PutChecked, without its key
+// check, but gives up once ctx is done, returning ctx.Err(). A Put that is given up on
+// still runs to completion in the background, so the value may be stored after
+// PutContext has returned. PutContext returns ErrClosed instead of panicking when the map
+// has been closed.
+func (t *managedMap) PutContext(ctx context.Context, key, value interface{}, config Config) error {
+    return t.withContext(ctx, func() error {
+        var err error
+        if closed := t.try(func() {
+            err = t.put(key, value, config)
+        }); closed != nil {
+            return closed
+        }
+        return err
+    })
+}
+
+// withContext is a private method of a managedMap that runs fn in a goroutine and returns
+// its error, or ctx.Err() if ctx is done first. fn is not started when ctx is already
+// done. A panic from fn is passed on to the caller unless ctx was done first.
+func (t *managedMap) withContext(ctx context.Context, fn func() error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    // Both channels are buffered so fn never blocks on a caller that gave up
+    done := make(chan error, 1)
+    panics := make(chan interface{}, 1)
+    go func() {
+        defer func() {
+            if r := recover(); r != nil {
+                panics <- r
+            }
+        }()
+        done <- fn()
+    }()
+    select {
+    case err := <-done:
+        return err
+    case r := <-panics:
+        panic(r)
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
@@ -0,0 +1,102 @@
+package ManagedMap
+
+// WithCopyOnWrite is an Option for read-mostly maps that lets Get, Has, Peek and Keys
+// run without taking any lock. Every write, including the removal of an expired or
+// exhausted item, copies the underlying go map under the write lock and atomically
+// swaps in the copy as the snapshot that readers use. Writes become O(n) in the size of
+// the map, so this is only worthwhile when writes and removals are rare compared to
+// reads. Access counts are kept on the items that snapshots share, so Get still
+// consumes accesses, and the item state readers use, such as the value and the
+// deadline, is read and written atomically.
+func WithCopyOnWrite() Option {
+    return func(t *managedMap) {
+        t.copyOnWrite = true
+        t.publish()
+    }
+}
+
+// publish is a private method of a managedMap that swaps in a copy of the underlying
+// go map as the snapshot read by Get and Has when copy-on-write is enabled. It must be
+// called with the write lock held after every change to the map.
+func (t *managedMap) publish() {
+    if !t.copyOnWrite {
+        return
+    }
+    if t.m == nil {
+        t.snapshot.Store(nil)
+        return
+    }
+    m := make(map[interface{}] *item, len(t.m))
+    for key, value := range t.m {
+        m[key] = value
+    }
+    t.snapshot.Store(&m)
+}
+
+// loadSnapshot is a private method of a managedMap that returns the copy-on-write
+// snapshot read by the lock-free methods. It panics if the map is closed, unless the map
+// is in its close grace period, in which case it returns nil and false.
+func (t *managedMap) loadSnapshot() (map[interface{}] *item, bool) {
+    m := t.snapshot.Load()
+    // Panic if managedMap is closed
+    if m == nil {
+        if t.inGrace() {
+            return nil, false
+        }
+        panic("Could not perform Close on a closed managedMap")
+    }
+    return *m, true
+}
+
+// getSnapshot is a private method of a managedMap that implements Get against the
+// copy-on-write snapshot without taking a lock.
+func (t *managedMap) getSnapshot(key interface{}) (interface{}, bool) {
+    m, ok := t.loadSnapshot()
+    if !ok {
+        return nil, false
+    }
+    item, has := m[key]
+    if !has {
+        return nil, false
+    }
+    value, _, has := t.consume(key, item)
+    return value, has
+}
+
+// hasSnapshot is a private method of a managedMap that implements Has against the
+// copy-on-write snapshot without taking a lock.
+func (t *managedMap) hasSnapshot(key interface{}) bool {
+    m, ok := t.loadSnapshot()
+    if !ok {
+        return false
+    }
+    value, has := m[key]
+    return has && !value.pending()
+}
+
+// peekSnapshot is a private method of a managedMap that implements Peek against the
+// copy-on-write snapshot without taking a lock.
+func (t *managedMap) peekSnapshot(key interface{}) (interface{}, bool) {
+    m, ok := t.loadSnapshot()
+    if !ok {
+        return nil, false
+    }
+    item, has := m[key]
+    if !has || item.pending() {
+        return nil, false
+    }
+    return t.decode(item.load()), true
+}
+
+// keysSnapshot is a private method of a managedMap that implements Keys against the
+// copy-on-write snapshot without taking a lock.
+func (t *managedMap) keysSnapshot() []interface{} {
+    m, _ := t.loadSnapshot()
+    keys := make([]interface{}, 0, len(m))
+    for k, v := range m {
+        if !v.pending() {
+            keys = append(keys, k)
+        }
+    }
+    return keys
+}
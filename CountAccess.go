@@ -0,0 +1,36 @@
+package ManagedMap
+
+import (
+    "context"
+)
+
+// countAccessKey is the private type of the context key under which WithCountAccess
+// stores whether reads through GetCtx consume an access. Being unexported it can not
+// collide with keys set by other packages.
+type countAccessKey struct{}
+
+// WithCountAccess returns a copy of ctx that tells GetCtx whether reads made with it
+// consume an access. Metered code paths, such as user requests, set it to true while
+// internal or system reads leave it unset, so both can read the same key without the
+// latter using up its budget.
+func WithCountAccess(ctx context.Context, count bool) context.Context {
+    return context.WithValue(ctx, countAccessKey{}, count)
+}
+
+// countsAccess is a private function that reports whether ctx was marked by
+// WithCountAccess to consume accesses.
+func countsAccess(ctx context.Context) bool {
+    count, _ := ctx.Value(countAccessKey{}).(bool)
+    return count
+}
+
+// GetCtx is a method of a managedMap that reads key like Get when ctx was marked with
+// WithCountAccess(ctx, true), consuming an access, and like Peek otherwise, leaving the
+// access count untouched. A context without the mark is not counted. GetCtx will always
+// panic when called after the Close method has been called.
+func (t *managedMap) GetCtx(ctx context.Context, key interface{}) (interface{}, bool) {
+    if countsAccess(ctx) {
+        return t.Get(key)
+    }
+    return t.Peek(key)
+}
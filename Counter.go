@@ -0,0 +1,50 @@
+package ManagedMap
+
+import (
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// IncrementCapped is a method of a managedMap that adds delta to the int64 counter stored
+// at key and returns the new count and whether it is at most cap, which makes the map
+// usable as a fixed window rate limiter. A missing counter is created holding delta with
+// a timeout of window and the map's default access count, so the count starts over once
+// the window has passed. Incrementing does not extend the window or consume accesses. A
+// counter over cap is still stored and keeps counting, so callers over the limit stay
+// over it until the window ends. IncrementCapped panics if key holds a value that is not
+// an int64, and will always panic when called after the Close method has been called.
+func (t *managedMap) IncrementCapped(key interface{}, delta, cap int64, window time.Duration) (int64, bool) {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    // Counting is a no-op during the close grace period
+    if t.m == nil {
+        return 0, false
+    }
+    value, has := t.m[key]
+    // A counter whose window has passed or is out of accesses starts over unless its
+    // eviction is vetoed
+    if has && atomic.LoadUint64(&value.accessRemaining) == 0 {
+        has = !t.evict(key, value, EvictAccessExhausted)
+    } else if has && value.remaining() == 0 {
+        has = !t.evict(key, value, EvictExpired)
+    }
+    if !has {
+        config := Config{Timeout: window, AccessCount: t.default_access}.resolve()
+        t.markDirty(t.insert(key, t.mustEncode(delta), config.Timeout, config.Timeout, config.AccessCount))
+        return delta, delta <= cap
+    }
+    count, ok := t.decode(value.load()).(int64)
+    if !ok {
+        panic(fmt.Sprintf("ManagedMap: value of type %T at key %v is not an int64 counter", t.decode(value.load()), key))
+    }
+    count += delta
+    old := value.load()
+    value.store(t.intern(t.mustEncode(count)))
+    t.unintern(old)
+    t.markDirty(value)
+    return count, count <= cap
+}
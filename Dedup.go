@@ -0,0 +1,64 @@
+package ManagedMap
+
+import (
+    "reflect"
+)
+
+// sharedValue is a private struct that holds the single stored copy of a value and the
+// number of items referring to it when value deduplication is enabled.
+type sharedValue struct {
+    value interface{}
+    refs int
+}
+
+// dedupTable is a private struct that maps each distinct stored value to its shared
+// copy. Values are only stored and replaced under the write lock of the map, which also
+// guards the table.
+type dedupTable struct {
+    values map[interface{}] *sharedValue
+}
+
+// WithDedupValues is an Option for maps where many keys hold equal values. Each distinct
+// comparable value is stored once and shared by every item holding an equal value, with
+// a reference count that is decremented as items are removed and replaced. The shared
+// copy is released once no item refers to it. Values that can not be compared with the
+// == operator, such as slices and maps, are stored as they are. Removing one key never
+// affects the value held by the others.
+func WithDedupValues() Option {
+    return func(t *managedMap) {
+        t.dedup = &dedupTable{values: make(map[interface{}] *sharedValue)}
+    }
+}
+
+// intern is a private method of a managedMap that returns the shared copy of value and
+// records one more reference to it when value deduplication is enabled. The caller must
+// hold the write lock.
+func (t *managedMap) intern(value interface{}) interface{} {
+    if t.dedup == nil || value == nil || !reflect.ValueOf(value).Comparable() {
+        return value
+    }
+    shared, has := t.dedup.values[value]
+    if !has {
+        shared = &sharedValue{value: value}
+        t.dedup.values[value] = shared
+    }
+    shared.refs++
+    return shared.value
+}
+
+// unintern is a private method of a managedMap that drops one reference to the shared
+// copy of value, releasing it when it is no longer referenced. The caller must hold the
+// write lock.
+func (t *managedMap) unintern(value interface{}) {
+    if t.dedup == nil || value == nil || !reflect.ValueOf(value).Comparable() {
+        return
+    }
+    shared, has := t.dedup.values[value]
+    if !has {
+        return
+    }
+    shared.refs--
+    if shared.refs <= 0 {
+        delete(t.dedup.values, value)
+    }
+}
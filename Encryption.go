@@ -0,0 +1,78 @@
+package ManagedMap
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/gob"
+    "errors"
+    "fmt"
+)
+
+// ErrDecryption is returned by Load when an encrypted snapshot can not be decrypted,
+// which usually means it was saved with a different encryption key.
+var ErrDecryption = errors.New("ManagedMap: could not decrypt value, the encryption key may be wrong")
+
+// WithValueEncryption is an Option that keeps values encrypted with AES-GCM under key
+// while they are stored, decrypting them whenever they are read, so values do not appear
+// in a dump of the process memory and snapshots written by Save hold only ciphertext.
+// Values are marshaled before they are encrypted, with the serializer set by
+// WithSerializer or else with encoding/gob, in which case value types must be registered
+// with RegisterType. key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256 and the Option panics otherwise. Loading a snapshot saved with a different key
+// returns ErrDecryption.
+func WithValueEncryption(key []byte) Option {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        panic(fmt.Sprintf("ManagedMap: invalid encryption key: %v", err))
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        panic(fmt.Sprintf("ManagedMap: invalid encryption key: %v", err))
+    }
+    return func(t *managedMap) {
+        t.aead = aead
+    }
+}
+
+// seal is a private method of a managedMap that encrypts data under a fresh random nonce,
+// which is stored in front of the ciphertext.
+func (t *managedMap) seal(data []byte) []byte {
+    nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize() + len(data) + t.aead.Overhead())
+    if _, err := rand.Read(nonce); err != nil {
+        panic(fmt.Sprintf("ManagedMap: could not generate a nonce: %v", err))
+    }
+    return t.aead.Seal(nonce, nonce, data, nil)
+}
+
+// open is a private method of a managedMap that decrypts data sealed by seal, returning
+// ErrDecryption if it was not sealed with the map's key.
+func (t *managedMap) open(data []byte) ([]byte, error) {
+    if len(data) < t.aead.NonceSize() {
+        return nil, ErrDecryption
+    }
+    nonce, ciphertext := data[:t.aead.NonceSize()], data[t.aead.NonceSize():]
+    plain, err := t.aead.Open(nil, nonce, ciphertext, nil)
+    if err != nil {
+        return nil, ErrDecryption
+    }
+    return plain, nil
+}
+
+// gobMarshal is a private function that marshals value with encoding/gob for maps that
+// encrypt values without a serializer.
+func gobMarshal(value interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// gobUnmarshal is a private function that unmarshals a value marshaled by gobMarshal.
+func gobUnmarshal(data []byte) (interface{}, error) {
+    var value interface{}
+    err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+    return value, err
+}
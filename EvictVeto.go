@@ -0,0 +1,108 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// EvictReason describes why an item is being removed from a managedMap. Only the
+// automatic removals, EvictExpired, EvictAccessExhausted and EvictCapacity, are ever
+// passed to a veto.
+type EvictReason int
+
+const (
+    // EvictExpired is the reason given for an item whose timeout has passed.
+    EvictExpired EvictReason = iota
+    // EvictAccessExhausted is the reason given for an item with no accesses remaining.
+    EvictAccessExhausted
+    // EvictLifetimeExceeded is the reason given for an item older than the maximum
+    // lifetime set with WithMaxLifetime.
+    EvictLifetimeExceeded
+    // EvictRemoved is the reason given for an item removed explicitly, by Remove, Clear,
+    // SwapOut, EvictWhere, an UnsafeMap or being replaced by Load or MoveEntry.
+    EvictRemoved
+    // EvictClosed is the reason given for an item torn down by Close.
+    EvictClosed
+    // EvictCapacity is the reason given for the least recently used item of a full map
+    // with a MaxSize, evicted to make room for a new key.
+    EvictCapacity
+)
+
+// String returns the name of the EvictReason.
+func (r EvictReason) String() string {
+    switch r {
+    case EvictExpired:
+        return "Expired"
+    case EvictAccessExhausted:
+        return "AccessExhausted"
+    case EvictLifetimeExceeded:
+        return "LifetimeExceeded"
+    case EvictRemoved:
+        return "Removed"
+    case EvictClosed:
+        return "Closed"
+    case EvictCapacity:
+        return "Capacity"
+    }
+    return "Unknown"
+}
+
+// WithEvictVeto returns an Option that lets the application keep items that are about
+// to be automatically removed. veto is called with the key, value and reason of every
+// eviction, and returning true cancels it: the item's timer is re-armed with the map's
+// default timeout, and an item that ran out of accesses is given the map's default
+// access count again. A full map with a MaxSize whose victim is kept evicts the next one
+// its EvictionPolicy picks instead, and grows past its MaxSize if every item is kept.
+// Removal with Remove and Close and removal after the maximum lifetime set by
+// WithMaxLifetime are never vetoed. veto is called while the write lock is held, so it
+// must not call back into the map. Every cancelled eviction is counted by the Vetoes field
+// of Stats so retention loops can be spotted.
+func WithEvictVeto(veto func(key, value interface{}, reason EvictReason) bool) Option {
+    return func(t *managedMap) {
+        t.veto = veto
+    }
+}
+
+// vetoed is a private method of a managedMap that asks the veto callback whether the
+// item stored at key should be kept and, if so, renews it. The caller must hold the
+// write lock.
+func (t *managedMap) vetoed(key interface{}, it *item, reason EvictReason) bool {
+    if t.veto == nil || !t.veto(key, t.decode(it.load()), reason) {
+        return false
+    }
+    atomic.AddInt64(&t.vetoes, 1)
+    defaults := t.defaults()
+    if reason == EvictAccessExhausted {
+        atomic.StoreUint64(&it.accessRemaining, defaults.AccessCount)
+    }
+    t.arm(key, it, defaults.Timeout)
+    return true
+}
+
+// WithOnExpire returns an Option that calls onExpire with the key and value of every item
+// removed because its timeout or maximum lifetime passed. It is not called for items that
+// ran out of accesses, items whose expiry was vetoed or items removed with Remove or
+// Close. The item is deleted and onExpire is called under the same hold of the write
+// lock, so no Put can re-insert the key until onExpire has returned and the value passed
+// to it is always the one being expired, never a replacement. For the same reason
+// onExpire must not call back into the map. WithOnEvictLocked gives the same guarantee
+// for every way an item leaves the map. Its callback runs before onExpire, and the
+// callback of WithOnEvict after both, once the write lock is released.
+func WithOnExpire(onExpire func(key, value interface{})) Option {
+    return func(t *managedMap) {
+        t.onExpire = onExpire
+    }
+}
+
+// WithMaxLifetime returns an Option that caps how long any item can stay in the map,
+// counted from when it was first inserted, no matter how often it is renewed by
+// TouchAll, UpdateIfStale, Unpin or an evict veto. Renewals never arm an item's expiry
+// past the end of its lifetime and items with an infinite timeout expire at the end of
+// it too, with the reason EvictLifetimeExceeded, which can not be vetoed. Updating the
+// value of a key with Put does not make the item any younger. Pinned items are still
+// exempt from removal until they are unpinned.
+func WithMaxLifetime(d time.Duration) Option {
+    return func(t *managedMap) {
+        t.maxLifetime = d
+    }
+}
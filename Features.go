@@ -0,0 +1,93 @@
+package ManagedMap
+
+import (
+    "time"
+)
+
+// FeatureSet describes the configuration of a managedMap as set by its constructor and
+// Options. Durations and sizes are zero when the matching Option was not used.
+type FeatureSet struct {
+    // DefaultTimeout, DefaultAccessCount, DefaultSlideOnAccess, DefaultPriority, MaxSize
+    // and EvictionPolicy are the Config the map was created with.
+    DefaultTimeout time.Duration
+    DefaultAccessCount uint64
+    DefaultSlideOnAccess bool
+    DefaultPriority int
+    MaxSize int
+    EvictionPolicy EvictionPolicy
+    Tracer bool
+    KeyTypeCheck bool
+    CopyOnWrite bool
+    TTLResolution time.Duration
+    DedupValues bool
+    SharedScheduler bool
+    PerItemTimers bool
+    MaxGoroutines int64
+    ManualExpiry bool
+    AdaptiveTTL bool
+    MaxValueSize int64
+    // Serializer is also set when Encryption is, as encrypted values are always marshaled.
+    Serializer bool
+    Encryption bool
+    Loader bool
+    // MaxConcurrentLoads is zero when the number of concurrent loads is not limited.
+    MaxConcurrentLoads int
+    ServeStaleOnError bool
+    WriteBack bool
+    FlushRetries int
+    EvictVeto bool
+    OnExpire bool
+    OnEvict bool
+    OnEvictLocked bool
+    CloseGrace time.Duration
+    MaxLifetime time.Duration
+    MetricsInterval time.Duration
+    CompactThreshold float64
+    SnapshotCompression Compression
+    // VirtualNodes is zero when WithConsistentHashing was not used.
+    VirtualNodes int
+}
+
+// Features is a method of a managedMap that returns the features it was configured with,
+// so code that is handed a map can check it is set up as expected. The configuration
+// never changes after construction, apart from the MaxSize of a shard when Reshard
+// splits it again, so Features takes no lock and may be called after the Close method
+// has been called.
+func (t *managedMap) Features() FeatureSet {
+    return FeatureSet{
+        DefaultTimeout: t.default_timeout,
+        DefaultAccessCount: t.default_access,
+        DefaultSlideOnAccess: t.default_slide,
+        DefaultPriority: t.default_priority,
+        MaxSize: int(t.maxSize.Load()),
+        EvictionPolicy: t.policy,
+        Tracer: t.tracer != nil,
+        KeyTypeCheck: t.keyTypeCheck,
+        CopyOnWrite: t.copyOnWrite,
+        TTLResolution: t.resolution,
+        DedupValues: t.dedup != nil,
+        SharedScheduler: t.scheduler != nil && !t.ownScheduler,
+        PerItemTimers: t.perItemTimers,
+        MaxGoroutines: t.maxGoroutines,
+        ManualExpiry: t.manualExpiry,
+        AdaptiveTTL: t.adaptive != nil,
+        MaxValueSize: t.maxValueSize,
+        Serializer: t.marshal != nil,
+        Encryption: t.aead != nil,
+        Loader: t.loader != nil,
+        MaxConcurrentLoads: cap(t.loadSlots),
+        ServeStaleOnError: t.serveStale,
+        WriteBack: t.writeBack != nil,
+        FlushRetries: t.flushRetries,
+        EvictVeto: t.veto != nil,
+        OnExpire: t.onExpire != nil,
+        OnEvict: t.onEvict != nil,
+        OnEvictLocked: t.onEvictLocked != nil,
+        CloseGrace: t.closeGrace,
+        MaxLifetime: t.maxLifetime,
+        MetricsInterval: t.metricsInterval,
+        CompactThreshold: t.compactThreshold,
+        SnapshotCompression: t.compression,
+        VirtualNodes: t.virtualNodes,
+    }
+}
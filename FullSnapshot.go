@@ -0,0 +1,124 @@
+package ManagedMap
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/gob"
+    "errors"
+    "io"
+)
+
+// ErrSnapshotVersion is returned by RestoreFull when a snapshot was written by a newer
+// version of SnapshotFull than this package can read.
+var ErrSnapshotVersion = errors.New("ManagedMap: full snapshot version is not supported")
+
+// fullSnapshotMagic begins every snapshot written by SnapshotFull. It is followed by a
+// byte holding the format version and a byte holding the Compression of the rest.
+const fullSnapshotMagic = "MMAPFULL"
+
+// fullSnapshotVersion is the format version SnapshotFull writes. Version 1 is a gob
+// encoded fullSnapshot. A change that older readers can not decode, such as removing or
+// retyping a field, must increase it; fields added to fullSnapshot or persistedItem do
+// not need to, as gob skips fields it does not know and zeroes fields that are missing.
+const fullSnapshotVersion byte = 1
+
+// fullSnapshot is a private struct holding the state written by SnapshotFull. Items are
+// ordered from the least to the most recently used.
+type fullSnapshot struct {
+    Policy EvictionPolicy
+    Items []persistedItem
+}
+
+// SnapshotFull is a method of a managedMap that writes every readable item to w like
+// Save, along with the state its eviction policy uses, so RestoreFull can rebuild a map
+// that evicts in the same order: the recency order of the items, how many times each
+// was used and their priority. The map's EvictionPolicy is saved for reference. A map
+// without a MaxSize tracks no recency, so its items are saved in no particular order.
+// The snapshot starts with a header holding its format version, so RestoreFull can
+// refuse formats it does not know, and is compressed as set by WithSnapshotCompression.
+// Key and value types must be registered with RegisterType. SnapshotFull will always
+// panic when called after the Close method has been called.
+func (t *managedMap) SnapshotFull(w io.Writer) error {
+    snapshot := fullSnapshot{Policy: t.policy, Items: t.persistedFull()}
+    if _, err := io.WriteString(w, fullSnapshotMagic + string([]byte{fullSnapshotVersion, byte(t.compression)})); err != nil {
+        return err
+    }
+    if t.compression != GzipCompression {
+        return gob.NewEncoder(w).Encode(snapshot)
+    }
+    zw := gzip.NewWriter(w)
+    if err := gob.NewEncoder(zw).Encode(snapshot); err != nil {
+        return err
+    }
+    return zw.Close()
+}
+
+// persistedFull is a private method of a managedMap that returns the state of every
+// readable item for SnapshotFull, from the least to the most recently used when the map
+// tracks recency.
+func (t *managedMap) persistedFull() []persistedItem {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    items := make([]persistedItem, 0, len(t.m))
+    add := func(k interface{}, v *item) {
+        if v.pending() {
+            return
+        }
+        item := t.persist(k, v, true)
+        item.Uses = v.uses.Load()
+        items = append(items, item)
+    }
+    if t.lru == nil {
+        for k, v := range t.m {
+            add(k, v)
+        }
+        return items
+    }
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    for e := t.lru.Back(); e != nil; e = e.Prev() {
+        add(e.Value, t.m[e.Value])
+    }
+    return items
+}
+
+// RestoreFull is a method of a managedMap that reads a snapshot written by SnapshotFull
+// from r and stores its items like Load, restoring their recency order, use counts and
+// priorities so the map evicts them in the same order the saved map would have. The map
+// keeps its own MaxSize and EvictionPolicy; restoring more items than fit evicts the
+// least recently used of them. ErrInvalidSnapshot is returned if r does not hold a full
+// snapshot and ErrSnapshotVersion if it was written in a newer format. RestoreFull will
+// always panic when called after the Close method has been called.
+func (t *managedMap) RestoreFull(r io.Reader) error {
+    br := bufio.NewReader(r)
+    header := make([]byte, len(fullSnapshotMagic) + 2)
+    if _, err := io.ReadFull(br, header); err != nil || string(header[:len(fullSnapshotMagic)]) != fullSnapshotMagic {
+        return ErrInvalidSnapshot
+    }
+    switch version := header[len(fullSnapshotMagic)]; {
+    case version == 0:
+        return ErrInvalidSnapshot
+    case version > fullSnapshotVersion:
+        return ErrSnapshotVersion
+    }
+    var src io.Reader = br
+    switch Compression(header[len(fullSnapshotMagic) + 1]) {
+    case NoCompression:
+    case GzipCompression:
+        zr, err := gzip.NewReader(br)
+        if err != nil {
+            return err
+        }
+        defer zr.Close()
+        src = zr
+    default:
+        return ErrInvalidSnapshot
+    }
+    var snapshot fullSnapshot
+    if err := gob.NewDecoder(src).Decode(&snapshot); err != nil {
+        return err
+    }
+    return t.storePersisted(snapshot.Items)
+}
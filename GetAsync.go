@@ -0,0 +1,49 @@
+package ManagedMap
+
+import (
+    "context"
+    "fmt"
+)
+
+// Result is the outcome of a GetAsync lookup. OK reports whether Value is the value of
+// the key, either because it was in the map or because it was loaded. Err holds the
+// error of a failed load.
+type Result struct {
+    Value interface{}
+    Err error
+    OK bool
+}
+
+// GetAsync is a method of a managedMap that looks up key without blocking the caller. The
+// returned channel delivers exactly one Result and is then closed, so a receive after the
+// Result has been taken yields the zero Result. A hit delivers the value immediately and
+// consumes an access like Get. A miss loads the key in the background as GetLoad does,
+// sharing the load with any concurrent GetAsync or GetLoad calls for the key, and
+// delivers once the load completes. The channel is buffered so the background load never
+// blocks on a caller that stops listening. Without a Loader a miss delivers ErrNoLoader.
+// GetAsync will always panic when called after the Close method has been called, and a
+// load that finishes after the map is closed delivers ErrClosed.
+func (t *managedMap) GetAsync(key interface{}) <-chan Result {
+    results := make(chan Result, 1)
+    if value, has := t.traceGet(key); has {
+        results <- Result{Value: value, OK: true}
+        close(results)
+        return results
+    }
+    go func() {
+        defer close(results)
+        defer func() {
+            if r := recover(); r != nil {
+                if t.IsClosed() {
+                    results <- Result{Err: ErrClosed}
+                    return
+                }
+                results <- Result{Err: fmt.Errorf("ManagedMap: %v", r)}
+            }
+        }()
+        // The key has already been looked up, so it is not counted or traced again
+        value, err := t.loadMissing(context.Background(), key)
+        results <- Result{Value: value, Err: err, OK: err == nil}
+    }()
+    return results
+}
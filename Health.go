@@ -0,0 +1,64 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// Health is the struct returned by the Health method of a managedMap describing whether
+// the map is running degraded.
+type Health struct {
+    // Goroutines is the number of per-item goroutines currently running.
+    Goroutines int64
+    // MaxGoroutines is the cap set with WithMaxGoroutines, or zero without a cap.
+    MaxGoroutines int64
+    // DegradedItems is the number of items whose expiry runs without a goroutine of
+    // their own because the goroutine cap was reached when they were armed.
+    DegradedItems int64
+    // Degraded is true while any item is expiring in degraded mode.
+    Degraded bool
+}
+
+// WithMaxGoroutines returns an Option that caps the number of per-item goroutines the map
+// keeps at n, so a burst of Puts can not contribute to goroutine exhaustion. Once the cap
+// is reached new items are expired by a timer callback instead, which only runs a
+// goroutine for the moment the item expires. The items expire exactly as they would
+// otherwise; Health reports the map as degraded while any of them remain. Only maps
+// created WithPerItemTimers start per-item goroutines, so the cap has no effect on any
+// other map.
+func WithMaxGoroutines(n int) Option {
+    return func(t *managedMap) {
+        if n <= 0 {
+            return
+        }
+        t.maxGoroutines = int64(n)
+    }
+}
+
+// Health is a method of a managedMap that reports whether the map is running degraded
+// because of its goroutine cap. Health does not take the lock and may be called after
+// the Close method has been called.
+func (t *managedMap) Health() Health {
+    degraded := atomic.LoadInt64(&t.degraded)
+    return Health{
+        Goroutines: atomic.LoadInt64(&t.goroutines),
+        MaxGoroutines: t.maxGoroutines,
+        DegradedItems: degraded,
+        Degraded: degraded > 0,
+    }
+}
+
+// armDegraded is a private method of a managedMap that arms an item with a timer whose
+// callback expires it, in place of a timer and a goroutine waiting on it. Later arms
+// reset the same timer. The caller must hold the write lock.
+func (t *managedMap) armDegraded(key interface{}, it *item, d time.Duration) {
+    it.degraded = true
+    atomic.AddInt64(&t.degraded, 1)
+    it.timer = time.AfterFunc(d, func() {
+        t.lock.Lock()
+        defer t.unlock()
+        if t.m != nil && t.m[key] == it && t.due(it) {
+            t.evict(key, it, EvictExpired)
+        }
+    })
+}
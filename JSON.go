@@ -0,0 +1,97 @@
+package ManagedMap
+
+import (
+    "encoding/json"
+    "math"
+    "time"
+)
+
+// jsonItem is a private struct holding the state of an item written by MarshalJSON. A
+// zero Timeout or Accesses means infinite, as in a Config, Remaining is the time left
+// before a finite timeout passes and Age is how long ago the item was first inserted.
+// Value holds the ciphertext of the value when Encrypted is set.
+type jsonItem struct {
+    Key interface{} `json:"key"`
+    Value json.RawMessage `json:"value"`
+    Encrypted bool `json:"encrypted,omitempty"`
+    Timeout time.Duration `json:"timeout,omitempty"`
+    Remaining time.Duration `json:"remaining,omitempty"`
+    Accesses uint64 `json:"accesses,omitempty"`
+    SlideOnAccess bool `json:"slideOnAccess,omitempty"`
+    Age time.Duration `json:"age,omitempty"`
+    Priority int `json:"priority,omitempty"`
+}
+
+// MarshalJSON is a method of a managedMap that implements json.Marshaler, writing every
+// readable item as a JSON array of objects holding its key, value, timeout, remaining
+// time, remaining accesses and priority. The items are copied under the read lock like
+// Save, so no accesses are consumed and no timers are touched. Keys and values must be
+// encodable by encoding/json, and keys should be strings as JSON has no other way to
+// tell them apart: numbers come back as float64 and objects can not be map keys at all.
+// MarshalJSON will always panic when called after the Close method has been called.
+func (t *managedMap) MarshalJSON() ([]byte, error) {
+    items := t.persisted(true)
+    out := make([]jsonItem, len(items))
+    for n, i := range items {
+        value, err := json.Marshal(i.Value)
+        if err != nil {
+            return nil, err
+        }
+        out[n] = jsonItem{Key: i.Key, Value: value, Encrypted: i.Encrypted, Accesses: i.Accesses, SlideOnAccess: i.SlideOnAccess, Age: time.Since(i.Created), Priority: i.Priority}
+        if out[n].Accesses == math.MaxUint64 {
+            out[n].Accesses = 0
+        }
+        if i.Timeout != math.MaxInt64 {
+            out[n].Timeout = i.Timeout
+            // A remaining time of zero would read back as infinite
+            if out[n].Remaining = time.Until(i.Deadline); out[n].Remaining <= 0 {
+                out[n].Remaining = 1
+            }
+        }
+    }
+    return json.Marshal(out)
+}
+
+// UnmarshalJSON is a method of a managedMap that implements json.Unmarshaler, storing
+// the items written by MarshalJSON like Load does. Each item's timer is armed with its
+// stored remaining time and it keeps its remaining accesses. The map must have been
+// created by one of the constructors. ErrKeyNotComparable is returned, and nothing is
+// stored, if a key can not be used as a map key, such as a JSON object. UnmarshalJSON
+// will always panic when called after the Close method has been called.
+func (t *managedMap) UnmarshalJSON(data []byte) error {
+    var in []jsonItem
+    if err := json.Unmarshal(data, &in); err != nil {
+        return err
+    }
+    now := time.Now()
+    items := make([]persistedItem, len(in))
+    for n, i := range in {
+        if !comparableKey(i.Key) {
+            return ErrKeyNotComparable
+        }
+        items[n] = persistedItem{Key: i.Key, Encrypted: i.Encrypted, Timeout: math.MaxInt64, Accesses: math.MaxUint64, SlideOnAccess: i.SlideOnAccess, Priority: i.Priority}
+        // Encrypted values are ciphertext, which encoding/json writes as base64
+        var err error
+        if i.Encrypted {
+            var sealed []byte
+            err = json.Unmarshal(i.Value, &sealed)
+            items[n].Value = sealed
+        } else {
+            err = json.Unmarshal(i.Value, &items[n].Value)
+        }
+        if err != nil {
+            return err
+        }
+        if i.Accesses != 0 {
+            items[n].Accesses = i.Accesses
+        }
+        if i.Age > 0 {
+            items[n].Created = now.Add(-i.Age)
+        }
+        if i.Timeout != 0 {
+            items[n].Timeout = i.Timeout
+            items[n].Deadline = now.Add(i.Remaining)
+        }
+    }
+    return t.storePersisted(items)
+}
@@ -0,0 +1,50 @@
+package ManagedMap
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+)
+
+// ErrKeyNotComparable is returned by PutChecked and GetChecked when the key can not be
+// compared with the == operator and so can not be used as a go map key.
+var ErrKeyNotComparable = errors.New("ManagedMap: key is not comparable and can not be used as a map key")
+
+// WithKeyTypeCheck is an Option, intended for debugging, that checks every key passed
+// to Get, Put, PutCustom, Has and Remove before the underlying go map is touched. A key
+// that can not be compared with the == operator causes a panic naming the offending
+// type rather than the runtime's 'hash of unhashable type' panic. The check uses
+// reflection on every call so it is not enabled by default.
+func WithKeyTypeCheck() Option {
+    return func(t *managedMap) {
+        t.keyTypeCheck = true
+    }
+}
+
+// checkKeyType is a private method of a managedMap that panics if the key type check
+// is enabled and the passed key can not be used as a go map key.
+func (t *managedMap) checkKeyType(key interface{}) {
+    if !t.keyTypeCheck {
+        return
+    }
+    if !comparableKey(key) {
+        panic(fmt.Sprintf("ManagedMap: key of type %T is not comparable and can not be used as a map key", key))
+    }
+}
+
+// comparableKey is a private function that reports whether key can be used as a go map
+// key without panicking.
+func comparableKey(key interface{}) bool {
+    return key == nil || reflect.ValueOf(key).Comparable()
+}
+
+// GetChecked is a method of a managedMap that works like Get but returns
+// ErrKeyNotComparable instead of panicking when the key can not be used as a map key.
+// GetChecked will always panic when called after the Close method has been called.
+func (t *managedMap) GetChecked(key interface{}) (interface{}, bool, error) {
+    if !comparableKey(key) {
+        return nil, false, ErrKeyNotComparable
+    }
+    value, has := t.Get(key)
+    return value, has, nil
+}
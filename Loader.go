@@ -0,0 +1,243 @@
+package ManagedMap
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "sync/atomic"
+)
+
+// ErrNoLoader is returned by GetLoad when the map was created without a Loader.
+var ErrNoLoader = errors.New("ManagedMap: no loader configured")
+
+// ErrLoaderPanicked is returned by GetLoad to callers waiting on a load of the key
+// whose Loader panicked. The panic itself is passed on to the caller that ran the load.
+var ErrLoaderPanicked = errors.New("ManagedMap: loader panicked")
+
+// Loader is a function used by GetLoad to load the value of a key that is missing from
+// the map, typically from a slower backing store.
+type Loader func(ctx context.Context, key interface{}) (interface{}, error)
+
+// ConfigLoader is a Loader that also returns the Config a loaded value is stored with,
+// so its timeout and access count can be derived from the value itself, for example
+// from the freshness lifetime of a cached response. A zero Config stores the value with
+// the map's default timeout and access count.
+type ConfigLoader func(ctx context.Context, key interface{}) (interface{}, Config, error)
+
+// WithLoader is an Option that sets the Loader used by GetLoad, and by Get for keys that
+// are missing.
+func WithLoader(loader Loader) Option {
+    return func(t *managedMap) {
+        t.loader = func(ctx context.Context, key interface{}) (interface{}, Config, error) {
+            value, err := loader(ctx, key)
+            return value, Config{}, err
+        }
+    }
+}
+
+// WithConfigLoader is an Option that sets a ConfigLoader used by GetLoad and Get in place
+// of a Loader. It replaces any Loader set with WithLoader.
+func WithConfigLoader(loader ConfigLoader) Option {
+    return func(t *managedMap) {
+        t.loader = loader
+    }
+}
+
+// WithMaxConcurrentLoads is an Option that limits the number of Loader calls the map runs
+// at once to n, protecting the backend from a burst of misses of distinct keys. Loads
+// over the limit wait for a running load to finish, or return the context's error if
+// their context is done first. Loads of the same key are already coalesced and only
+// take one slot. The number of loads running is reported by the InFlightLoads field of
+// Stats.
+func WithMaxConcurrentLoads(n int) Option {
+    return func(t *managedMap) {
+        t.loadSlots = make(chan struct{}, n)
+    }
+}
+
+// load is a private method of a managedMap that calls its Loader for key once a load
+// slot is free, if the number of concurrent loads is limited.
+func (t *managedMap) load(ctx context.Context, key interface{}) (interface{}, Config, error) {
+    if t.loadSlots != nil {
+        select {
+        case t.loadSlots <- struct{}{}:
+            defer func() { <-t.loadSlots }()
+        case <-ctx.Done():
+            return nil, Config{}, ctx.Err()
+        }
+    }
+    atomic.AddInt64(&t.loading, 1)
+    defer atomic.AddInt64(&t.loading, -1)
+    return t.loader(ctx, key)
+}
+
+// WithServeStaleOnError is an Option that makes Get on a map with a Loader return the
+// last value a key held when loading it fails, keeping the map useful while the backend
+// is down. The last value of every automatically removed key is kept until the key is
+// stored again or removed with Remove, so values can be served long after they stopped
+// being fresh and a map with many distinct keys keeps one stale value for each of them.
+// Stale values are never served by GetLoad, which returns the error.
+func WithServeStaleOnError() Option {
+    return func(t *managedMap) {
+        t.serveStale = true
+        t.stale = make(map[interface{}] interface{})
+    }
+}
+
+// loadOnMiss is a private method of a managedMap that implements Get for a key missing
+// from a map with a Loader.
+func (t *managedMap) loadOnMiss(key interface{}) (interface{}, bool) {
+    // Get has already looked the key up, so it is not counted or traced again
+    value, err := t.loadMissing(context.Background(), key)
+    if err == nil {
+        return value, true
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    if data, has := t.stale[key]; has {
+        return t.decode(data), true
+    }
+    return nil, false
+}
+
+// call is a private struct that tracks a single in-flight load in a Group and which
+// maps have already stored its result.
+type call struct {
+    done chan struct{}
+    span Span
+    value interface{}
+    conf Config
+    err error
+    stored map[*managedMap] bool
+}
+
+// Group coalesces concurrent loads of the same key so the loader only runs once while
+// every caller waiting on the key receives its result. Every map has its own Group. A
+// Group can instead be shared between several maps that load from the same backend with
+// WithLoaderGroup, so that concurrent misses of a key in any of them cause a single
+// load, after which every waiting map stores the loaded value. Keys must therefore mean
+// the same thing in every map sharing a Group. A Group holds no goroutines or resources
+// between loads, so it needs no cleanup and may outlive the maps using it.
+type Group struct {
+    lock sync.Mutex
+    calls map[interface{}] *call
+}
+
+// NewGroup returns a pointer to an empty Group.
+func NewGroup() *Group {
+    return &Group{calls: make(map[interface{}] *call)}
+}
+
+// WithLoaderGroup is an Option that makes the map coalesce its loads through the passed
+// Group, which may be shared with other maps, instead of a Group of its own.
+func WithLoaderGroup(g *Group) Option {
+    return func(t *managedMap) {
+        t.group = g
+    }
+}
+
+// do is a private method of a Group that calls fn for key unless a call for key is
+// already in flight, in which case it waits for that call's result. span is the caller's
+// Load span, or nil if it is not traced; a waiting caller's span is linked to the span of
+// the call it waits on, if both exist and its span is a SpanLinker. A waiting caller
+// stops waiting with ctx.Err() if ctx is done first. A successful result is stored in
+// the caller's map t, with the Config returned by fn or the map's defaults if it is
+// zero, by the first caller of each map to receive it. do also reports whether the
+// result came from another caller's call.
+func (g *Group) do(ctx context.Context, t *managedMap, key interface{}, span Span, fn func() (interface{}, Config, error)) (interface{}, error, bool) {
+    g.lock.Lock()
+    c, shared := g.calls[key]
+    if shared {
+        g.lock.Unlock()
+        if linker, ok := span.(SpanLinker); ok && c.span != nil {
+            linker.AddLink(c.span)
+        }
+        select {
+        case <-c.done:
+        case <-ctx.Done():
+            return nil, ctx.Err(), true
+        }
+    } else {
+        c = &call{done: make(chan struct{}), span: span, stored: make(map[*managedMap] bool)}
+        g.calls[key] = c
+        g.lock.Unlock()
+        g.run(key, c, fn)
+    }
+    if c.err != nil {
+        return nil, c.err, shared
+    }
+    g.store(t, key, c)
+    return c.value, nil, shared
+}
+
+// store is a private method of a Group that stores the successful result of the call c in
+// map t, with the Config returned by the call or the map's defaults if it is zero, unless
+// a caller from t already has.
+func (g *Group) store(t *managedMap, key interface{}, c *call) {
+    g.lock.Lock()
+    store := !c.stored[t]
+    c.stored[t] = true
+    g.lock.Unlock()
+    if !store {
+        return
+    }
+    if c.conf == (Config{}) {
+        t.Put(key, c.value)
+    } else {
+        t.PutCustom(key, c.value, c.conf)
+    }
+}
+
+// run is a private method of a Group that calls fn for the in-flight call c. The call
+// is removed and its waiters are woken even if fn panics, in which case they receive
+// ErrLoaderPanicked and nothing is stored.
+func (g *Group) run(key interface{}, c *call, fn func() (interface{}, Config, error)) {
+    returned := false
+    defer func() {
+        if !returned {
+            c.value, c.err = nil, ErrLoaderPanicked
+        }
+        g.lock.Lock()
+        delete(g.calls, key)
+        g.lock.Unlock()
+        close(c.done)
+    }()
+    c.value, c.conf, c.err = fn()
+    returned = true
+}
+
+// GetLoad is a method of a managedMap that returns the value associated with key like
+// Get, loading it with the map's Loader when it is missing. The loaded value is stored
+// once per map, with the Config returned by a ConfigLoader or else the map's default
+// timeout and access count, and returned without consuming an access. Concurrent
+// GetLoad calls for the same key share a single load, which runs with the context of
+// the caller that started it. If the load fails its error is returned and nothing is
+// stored. ErrNoLoader is returned if the map has no Loader. GetLoad will always panic
+// when called after the Close method has been called.
+func (t *managedMap) GetLoad(ctx context.Context, key interface{}) (interface{}, error) {
+    if value, has := t.traceGet(key); has {
+        return value, nil
+    }
+    return t.loadMissing(ctx, key)
+}
+
+// loadMissing is a private method of a managedMap that implements GetLoad for a key that
+// was not found in the map.
+func (t *managedMap) loadMissing(ctx context.Context, key interface{}) (interface{}, error) {
+    if t.loader == nil {
+        return nil, ErrNoLoader
+    }
+    var span Span
+    if t.tracer != nil {
+        span = t.startSpan("Load", key)
+        defer span.End()
+    }
+    value, err, shared := t.group.do(ctx, t, key, span, func() (interface{}, Config, error) {
+        return t.load(ctx, key)
+    })
+    if span != nil {
+        span.SetAttribute("load.shared", shared)
+        span.SetAttribute("error", err != nil)
+    }
+    return value, err
+}
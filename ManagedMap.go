@@ -6,10 +6,14 @@ package ManagedMap
 // via the Methods provided in this package
 
 import (
+    "container/list"
+    "crypto/cipher"
     "time"
     "sync"
     "sync/atomic"
     "math"
+    "sort"
+    "unsafe"
 )
 
 const (
@@ -25,17 +29,72 @@ const (
 type Config struct {
     Timeout     time.Duration
     AccessCount uint64
+    // SlideOnAccess makes every successful read re-arm the item's timer to its full
+    // timeout, so items that keep being read stay alive and only idle ones expire. By
+    // default the timeout runs from insertion regardless of reads.
+    SlideOnAccess bool
+    // ShardCount is the number of shards NewCustomShardedManagedMap splits the map into,
+    // DefaultShardCount when not positive. The constructors of maps that are not sharded
+    // and the Config of a single item ignore it.
+    ShardCount int
+    // MaxSize caps the number of items NewCustomManagedMap's map holds. Inserting a new
+    // key into a full map evicts the least recently used item first, where reading an
+    // item's value or updating it counts as use. 0 means unlimited. It is ignored
+    // everywhere else.
+    MaxSize int
+    // EvictionPolicy selects the item a full map with a MaxSize evicts, LRU by default.
+    // It is ignored everywhere else.
+    EvictionPolicy EvictionPolicy
+    // Priority protects an item from capacity eviction: a full map with a MaxSize only
+    // evicts an item when every other candidate has the same or a higher priority, and
+    // picks among items of the lowest priority by its EvictionPolicy. 0 by default.
+    Priority int
 }
 
+// resolve is a private method of a Config that returns a copy with the '0' values,
+// which imply infinite, replaced by the maximum value of their types.
+func (c Config) resolve() Config {
+    if c.Timeout == 0 {
+        c.Timeout = math.MaxInt64
+    }
+    if c.AccessCount == 0 {
+        c.AccessCount = math.MaxUint64
+    }
+    return c
+}
+
+// Option is a function that configures optional behavior of a managedMap. Options
+// are passed to NewManagedMap or NewCustomManagedMap and are applied in order
+// before the map is returned.
+type Option func(*managedMap)
+
 // item is a private struct that manages the internal value of the map.
-// This manages the timer, the accesses, the data, and a closed channel.
+// This manages the timer, the accesses, the data, and a done channel.
 // item is unexported but allows the user to use any data they desire to be
 // stored in the map.
 type item struct {
     timer *time.Timer
+    bucket *bucket
+    scheduled *scheduleEntry
+    // timeout, deadline, slide and data are atomic because copy-on-write readers read them
+    // without a lock while writers change them under the write lock
+    timeout atomic.Int64
+    deadline atomic.Int64
+    created time.Time
+    expires time.Time
     accessRemaining uint64
-    data interface{}
-    removed chan bool
+    data atomic.Pointer[interface{}]
+    done chan struct{}
+    pinned atomic.Bool
+    dirty atomic.Bool
+    expiring atomic.Bool
+    degraded bool
+    slide atomic.Bool
+    priority int
+    hits atomic.Int64
+    adapted time.Time
+    lru *list.Element
+    uses atomic.Uint64
 }
 
 // managedMap is a private struct that manages the internals of the managedMap
@@ -45,27 +104,135 @@ type item struct {
 type managedMap struct {
     default_timeout time.Duration
     default_access  uint64
+    default_slide bool
+    default_priority int
     m map[interface{}] *item
     lock               *sync.RWMutex
+    tracer Tracer
+    keyTypeCheck bool
+    copyOnWrite bool
+    snapshot atomic.Pointer[map[interface{}] *item]
+    resolution time.Duration
+    buckets map[int64] *bucket
+    dedup *dedupTable
+    goroutines int64
+    maxGoroutines int64
+    manualExpiry bool
+    adaptive *adaptiveTTL
+    degraded int64
+    scheduler *Scheduler
+    ownScheduler bool
+    perItemTimers bool
+    maxValueSize int64
+    sizer func(value interface{}) int64
+    marshal func(value interface{}) ([]byte, error)
+    unmarshal func(data []byte) (interface{}, error)
+    aead cipher.AEAD
+    loader ConfigLoader
+    group *Group
+    loadSlots chan struct{}
+    stale map[interface{}] interface{}
+    serveStale bool
+    metricsInterval time.Duration
+    emit func(Stats)
+    compactThreshold float64
+    compression Compression
+    pending int64
+    compactions int64
+    stop chan struct{}
+    loading int64
+    veto func(key, value interface{}, reason EvictReason) bool
+    onExpire func(key, value interface{})
+    onEvict func(key, value interface{}, reason EvictReason)
+    onEvictLocked func(key, value interface{}, reason EvictReason)
+    // maxSize only changes when Reshard splits a MaxSize between a new number of shards
+    maxSize atomic.Int64
+    policy EvictionPolicy
+    lru *list.List
+    lruLock sync.Mutex
+    prioritized bool
+    evictLock sync.Mutex
+    evictions []eviction
+    vetoes int64
+    hits int64
+    misses int64
+    expirations int64
+    exhaustions int64
+    removals int64
+    capacityEvictions int64
+    closeGrace time.Duration
+    maxLifetime time.Duration
+    closedAt int64
+    onDrop func(key interface{})
+    writeBack func(key, value interface{}) error
+    deadLetters chan DeadLetter
+    flushRetries int
+    flushRetryDelay time.Duration
+    flushLock sync.Mutex
+    retries map[interface{}] uint64
+    retryGen uint64
+    retryDepth int64
+    virtualNodes int
 }
 
 // NewManagedMap returns a pointer to a managedMap with the default timeout and accessCount
-// as defined by the DefaultTimeout and DefaultAccessCount constants. 
-func NewManagedMap() *managedMap {
-    return NewCustomManagedMap(Config{Timeout: DefaultTimeout, AccessCount: DefaultAccessCount})
+// as defined by the DefaultTimeout and DefaultAccessCount constants. Any passed Options
+// are applied to the map before it is returned.
+func NewManagedMap(opts ...Option) *managedMap {
+    return NewCustomManagedMap(Config{Timeout: DefaultTimeout, AccessCount: DefaultAccessCount}, opts...)
 }
 
 // NewCustomManagedMap returns a pointer to a managedMap with the timeout and accessCount
-// defined by the passed Config struct.
-func NewCustomManagedMap(conf Config) *managedMap {
+// defined by the passed Config struct. Any passed Options are applied to the map before
+// it is returned. The returned map is never sharded, so the Config's ShardCount is
+// ignored; pass the same Config and Options to NewCustomShardedManagedMap to split the map
+// into ShardCount shards.
+func NewCustomManagedMap(conf Config, opts ...Option) *managedMap {
     m := make(map[interface{}] *item)
     lock := &sync.RWMutex{}
-    return &managedMap{
+    t := &managedMap{
         default_timeout: conf.Timeout,
         default_access: conf.AccessCount,
+        default_slide: conf.SlideOnAccess,
+        default_priority: conf.Priority,
+        policy: conf.EvictionPolicy,
+        lru: newRecency(conf.MaxSize),
         m: m,
         lock: lock,
     }
+    t.maxSize.Store(int64(conf.MaxSize))
+    for _, opt := range opts {
+        opt(t)
+    }
+    if t.group == nil {
+        t.group = NewGroup()
+    }
+    // Encrypted values are marshaled with gob unless a serializer is set
+    if t.aead != nil && t.marshal == nil {
+        t.marshal, t.unmarshal = gobMarshal, gobUnmarshal
+    }
+    // Without another way to expire items the map keeps a private Scheduler so no item
+    // needs a goroutine of its own
+    if t.scheduler == nil && t.resolution == 0 && !t.perItemTimers && !t.manualExpiry {
+        t.scheduler = NewScheduler()
+        t.ownScheduler = true
+        t.scheduler.Start()
+    }
+    // Background goroutines run until the map is closed
+    t.stop = make(chan struct{})
+    if t.emit != nil {
+        go t.emitMetrics()
+    }
+    if t.compactThreshold > 0 {
+        go t.monitorPending()
+    }
+    return t
+}
+
+// defaults is a private method of a managedMap that returns the map's default timeout
+// and access count with infinite values resolved.
+func (t *managedMap) defaults() Config {
+    return Config{Timeout: t.default_timeout, AccessCount: t.default_access, SlideOnAccess: t.default_slide, Priority: t.default_priority}.resolve()
 }
 
 // Get is a method of a managedMap that returns the value associated with
@@ -75,7 +242,36 @@ func NewCustomManagedMap(conf Config) *managedMap {
 // method has been called. The key must be a type that can be compared with the == operator. 
 // If it is not the underlying go map will panic. For more reading see 
 // [Go maps in action](https://blog.golang.org/go-maps-in-action) the section about "Key types".
+// If the map has a Loader a missing key is loaded like GetLoad with a background context
+// and a failed load is a miss, or with WithServeStaleOnError returns the last value the
+// key held.
 func (t *managedMap) Get(key interface{}) (interface{}, bool) {
+    t.checkKeyType(key)
+    value, has := t.traceGet(key)
+    if !has && t.loader != nil {
+        return t.loadOnMiss(key)
+    }
+    return value, has
+}
+
+// traceGet is a private method of a managedMap that implements Get without loading,
+// wrapped in a span if the map has a Tracer.
+func (t *managedMap) traceGet(key interface{}) (interface{}, bool) {
+    if t.tracer == nil {
+        return t.countGet(t.get(key))
+    }
+    span := t.startSpan("Get", key)
+    defer span.End()
+    value, has := t.countGet(t.get(key))
+    span.SetAttribute("hit", has)
+    return value, has
+}
+
+// get is a private method of a managedMap that implements Get without tracing.
+func (t *managedMap) get(key interface{}) (interface{}, bool) {
+    if t.copyOnWrite {
+        return t.getSnapshot(key)
+    }
     t.lock.RLock()
     defer t.lock.RUnlock()
     // Panic if managedMap is closed
@@ -85,31 +281,253 @@ func (t *managedMap) Get(key interface{}) (interface{}, bool) {
     if !has {
         return nil, false
     }
-    // Atomically read the number of access remaining
-    accesses := atomic.LoadUint64(&item.accessRemaining)
-    // If accesses remaining is 0 that means this has already
-    // been read more than its allotted amount of times. Its possible
-    // that the element is not quite deleted yet here so we pretend that
-    // it has already been delete.
-    if accesses < 1 {
+    value, _, has := t.consume(key, item)
+    return value, has
+}
+
+// GetMany is a method of a managedMap that looks up every key of keys under a single hold
+// of the read lock, consuming an access of each item found just like Get, and returns
+// the values of the keys that exist. Keys that are missing, or whose items have run out
+// of accesses or time, are left out. Keys repeated in keys consume an access each time.
+// Missing keys are not loaded by a Loader. GetMany will always panic when called after
+// the Close method has been called.
+func (t *managedMap) GetMany(keys []interface{}) map[interface{}]interface{} {
+    if t.tracer != nil {
+        span := t.tracer.Start("GetMany")
+        defer span.End()
+    }
+    for _, key := range keys {
+        t.checkKeyType(key)
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    values := make(map[interface{}]interface{})
+    for _, key := range keys {
+        item, has := t.m[key]
+        if !has {
+            continue
+        }
+        if value, _, has := t.consume(key, item); has {
+            values[key] = value
+        }
+    }
+    return values
+}
+
+// GetAndRemaining is a method of a managedMap that works like Get but also returns the
+// number of accesses the item has left after this read, for responses such as "N uses
+// left" that can't race with other readers the way a separate lookup would. Items with
+// infinite accesses always report math.MaxUint64 remaining, and pinned items report
+// their unchanged count. GetAndRemaining will always panic when called after the Close
+// method has been called.
+func (t *managedMap) GetAndRemaining(key interface{}) (value interface{}, remaining uint64, ok bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    item, has := t.m[key]
+    if !has {
+        return nil, 0, false
+    }
+    return t.consume(key, item)
+}
+
+// Peek is a method of a managedMap that works like Get but does not consume an access,
+// so monitoring code can inspect a value without affecting when it is removed. Peek
+// will always panic when called after the Close method has been called.
+func (t *managedMap) Peek(key interface{}) (interface{}, bool) {
+    t.checkKeyType(key)
+    if t.copyOnWrite {
+        return t.peekSnapshot(key)
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    item, has := t.m[key]
+    if !has || item.pending() {
         return nil, false
     }
-    // Hack to add negative 1 to a unit64. This is safe because at this point
-    // accesses is a positive value greater than 1.
-    negative1 := int64(-1)
-    atomic.StoreUint64(&item.accessRemaining, accesses + uint64(negative1))
-    // If this is the last access we can use the removed channel to delete the
-    // key. This is done in a goroutine so that the Get call does not block 
-    // to acquire the write lock.
-    if accesses == 1 {
-        go func(t *managedMap, removed chan bool) {
-            t.lock.Lock()
-            defer t.lock.Unlock()
-            removed <- true
-            <-removed
-        }(t, item.removed)
+    return t.decode(item.load()), true
+}
+
+// PeekFresh is a method of a managedMap that works like Peek, never consuming an access,
+// but also honours the item's deadline the way Get does: an item found past its deadline
+// is reported absent and its deletion is started rather than left to its timer.
+// PeekFresh will always panic when called after the Close method has been called.
+func (t *managedMap) PeekFresh(key interface{}) (interface{}, bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    item, has := t.m[key]
+    if !has || atomic.LoadUint64(&item.accessRemaining) == 0 {
+        return nil, false
+    }
+    if item.remaining() == 0 {
+        t.expireLater(key, item)
+        return nil, false
     }
-    return item.data, true
+    return t.decode(item.load()), true
+}
+
+// consume is a private method of a managedMap that consumes a single access of the item
+// stored at key on behalf of Get, returning the item's data, the number of accesses left
+// and whether it could still be read.
+func (t *managedMap) consume(key interface{}, item *item) (interface{}, uint64, bool) {
+    for {
+        // Atomically read the number of access remaining
+        accesses := atomic.LoadUint64(&item.accessRemaining)
+        // If accesses remaining is 0 that means this has already
+        // been read more than its allotted amount of times. Its possible
+        // that the element is not quite deleted yet here so we pretend that
+        // it has already been delete.
+        if accesses < 1 {
+            return nil, 0, false
+        }
+        // The item's timer may not have fired yet, or its goroutine may still be waiting
+        // on the write lock, so an item past its deadline is a miss.
+        if item.remaining() == 0 {
+            t.expireLater(key, item)
+            return nil, 0, false
+        }
+        // An item with infinite accesses is never decremented so skip the store.
+        // Pinned items are exempt from access-count deletion so they are treated
+        // the same way.
+        if accesses == math.MaxUint64 || item.pinned.Load() {
+            t.rearmLater(key, item)
+            t.used(item)
+            return t.decode(item.load()), accesses, true
+        }
+        // Retry if another reader consumed accesses since the load, so every access
+        // is handed out exactly once
+        if !atomic.CompareAndSwapUint64(&item.accessRemaining, accesses, accesses - 1) {
+            continue
+        }
+        // If this is the last access the item has to be deleted from the map.
+        if accesses == 1 {
+            t.removeLater(key, item)
+        }
+        t.rearmLater(key, item)
+        t.used(item)
+        return t.decode(item.load()), accesses - 1, true
+    }
+}
+
+// GetN is a method of a managedMap that works like Get but consumes n accesses at once,
+// for items that model a metered resource where one use costs several accesses. If
+// at least n accesses remain they are consumed and the value is returned. If fewer
+// than n accesses remain nothing is consumed and GetN reports the key as absent,
+// leaving the remaining accesses for cheaper requests. An item whose accesses drop to
+// exactly 0 is removed just like with Get. Items with infinite accesses and pinned
+// items are never decremented. GetN will always panic when called after the Close
+// method has been called.
+func (t *managedMap) GetN(key interface{}, n uint64) (interface{}, bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    item, has := t.m[key]
+    if !has {
+        return nil, false
+    }
+    for {
+        accesses := atomic.LoadUint64(&item.accessRemaining)
+        if accesses < 1 || accesses < n {
+            return nil, false
+        }
+        if item.remaining() == 0 {
+            t.expireLater(key, item)
+            return nil, false
+        }
+        if accesses == math.MaxUint64 || item.pinned.Load() || n == 0 {
+            t.rearmLater(key, item)
+            t.used(item)
+            return t.decode(item.load()), true
+        }
+        // Retry if another reader consumed accesses since the load
+        if !atomic.CompareAndSwapUint64(&item.accessRemaining, accesses, accesses - n) {
+            continue
+        }
+        if accesses == n {
+            t.removeLater(key, item)
+        }
+        t.rearmLater(key, item)
+        t.used(item)
+        return t.decode(item.load()), true
+    }
+}
+
+// removeLater is a private method of a managedMap that deletes the item stored at key
+// once its accesses have run out. This is done in a goroutine so that readers holding
+// the read lock do not block to acquire the write lock. The item is only deleted if it
+// is still stored at key and still out of accesses once the lock is acquired.
+func (t *managedMap) removeLater(key interface{}, it *item) {
+    if t.manualExpiry {
+        return
+    }
+    go func(t *managedMap, key interface{}, it *item) {
+        t.lock.Lock()
+        defer t.unlock()
+        if t.m != nil && t.m[key] == it && atomic.LoadUint64(&it.accessRemaining) == 0 {
+            t.evict(key, it, EvictAccessExhausted)
+        }
+    }(t, key, it)
+}
+
+// expireLater is a private method of a managedMap that deletes the item stored at key
+// once a reader has found it past its deadline, without waiting for its expiry to fire.
+// Like removeLater it is done in a goroutine, of which only one is started per item.
+// The item is only deleted if it is still stored at key and still due once the lock is
+// acquired.
+func (t *managedMap) expireLater(key interface{}, it *item) {
+    if t.manualExpiry {
+        return
+    }
+    if !it.expiring.CompareAndSwap(false, true) {
+        return
+    }
+    go func(t *managedMap, key interface{}, it *item) {
+        t.lock.Lock()
+        defer t.unlock()
+        it.expiring.Store(false)
+        if t.m != nil && t.m[key] == it && t.due(it) {
+            t.evict(key, it, EvictExpired)
+        }
+    }(t, key, it)
+}
+
+// rearmLater is a private method of a managedMap that records a successful read of the
+// item stored at key and, if the item slides on access or the map has an adaptive TTL,
+// re-arms its timer. Readers only hold the read lock so, like removeLater, this is done
+// in a goroutine, of which only one is started for any number of reads recorded before
+// it acquires the write lock. Items with an infinite timeout are never re-armed.
+func (t *managedMap) rearmLater(key interface{}, it *item) {
+    if (!it.slide.Load() && t.adaptive == nil) || it.loadTimeout() == math.MaxInt64 {
+        return
+    }
+    if it.hits.Add(1) != 1 {
+        return
+    }
+    go func(t *managedMap, key interface{}, it *item) {
+        t.lock.Lock()
+        defer t.unlock()
+        hits := it.hits.Swap(0)
+        if t.m == nil || t.m[key] != it || it.pending() || it.pinned.Load() {
+            return
+        }
+        now := time.Now()
+        if t.adaptive != nil {
+            it.timeout.Store(int64(t.adaptive.adapt(it.loadTimeout(), now.Sub(it.adapted), hits)))
+        }
+        it.adapted = now
+        t.arm(key, it, it.loadTimeout())
+    }(t, key, it)
 }
 
 // Put is a method of a managedMap that allows the user to insert a key-value pair.
@@ -119,7 +537,7 @@ func (t *managedMap) Get(key interface{}) (interface{}, bool) {
 // with the == operator. If it is not the underlying go map will panic. For more reading see 
 // [Go maps in action](https://blog.golang.org/go-maps-in-action) the section about "Key types".
 func (t *managedMap) Put(key, value interface{}) {
-    t.PutCustom(key,value, Config{ t.default_timeout, t.default_access })
+    t.PutCustom(key,value, Config{Timeout: t.default_timeout, AccessCount: t.default_access, SlideOnAccess: t.default_slide, Priority: t.default_priority})
 }
 
 // Has is a method of a managedMap that allows the user to check the existance of a key.
@@ -129,6 +547,10 @@ func (t *managedMap) Put(key, value interface{}) {
 // the underlying go map will panic. For more reading see 
 // [Go maps in action](https://blog.golang.org/go-maps-in-action) the section about "Key types".
 func (t *managedMap) Has(key interface{}) bool {
+    t.checkKeyType(key)
+    if t.copyOnWrite {
+        return t.hasSnapshot(key)
+    }
     t.lock.RLock()
     defer t.lock.RUnlock()
     // Panic if managedMap is closed
@@ -139,8 +561,15 @@ func (t *managedMap) Has(key interface{}) bool {
     }
     // The techinally has the item but item may be in the process of being
     // delete so we have to check if it is waiting to be deleted
-    accesses := atomic.LoadUint64(&value.accessRemaining)
-    return access != 0
+    return !value.pending()
+}
+
+// Contains is a method of a managedMap that reports whether key exists without consuming
+// an access, exactly like Has. An item that has run out of accesses or time is absent, so
+// the answer matches what a following Get would see unless the item changes in between.
+// Contains will always panic when called after the Close method has been called.
+func (t *managedMap) Contains(key interface{}) bool {
+    return t.Has(key)
 }
 
 
@@ -151,15 +580,164 @@ func (t *managedMap) Has(key interface{}) bool {
 // go map will panic. For more reading see 
 // [Go maps in action](https://blog.golang.org/go-maps-in-action) the section about "Key types".
 func (t *managedMap) Remove(key interface{}) {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if has {
+        t.drop(key, value, EvictRemoved)
+    }
+    delete(t.stale, key)
+}
+
+// RemoveSilent is a method of a managedMap that removes key and its associated data like
+// Remove, and counts it as removed in Stats, but without reporting an eviction to the
+// callback set by WithOnEvict, for when the item is not really going away, such as while
+// migrating it to another store. It returns whether key was stored. RemoveSilent will
+// always panic when called after the Close method has been called.
+func (t *managedMap) RemoveSilent(key interface{}) bool {
+    t.checkKeyType(key)
     t.lock.Lock()
-    defer t.lock.Unlock()
+    defer t.unlock()
     // Panic if managedMap is closed
     t.closed()
     value, has := t.m[key]
     if has {
-        value.removed <- true
-        <-value.removed
+        t.countEviction(EvictRemoved)
+        t.unlink(key, value)
     }
+    delete(t.stale, key)
+    return has
+}
+
+// RemoveMany is a method of a managedMap that removes every key of keys and its associated
+// data, like Remove, under a single hold of the write lock so no other writer sees only
+// some of them removed. It returns the number of keys that were stored. RemoveMany will
+// always panic when called after the Close method has been called.
+func (t *managedMap) RemoveMany(keys []interface{}) int {
+    for _, key := range keys {
+        t.checkKeyType(key)
+    }
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    removed := 0
+    for _, key := range keys {
+        if value, has := t.m[key]; has {
+            t.drop(key, value, EvictRemoved)
+            removed++
+        }
+        delete(t.stale, key)
+    }
+    return removed
+}
+
+// Clear is a method of a managedMap that removes every key and its associated data,
+// like calling Remove for each of them, leaving an empty map that can be used as before.
+// The timer and goroutine managing each item are stopped. Clear will always panic when
+// called after the Close method has been called.
+func (t *managedMap) Clear() {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    if t.m == nil {
+        return
+    }
+    t.swap()
+}
+
+// SwapOut is a method of a managedMap that atomically replaces the map's contents with an
+// empty map and returns the values of every item that was readable, for rotating
+// aggregation windows where one goroutine fills the map while another drains it. The
+// map keeps working with its new empty contents as soon as SwapOut returns and the
+// timers and goroutines of the swapped out items are stopped. Taking the values out is
+// not an access. SwapOut will always panic when called after the Close method has been
+// called.
+func (t *managedMap) SwapOut() map[interface{}]interface{} {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    out := make(map[interface{}]interface{})
+    if t.m == nil {
+        return out
+    }
+    for k, v := range t.swap() {
+        if !v.pending() {
+            out[k] = t.decode(v.load())
+        }
+    }
+    return out
+}
+
+// EvictWhere is a method of a managedMap that removes every readable item for which pred
+// returns true, as Remove would, and returns how many were removed. It works in two
+// phases so that pred is never called while the write lock is held: the items are first
+// matched under the read lock, which lets other readers continue during a long scan,
+// and the matches are then deleted together under a single hold of the write lock. An
+// item written between the phases is judged by the value it had when it was matched: a
+// key re-inserted in between is kept, while a value updated in place by Put is removed
+// with its item. pred must not call back into the map. Matching is not an access.
+// EvictWhere will always panic when called after the Close method has been called.
+func (t *managedMap) EvictWhere(pred func(key, value interface{}) bool) int {
+    matches := func() map[interface{}] *item {
+        t.lock.RLock()
+        defer t.lock.RUnlock()
+        // Panic if managedMap is closed
+        t.closed()
+        matches := make(map[interface{}] *item)
+        for k, v := range t.m {
+            if !v.pending() && pred(k, t.decode(v.load())) {
+                matches[k] = v
+            }
+        }
+        return matches
+    }()
+    if len(matches) == 0 {
+        return 0
+    }
+    t.lock.Lock()
+    defer t.unlock()
+    if t.m == nil {
+        t.closed()
+        return 0
+    }
+    evicted := 0
+    for k, v := range matches {
+        if t.m[k] == v {
+            t.drop(k, v, EvictRemoved)
+            delete(t.stale, k)
+            evicted++
+        }
+    }
+    return evicted
+}
+
+// swap is a private method of a managedMap that replaces the map with an empty one,
+// releasing every item, and returns the items that were removed. The caller must hold
+// the write lock.
+func (t *managedMap) swap() map[interface{}] *item {
+    old := t.m
+    t.m = make(map[interface{}] *item)
+    t.resetRecency()
+    for k, v := range old {
+        t.countEviction(EvictRemoved)
+        t.queueEviction(k, v, EvictRemoved)
+        t.release(v)
+        t.unintern(v.load())
+        if t.onDrop != nil {
+            t.onDrop(k)
+        }
+    }
+    if t.stale != nil {
+        t.stale = make(map[interface{}] interface{})
+    }
+    t.publish()
+    return old
 }
 
 // Size is a method of a managedMap that will return the number of items
@@ -173,19 +751,166 @@ func (t *managedMap) Size() int {
     return len(t.m)
 }
 
+// Keys is a method of a managedMap that returns the keys of every readable item, in no
+// particular order, as they are at the time of the call. Listing keys is not an access,
+// so no accesses are consumed and no timers are reset. An empty map returns an empty
+// slice. Keys will always panic when called after the Close method has been called.
+func (t *managedMap) Keys() []interface{} {
+    if t.copyOnWrite {
+        return t.keysSnapshot()
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    keys := make([]interface{}, 0, len(t.m))
+    for k, v := range t.m {
+        if !v.pending() {
+            keys = append(keys, k)
+        }
+    }
+    return keys
+}
 
-// Close is a method of a managedMap that cleans a ManagedMap. Any underlying data is set to
-// nil and all Goroutines are stopped. 
-func (t *managedMap) Close() {
-    t.lock.Lock()
-    defer t.lock.Unlock()
+// Values is a method of a managedMap that returns the values of every readable item, in
+// no particular order, as they are at the time of the call. No accesses are consumed
+// and no timers are reset. An empty map returns an empty slice. Values will always panic
+// when called after the Close method has been called.
+func (t *managedMap) Values() []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
     // Panic if managedMap is closed
     t.closed()
+    values := make([]interface{}, 0, len(t.m))
     for _, v := range t.m {
-        v.removed <- true
-        <-v.removed
+        if !v.pending() {
+            values = append(values, t.decode(v.load()))
+        }
+    }
+    return values
+}
+
+// Range is a method of a managedMap that calls fn for every readable item, in no
+// particular order, stopping early if fn returns false. The items are copied under the
+// read lock and fn is called after the lock is released, so fn may call any method of
+// the map, including Put, Remove and Close, but it sees items as they were at the time
+// of the call rather than live. No accesses are consumed and no timers are reset. Range
+// will always panic when called after the Close method has been called.
+func (t *managedMap) Range(fn func(key, value interface{}) bool) {
+    type entry struct {
+        key, value interface{}
+    }
+    entries := []entry{}
+    // Copy the items under the read lock, releasing it even if the map is closed
+    func() {
+        t.lock.RLock()
+        defer t.lock.RUnlock()
+        // Panic if managedMap is closed
+        t.closed()
+        for k, v := range t.m {
+            if !v.pending() {
+                entries = append(entries, entry{k, t.decode(v.load())})
+            }
+        }
+    }()
+    for _, e := range entries {
+        if !fn(e.key, e.value) {
+            return
+        }
+    }
+}
+
+// Sample is a method of a managedMap that calls fn for up to n readable items, picked by
+// where Go's randomized map iteration happens to start, so monitoring code can estimate
+// properties of a huge map without visiting every item. The sample is not uniformly
+// random, as items stored next to each other tend to be picked together, but it is
+// adequate for estimates. No accesses are consumed. fn is called while the read lock is
+// held, so it must not call methods of the map that write. Sample will always panic when
+// called after the Close method has been called.
+func (t *managedMap) Sample(n int, fn func(key, value interface{})) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    for k, v := range t.m {
+        if n <= 0 {
+            return
+        }
+        if !v.pending() {
+            fn(k, t.decode(v.load()))
+            n--
+        }
+    }
+}
+
+// LiveSize is a method of a managedMap that returns the number of items that are still
+// readable, leaving out items that have run out of accesses or time but have not been
+// deleted yet, which Size still counts. LiveSize will panic when called after the Close
+// method has been called.
+func (t *managedMap) LiveSize() int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    live := 0
+    for _, v := range t.m {
+        if !v.pending() {
+            live++
+        }
+    }
+    return live
+}
+
+
+// Close is a method of a managedMap that cleans a ManagedMap. Any underlying data is set to
+// nil and all Goroutines are stopped. Items are torn down, and dirty items flushed, in an
+// unspecified order; use CloseOrdered when the order matters. Calling Close on a map that
+// has already been closed does nothing, so it can safely be deferred more than once.
+func (t *managedMap) Close() {
+    t.close(nil)
+}
+
+// CloseOrdered is a method of a managedMap that works like Close but tears down the items,
+// flushing dirty items with the write-back function, in the order of their keys sorted by
+// less. less is called while the write lock is held and must not call back into the map.
+func (t *managedMap) CloseOrdered(less func(a, b interface{}) bool) {
+    t.close(less)
+}
+
+// close is a private method of a managedMap that implements Close, tearing items down in
+// the order of less if it is not nil.
+func (t *managedMap) close(less func(a, b interface{}) bool) {
+    t.lock.Lock()
+    defer t.unlock()
+    // Closing a closed managedMap does nothing
+    if t.m == nil {
+        return
+    }
+    atomic.StoreInt64(&t.closedAt, time.Now().UnixNano())
+    close(t.stop)
+    keys := make([]interface{}, 0, len(t.m))
+    for k := range t.m {
+        keys = append(keys, k)
+    }
+    if less != nil {
+        sort.Slice(keys, func(i, j int) bool {
+            return less(keys[i], keys[j])
+        })
+    }
+    for _, k := range keys {
+        v := t.m[k]
+        t.queueEviction(k, v, EvictClosed)
+        t.flushItem(k, v, true)
+        t.release(v)
+        t.unintern(v.load())
+    }
+    if t.ownScheduler {
+        t.scheduler.Stop()
     }
     t.m = nil
+    t.stale = nil
+    t.resetRecency()
+    t.publish()
 }
 
 // PutCustom is a method of a managedMap that allows the user to insert a key-value
@@ -195,64 +920,838 @@ func (t *managedMap) Close() {
 // after the Close method has been called. The key must be a type that can be compared with the == operator. 
 // If it is not the underlying go map will panic. For more reading see 
 // [Go maps in action](https://blog.golang.org/go-maps-in-action) the section about "Key types".
+// If a maximum value size is configured a value exceeding it is dropped, use PutChecked
+// to find out.
 func (t *managedMap) PutCustom(key, value interface{}, config Config) {
-    // Update only value if it already exists in the map
-    t.lock.RLock()
+    t.put(key, value, config)
+}
+
+// PutChecked is a method of a managedMap that works like PutCustom but returns an error
+// instead of silently dropping a value that can not be stored or panicking on a key that
+// can not be used as a map key. ErrKeyNotComparable is returned, before the map is
+// touched, when the key can not be compared with the == operator and ErrValueTooLarge is
+// returned when the value exceeds the configured maximum value size.
+func (t *managedMap) PutChecked(key, value interface{}, config Config) error {
+    if !comparableKey(key) {
+        return ErrKeyNotComparable
+    }
+    return t.put(key, value, config)
+}
+
+// GetOrPut is a method of a managedMap that atomically returns the value of key if it
+// exists, consuming an access like Get, with loaded set to true, or otherwise inserts
+// value with the timeout and access count of the passed Config struct, as PutCustom
+// would, and returns it with loaded set to false. The lookup and the insert happen under
+// a single write lock so concurrent callers that miss on the same key insert it only
+// once and all see the same value. A value that can not be stored, for example because
+// it exceeds the maximum value size, is returned with loaded set to false but is not
+// inserted. GetOrPut will always panic when called after the Close method has been
+// called.
+func (t *managedMap) GetOrPut(key, value interface{}, config Config) (actual interface{}, loaded bool) {
+    return t.GetOrCompute(key, func() (interface{}, Config) {
+        return value, config
+    })
+}
+
+// GetOrCompute is a method of a managedMap that works like GetOrPut but only produces the
+// value to insert, and its Config, by calling fn when key is missing. fn is called while
+// the write lock is held, so it runs at most once for each insert however many callers
+// miss on key at the same time, and it must not call back into the map. GetOrCompute
+// will always panic when called after the Close method has been called.
+func (t *managedMap) GetOrCompute(key interface{}, fn func() (interface{}, Config)) (actual interface{}, loaded bool) {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
     // Panic if managedMap is closed
     t.closed()
-    // Update value if it already exists
-    if v, has := t.m[key]; has {
-        v.data = value
-        t.lock.RUnlock()
+    if t.m == nil {
+        return nil, false
+    }
+    if old, has := t.m[key]; has {
+        if actual, _, ok := t.consume(key, old); ok {
+            return actual, true
+        }
+        // The old item is only waiting to be deleted so it is replaced
+        t.flushItem(key, old, true)
+        t.drop(key, old, old.pendingReason())
+    }
+    value, config := fn()
+    encoded, err := t.encode(value)
+    if err != nil || t.checkValueSize(encoded) != nil {
+        return value, false
+    }
+    config = config.resolve()
+    inserted := t.insert(key, encoded, config.Timeout, config.Timeout, config.AccessCount)
+    inserted.slide.Store(config.SlideOnAccess)
+    t.prioritize(inserted, config.Priority)
+    t.markDirty(inserted)
+    return value, false
+}
+
+// Set is a method of a managedMap that inserts value at key with the timeout and access
+// count of the passed Config struct, replacing an existing item entirely: unlike
+// PutCustom, which only updates the value of an existing key, Set also restarts its
+// timer, resets its access count and its age and unpins it, as if the key had been
+// removed and inserted again. Replacing an item is not an eviction. If a maximum value
+// size is configured a value exceeding it is dropped and an existing item is kept. Set
+// will always panic when called after the Close method has been called.
+func (t *managedMap) Set(key, value interface{}, config Config) {
+    t.checkKeyType(key)
+    if t.tracer != nil {
+        span := t.startSpan("Set", key)
+        defer span.End()
+    }
+    value, err := t.encode(value)
+    if err != nil || t.checkValueSize(value) != nil {
         return
     }
-    t.lock.RUnlock()
-    // '0' as a config value implies infinite. We use math make value to supplement infinity.
-    if config.Timeout == 0 {
-        config.Timeout = math.MaxInt64
+    config = config.resolve()
+    t.lock.Lock()
+    defer t.unlock()
+    // Drop the Set if the map was closed during its close grace period
+    if t.m == nil {
+        t.closed()
+        return
+    }
+    if old, has := t.m[key]; has {
+        t.unlink(key, old)
+    }
+    inserted := t.insert(key, value, config.Timeout, config.Timeout, config.AccessCount)
+    inserted.slide.Store(config.SlideOnAccess)
+    t.prioritize(inserted, config.Priority)
+    t.markDirty(inserted)
+}
+
+// PutMany is a method of a managedMap that inserts every key-value pair of entries with
+// the timeout and access count of the passed Config struct under a single hold of the
+// write lock, for loading many items at once. Keys that already exist only have their
+// value updated, as with PutCustom. Values exceeding a configured maximum value size are
+// dropped. PutMany will always panic when called after the Close method has been called.
+func (t *managedMap) PutMany(entries map[interface{}]interface{}, config Config) {
+    if t.tracer != nil {
+        span := t.tracer.Start("PutMany")
+        defer span.End()
+    }
+    encoded := make(map[interface{}]interface{}, len(entries))
+    for key, value := range entries {
+        t.checkKeyType(key)
+        value, err := t.encode(value)
+        if err != nil || t.checkValueSize(value) != nil {
+            continue
+        }
+        encoded[key] = value
+    }
+    config = config.resolve()
+    t.lock.Lock()
+    defer t.unlock()
+    // Drop the values if the map was closed during its close grace period
+    if t.m == nil {
+        t.closed()
+        return
+    }
+    for key, value := range encoded {
+        // Update value if it already exists
+        if v, has := t.m[key]; has {
+            old := v.load()
+            v.store(t.intern(value))
+            t.unintern(old)
+            t.markDirty(v)
+            continue
+        }
+        inserted := t.insert(key, value, config.Timeout, config.Timeout, config.AccessCount)
+        inserted.slide.Store(config.SlideOnAccess)
+        t.prioritize(inserted, config.Priority)
+        t.markDirty(inserted)
+    }
+}
+
+// put is a private method of a managedMap that implements PutCustom and PutChecked.
+func (t *managedMap) put(key, value interface{}, config Config) error {
+    t.checkKeyType(key)
+    if t.tracer != nil {
+        span := t.startSpan("Put", key)
+        defer span.End()
+    }
+    value, err := t.encode(value)
+    if err != nil {
+        return err
+    }
+    if err := t.checkValueSize(value); err != nil {
+        return err
     }
-    if config.AccessCount == 0 {
-        config.AccessCount = math.MaxUint64
+    config = config.resolve()
+    // The existence check and the insert happen under one hold of the write lock so a
+    // concurrent Put of the same key can not insert it in between
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    // Drop the Put if the map was closed during its close grace period
+    if t.m == nil {
+        return nil
+    }
+    // Update only value if it already exists in the map
+    if v, has := t.m[key]; has {
+        old := v.load()
+        v.store(t.intern(value))
+        t.unintern(old)
+        t.markDirty(v)
+        t.used(v)
+        return nil
+    }
+    inserted := t.insert(key, value, config.Timeout, config.Timeout, config.AccessCount)
+    inserted.slide.Store(config.SlideOnAccess)
+    t.prioritize(inserted, config.Priority)
+    t.markDirty(inserted)
+    return nil
+}
+
+// insert is a private method of a managedMap that stores a new item at key whose
+// expiry is armed to fire after remaining and is re-armed with timeout. The caller must
+// hold the write lock.
+func (t *managedMap) insert(key, value interface{}, timeout, remaining time.Duration, access uint64) *item {
+    return t.insertCreated(key, value, timeout, remaining, access, time.Now())
+}
+
+// insertCreated is a private method of a managedMap that works like insert for an item
+// that was first created at created, which its age and maximum lifetime count from. The
+// caller must hold the write lock.
+func (t *managedMap) insertCreated(key, value interface{}, timeout, remaining time.Duration, access uint64, created time.Time) *item {
+    if t.adaptive != nil && timeout != math.MaxInt64 {
+        timeout = t.adaptive.clamp(timeout)
+        if remaining > timeout {
+            remaining = timeout
+        }
     }
     // Create a new map item
-    timer := time.NewTimer(config.Timeout)
-    removed := make(chan bool)
     item := &item{
-        timer: timer,
-        accessRemaining: config.AccessCount,
-        data: value,
-        removed: removed,
+        created: created,
+        adapted: time.Now(),
+        accessRemaining: access,
     }
-    // Grab lock as writer update the map
-    t.lock.Lock()
-    defer t.lock.Unlock()
+    item.store(t.intern(value))
+    item.timeout.Store(int64(timeout))
+    if t.maxLifetime > 0 {
+        item.expires = created.Add(t.maxLifetime)
+    }
+    t.makeRoom(key)
+    t.track(key, item)
     t.m[key] = item
-    // Spawn goroutine which will manage the newly created map item. This routine will
-    // block until the timer expires or the items is removed. 
-    go func(timer *time.Timer, t *managedMap, key interface{}, removed chan bool) {
+    delete(t.stale, key)
+    t.publish()
+    t.arm(key, item, remaining)
+    return item
+}
+
+// arm is a private method of a managedMap that (re)starts the expiry of the item stored
+// at key so that it is deleted after d. The item is handed to the map's Scheduler, or
+// its TTL resolution bucket, unless the map was created WithPerItemTimers, in which case
+// the item gets its own timer and a goroutine that manages it the first time it is
+// armed, or only a timer once the map's goroutine cap is reached. An infinite d never
+// fires so nothing is started. The caller must hold the write lock.
+func (t *managedMap) arm(key interface{}, it *item, d time.Duration) {
+    // No renewal reaches past the item's maximum lifetime
+    if !it.expires.IsZero() {
+        if hard := time.Until(it.expires); hard < d {
+            d = hard
+        }
+    }
+    it.setDeadline(time.Now().Add(d))
+    if d == math.MaxInt64 {
+        t.disarm(it)
+        return
+    }
+    // With manual expiry the deadline is only checked by reads and EvictExpired
+    if t.manualExpiry {
+        return
+    }
+    if t.scheduler != nil {
+        t.scheduler.schedule(t, key, it)
+        return
+    }
+    if t.resolution > 0 {
+        t.joinBucket(key, it)
+        return
+    }
+    if it.timer != nil {
+        it.timer.Reset(d)
+        return
+    }
+    if t.maxGoroutines > 0 && atomic.LoadInt64(&t.goroutines) >= t.maxGoroutines {
+        t.armDegraded(key, it, d)
+        return
+    }
+    it.timer = time.NewTimer(d)
+    it.done = make(chan struct{})
+    atomic.AddInt64(&t.goroutines, 1)
+    go t.watch(key, it)
+}
+
+// disarm is a private method of a managedMap that stops the expiry of an item without
+// stopping the goroutine that manages it. The caller must hold the write lock.
+func (t *managedMap) disarm(it *item) {
+    if it.scheduled != nil {
+        t.scheduler.cancel(it)
+    }
+    if it.bucket != nil {
+        t.leaveBucket(it)
+    }
+    if it.timer != nil {
+        it.timer.Stop()
+    }
+}
+
+// watch is a private method of a managedMap run in the goroutine that manages an item
+// with its own timer. This routine will block until the item is dropped or its timer
+// expires. If the timer has expired we need to acquire the write lock before we can
+// delete the data, and by then the item may have been replaced, pinned or re-armed, in
+// which case the routine goes back to waiting.
+func (t *managedMap) watch(key interface{}, it *item) {
+    defer atomic.AddInt64(&t.goroutines, -1)
+    for {
         select {
-            // Waits on the removed channel. If the removed channel receives a value
-            // we can safely delete the the key from the map because the sender's acquire
-            // a write lock on the data before sending data. The sender holds this lock
-            // until we sender back on the same channel
-        case <-removed:
-            delete(t.m, key)
-            removed <- true
-            // Waits on the timer channel. If the timer has expired we need to acquire
-            // the write lock before we can delete the data.
-        case <-timer.C:
+        case <-it.done:
+            return
+        case <-it.timer.C:
             t.lock.Lock()
-            defer t.lock.Unlock()
-            delete(t.m, key)
+            if t.m != nil && t.m[key] == it && t.due(it) && t.evict(key, it, EvictExpired) {
+                t.unlock()
+                return
+            }
+            t.unlock()
+        }
+    }
+}
+
+// due is a private method of a managedMap that reports whether an item's deadline has
+// passed and it is not pinned. The caller must hold the write lock.
+func (t *managedMap) due(it *item) bool {
+    return !it.pinned.Load() && !time.Now().Before(it.deadlineAt())
+}
+
+// evict is a private method of a managedMap that automatically removes the item stored
+// at key for the passed reason, unless the eviction is vetoed. It returns whether the
+// item was removed. The caller must hold the write lock.
+func (t *managedMap) evict(key interface{}, it *item, reason EvictReason) bool {
+    if reason == EvictExpired && !it.expires.IsZero() && !time.Now().Before(it.expires) {
+        reason = EvictLifetimeExceeded
+    }
+    // The maximum lifetime is a hard bound so it can not be vetoed
+    if reason != EvictLifetimeExceeded && t.vetoed(key, it, reason) {
+        return false
+    }
+    t.flushItem(key, it, true)
+    t.drop(key, it, reason)
+    if t.stale != nil {
+        t.stale[key] = it.load()
+    }
+    if (reason == EvictExpired || reason == EvictLifetimeExceeded) && t.onExpire != nil {
+        t.onExpire(key, t.decode(it.load()))
+    }
+    return true
+}
+
+// drop is a private method of a managedMap that deletes the item stored at key for the
+// passed reason and releases everything managing it. The caller must hold the write lock.
+func (t *managedMap) drop(key interface{}, it *item, reason EvictReason) {
+    t.countEviction(reason)
+    t.queueEviction(key, it, reason)
+    t.unlink(key, it)
+}
+
+// unlink is a private method of a managedMap that works like drop for an item that is
+// not leaving the map's users, such as one moved to another map, so no eviction is
+// reported. The caller must hold the write lock.
+func (t *managedMap) unlink(key interface{}, it *item) {
+    delete(t.m, key)
+    t.untrack(it)
+    t.release(it)
+    t.unintern(it.load())
+    t.publish()
+    if t.onDrop != nil {
+        t.onDrop(key)
+    }
+}
+
+// release is a private method of a managedMap that stops an item's expiry and the
+// goroutine managing it. The caller must hold the write lock.
+func (t *managedMap) release(it *item) {
+    t.disarm(it)
+    if it.done != nil {
+        close(it.done)
+    }
+    if it.degraded {
+        it.degraded = false
+        atomic.AddInt64(&t.degraded, -1)
+    }
+}
+
+// epoch is the time item deadlines are stored relative to, so they keep the monotonic
+// clock reading of the time they were set with.
+var epoch = time.Now()
+
+// load is a private method of an item that returns its stored data.
+func (i *item) load() interface{} {
+    return *i.data.Load()
+}
+
+// store is a private method of an item that replaces its stored data.
+func (i *item) store(data interface{}) {
+    i.data.Store(&data)
+}
+
+// loadTimeout is a private method of an item that returns its timeout.
+func (i *item) loadTimeout() time.Duration {
+    return time.Duration(i.timeout.Load())
+}
+
+// deadlineAt is a private method of an item that returns the time its timer fires.
+func (i *item) deadlineAt() time.Time {
+    return epoch.Add(time.Duration(i.deadline.Load()))
+}
+
+// setDeadline is a private method of an item that sets the time its timer fires.
+func (i *item) setDeadline(deadline time.Time) {
+    i.deadline.Store(int64(deadline.Sub(epoch)))
+}
+
+// remaining is a private method of an item that returns the time left before its
+// timer fires or its maximum lifetime ends, whichever is first. Pinned items and items
+// with an infinite timeout and no maximum lifetime always have the maximum duration left.
+func (i *item) remaining() time.Duration {
+    if i.pinned.Load() {
+        return math.MaxInt64
+    }
+    left := time.Duration(math.MaxInt64)
+    if i.loadTimeout() != math.MaxInt64 {
+        left = time.Until(i.deadlineAt())
+    }
+    if !i.expires.IsZero() {
+        if hard := time.Until(i.expires); hard < left {
+            left = hard
         }
-    }(timer, t, key, removed)
+    }
+    if left > 0 {
+        return left
+    }
+    return 0
+}
+
+// TouchAll is a method of a managedMap that keeps a set of keys alive. Under a single
+// write lock each present key has its timer re-armed to its original timeout and its
+// access count reset to the map's default access count. Keys that are absent, or whose
+// accesses have already run out and are waiting to be deleted, are skipped.
+// TouchAll returns the number of keys touched. TouchAll will always panic when called
+// after the Close method has been called.
+func (t *managedMap) TouchAll(keys ...interface{}) int {
+    for _, key := range keys {
+        t.checkKeyType(key)
+    }
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    access := t.defaults().AccessCount
+    touched := 0
+    for _, key := range keys {
+        value, has := t.m[key]
+        if !has || atomic.LoadUint64(&value.accessRemaining) == 0 {
+            continue
+        }
+        // A pinned item's timer stays stopped until it is unpinned
+        if value.pinned.Load() {
+            atomic.StoreUint64(&value.accessRemaining, access)
+            touched++
+            continue
+        }
+        t.arm(key, value, value.loadTimeout())
+        atomic.StoreUint64(&value.accessRemaining, access)
+        touched++
+    }
+    return touched
+}
+
+// Extend is a method of a managedMap that adds d to the time the item stored at key has
+// left, re-arming its timer to fire d later than it would have, for example to extend a
+// lease when a client renews it. Extend returns whether the key existed and does not
+// change the item's access count or its original timeout, so a later Touch still re-arms
+// it with the original timeout. Extending never reaches past the item's maximum lifetime.
+// Items that have run out of accesses or time are not extended and nothing changes for
+// items with an infinite timeout, pinned items or when d is not positive. Extend will
+// always panic when called after the Close method has been called.
+func (t *managedMap) Extend(key interface{}, d time.Duration) bool {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || value.pending() {
+        return false
+    }
+    if d <= 0 || value.loadTimeout() == math.MaxInt64 || value.pinned.Load() {
+        return true
+    }
+    left := time.Until(value.deadlineAt())
+    // Cap the sum just below the duration arm treats as infinite
+    if left > math.MaxInt64 - 1 - d {
+        t.arm(key, value, math.MaxInt64 - 1)
+        return true
+    }
+    t.arm(key, value, left + d)
+    return true
+}
+
+// Touch is a method of a managedMap that keeps a single key alive, re-arming its timer to
+// its original timeout without reading its value or consuming an access, for sliding
+// expiration. Touch returns whether the key existed. Items that have run out of accesses
+// or time are waiting to be deleted and are not touched, and a pinned item's timer stays
+// stopped until it is unpinned. Touch will always panic when called after the Close
+// method has been called.
+func (t *managedMap) Touch(key interface{}) bool {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || value.pending() {
+        return false
+    }
+    if !value.pinned.Load() {
+        t.arm(key, value, value.loadTimeout())
+    }
+    return true
+}
+
+// ResetAccess is a method of a managedMap that gives the item stored at key the map's
+// default access count again, which is infinite if the default is 0, without touching
+// its timer. ResetAccess returns false if the key is absent or its item has already run
+// out of accesses and is waiting to be deleted. ResetAccess will always panic when called
+// after the Close method has been called.
+func (t *managedMap) ResetAccess(key interface{}) bool {
+    return t.SetAccessCount(key, t.default_access)
+}
+
+// SetAccessCount is a method of a managedMap that gives the item stored at key count
+// accesses, where 0 is infinite as with PutCustom, without touching its value or its
+// timer. SetAccessCount returns false if the key is absent or its item has already run
+// out of accesses and is waiting to be deleted. The count is stored under the write lock,
+// so it takes effect between reads: a Get that started before SetAccessCount consumed an
+// access of the old count, which the new count does not account for, and every Get after
+// it consumes from the new count. SetAccessCount will always panic when called after the
+// Close method has been called.
+func (t *managedMap) SetAccessCount(key interface{}, count uint64) bool {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || atomic.LoadUint64(&value.accessRemaining) == 0 {
+        return false
+    }
+    atomic.StoreUint64(&value.accessRemaining, Config{AccessCount: count}.resolve().AccessCount)
+    return true
+}
+
+// UpdateIfStale is a method of a managedMap that refreshes the item stored at key only
+// if it is about to expire, so that of many concurrent writers only the first rewrites a
+// near-expiry item. If less than staleThreshold remains on the item's timer, fn is
+// called with the current value under the write lock, its result is stored and the
+// timer is re-armed with the item's original timeout. UpdateIfStale returns whether the
+// update happened. Absent items, items out of accesses, pinned items and items with an
+// infinite timeout are never stale. fn must not call any method of the map. UpdateIfStale
+// will always panic when called after the Close method has been called.
+func (t *managedMap) UpdateIfStale(key interface{}, staleThreshold time.Duration, fn func(old interface{}) interface{}) bool {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || atomic.LoadUint64(&value.accessRemaining) == 0 || value.pinned.Load() {
+        return false
+    }
+    if value.remaining() >= staleThreshold {
+        return false
+    }
+    old := value.load()
+    value.store(t.intern(t.mustEncode(fn(t.decode(old)))))
+    t.unintern(old)
+    t.arm(key, value, value.loadTimeout())
+    return true
+}
+
+// TransformAll is a method of a managedMap that replaces the value of every item with
+// the result of calling fn with its key and current value. Timers and access counts are
+// left untouched. TransformAll holds the write lock for the full pass, so fn should be
+// quick and must not call back into the map. TransformAll will always panic when called
+// after the Close method has been called.
+func (t *managedMap) TransformAll(fn func(key, value interface{}) interface{}) {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    for k, v := range t.m {
+        old := v.load()
+        v.store(t.intern(t.mustEncode(fn(k, t.decode(old)))))
+        t.unintern(old)
+        t.markDirty(v)
+    }
+}
+
+// SnapshotKeys is a method of a managedMap that returns the values of the passed keys as
+// one consistent view, reading them all under a single acquisition of the lock so that no
+// write can change any of them part way through, unlike calling Get for each key. Keys
+// that are absent or no longer readable are left out of the result. No accesses are
+// consumed. SnapshotKeys will always panic when called after the Close method has been
+// called.
+func (t *managedMap) SnapshotKeys(keys ...interface{}) map[interface{}]interface{} {
+    for _, key := range keys {
+        t.checkKeyType(key)
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    values := make(map[interface{}]interface{}, len(keys))
+    for _, key := range keys {
+        if v, has := t.m[key]; has && !v.pending() {
+            values[key] = t.decode(v.load())
+        }
+    }
+    return values
+}
+
+// Age is a method of a managedMap that returns how long ago the item stored at key was
+// inserted, regardless of its timeout, and a boolean representing whether or not it
+// exists. Updating the value of an existing key does not reset its age. Age does not
+// consume an access and will always panic when called after the Close method has been
+// called.
+func (t *managedMap) Age(key interface{}) (time.Duration, bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || atomic.LoadUint64(&value.accessRemaining) == 0 {
+        return 0, false
+    }
+    return time.Since(value.created), true
+}
+
+// TimeToLive is a method of a managedMap that returns how long the item stored at key has
+// left before it expires, and a boolean representing whether or not it exists. The time
+// left is the earlier of the item's deadline and the end of its maximum lifetime. Items
+// with an infinite timeout and no maximum lifetime, and pinned items, report the maximum
+// time.Duration, math.MaxInt64. TimeToLive does not consume an access and will always
+// panic when called after the Close method has been called.
+func (t *managedMap) TimeToLive(key interface{}) (time.Duration, bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || value.pending() {
+        return 0, false
+    }
+    return value.remaining(), true
+}
+
+// AccessesRemaining is a method of a managedMap that returns how many accesses the item
+// stored at key has left, and a boolean representing whether or not it exists. Items
+// with infinite accesses report math.MaxUint64, as that is how they are stored. The count
+// is loaded atomically and may be decremented by a concurrent Get as soon as it has been
+// read. AccessesRemaining does not consume an access and will always panic when called
+// after the Close method has been called.
+func (t *managedMap) AccessesRemaining(key interface{}) (uint64, bool) {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || value.pending() {
+        return 0, false
+    }
+    return atomic.LoadUint64(&value.accessRemaining), true
+}
+
+// OlderThan is a method of a managedMap that returns the keys of every item inserted more
+// than d ago, in no particular order. OlderThan does not consume accesses and will always
+// panic when called after the Close method has been called.
+func (t *managedMap) OlderThan(d time.Duration) []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    keys := []interface{}{}
+    now := time.Now()
+    for k, v := range t.m {
+        if atomic.LoadUint64(&v.accessRemaining) != 0 && now.Sub(v.created) > d {
+            keys = append(keys, k)
+        }
+    }
+    return keys
+}
+
+// Pin is a method of a managedMap that exempts the item stored at key from all
+// automatic removal. A pinned item's timer is stopped and its accesses are no longer
+// consumed by Get, so it stays in the map until it is unpinned or explicitly removed
+// with Remove. Pin returns false if the key is absent or the item is already waiting
+// to be deleted. Pin will always panic when called after the Close method has been called.
+func (t *managedMap) Pin(key interface{}) bool {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || atomic.LoadUint64(&value.accessRemaining) == 0 {
+        return false
+    }
+    t.disarm(value)
+    value.pinned.Store(true)
+    return true
+}
+
+// Unpin is a method of a managedMap that returns a pinned item to normal automatic
+// removal. The item's timer is re-armed with its full original timeout and Get
+// resumes consuming its accesses. Unpin does nothing if the key is absent or not
+// pinned. Unpin will always panic when called after the Close method has been called.
+func (t *managedMap) Unpin(key interface{}) {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has || !value.pinned.Load() {
+        return
+    }
+    value.pinned.Store(false)
+    t.arm(key, value, value.loadTimeout())
+}
+
+// MoveEntry moves the item stored at key from src to dst keeping its value, remaining
+// timeout and remaining accesses, for promoting or demoting items between two maps.
+// Both write locks are held for the whole move, taken in a consistent order so that
+// concurrent moves in opposite directions can not deadlock, so no reader of either
+// map sees the key missing from both. An item already stored at key in dst is
+// replaced. MoveEntry returns false if the key is absent from src or its item is
+// already waiting to be deleted. MoveEntry will always panic when either map has
+// been closed.
+func MoveEntry(src, dst *managedMap, key interface{}) bool {
+    if src == dst {
+        return src.Has(key)
+    }
+    src.checkKeyType(key)
+    dst.checkKeyType(key)
+    // Always lock the map at the lower address first
+    first, second := src, dst
+    if uintptr(unsafe.Pointer(dst)) < uintptr(unsafe.Pointer(src)) {
+        first, second = dst, src
+    }
+    // Evictions are reported once neither lock is held
+    defer src.fireEvictions()
+    defer dst.fireEvictions()
+    first.lock.Lock()
+    defer first.lock.Unlock()
+    second.lock.Lock()
+    defer second.lock.Unlock()
+    // Panic if either managedMap is closed
+    src.closed()
+    dst.closed()
+    value, has := src.m[key]
+    if !has {
+        return false
+    }
+    accesses := atomic.LoadUint64(&value.accessRemaining)
+    if accesses == 0 {
+        return false
+    }
+    // Nothing is moved into a map in its close grace period
+    if dst.m == nil {
+        return false
+    }
+    src.unlink(key, value)
+    if old, has := dst.m[key]; has {
+        dst.drop(key, old, EvictRemoved)
+    }
+    moved := dst.insertCreated(key, dst.mustEncode(src.decode(value.load())), value.loadTimeout(), value.remaining(), accesses, value.created)
+    moved.slide.Store(value.slide.Load())
+    dst.prioritize(moved, value.priority)
+    if value.pinned.Load() {
+        dst.disarm(moved)
+        moved.pinned.Store(true)
+    }
+    moved.dirty.Store(value.dirty.Load())
+    return true
+}
+
+// ForEachByDeadline is a method of a managedMap that calls fn for every readable item in
+// order from the soonest to expire to the latest, with the time remaining before each
+// expires, stopping early if fn returns false. Items that never expire come last. The
+// items are snapshotted under the read lock and fn is called after the lock is released,
+// so fn may call back into the map, but it sees items as they were at the time of the
+// call rather than live. No accesses are consumed. ForEachByDeadline will always panic
+// when called after the Close method has been called.
+func (t *managedMap) ForEachByDeadline(fn func(key, value interface{}, remaining time.Duration) bool) {
+    type entry struct {
+        key, value interface{}
+        remaining time.Duration
+    }
+    t.lock.RLock()
+    // Panic if managedMap is closed
+    t.closed()
+    entries := make([]entry, 0, len(t.m))
+    for key, value := range t.m {
+        if atomic.LoadUint64(&value.accessRemaining) == 0 {
+            continue
+        }
+        entries = append(entries, entry{key, t.decode(value.load()), value.remaining()})
+    }
+    t.lock.RUnlock()
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].remaining < entries[j].remaining
+    })
+    for _, e := range entries {
+        if !fn(e.key, e.value, e.remaining) {
+            return
+        }
+    }
+}
+
+// PendingDeletion is a method of a managedMap, intended as a debugging aid, that returns
+// the keys of items whose accesses have run out but that have not yet been deleted
+// from the map. These items already report as absent. A large number of pending keys
+// indicates that the goroutines deleting them are waiting on the write lock.
+// PendingDeletion does not consume any accesses. PendingDeletion will always panic
+// when called after the Close method has been called.
+func (t *managedMap) PendingDeletion() []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    keys := []interface{}{}
+    for key, value := range t.m {
+        if atomic.LoadUint64(&value.accessRemaining) == 0 {
+            keys = append(keys, key)
+        }
+    }
+    return keys
 }
 
 // closed is a private method of a managedMap that panics if the Close method 
 // has been called. This is used internally to ensure that no methods are 
-// called after the data structure is closed. 
+// called after the data structure is closed. During the close grace period it
+// returns normally and callers run against the nil map, so reads find nothing and
+// writes must check for the nil map themselves.
 func (t *managedMap) closed(){
-    if t.m == nil {
+    if t.m == nil && !t.inGrace() {
         panic("Could not perform Close on a closed managedMap")
     }
 }
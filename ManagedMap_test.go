@@ -1,8 +1,22 @@
 package ManagedMap
 
 import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/maphash"
+    "math"
+    "reflect"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
     "testing"
     "time"
+    "unsafe"
 )
 
 func TestPutGetRemoveSize(t *testing.T) {
@@ -71,7 +85,7 @@ func TestExpire(t *testing.T) {
     testMap := NewManagedMap()
     defer testMap.Close()
     for num, test := range tests {
-        testMap.PutCustom(test.key, test.value, Config{test.timeout, 0})
+        testMap.PutCustom(test.key, test.value, Config{Timeout: test.timeout, AccessCount: 0})
         time.Sleep(test.wait)
         value, has:= testMap.Get(test.key)
         if has != test.has {
@@ -82,3 +96,3862 @@ func TestExpire(t *testing.T) {
         testMap.Remove(test.key)
     }
 }
+
+type testSpan struct {
+    operation string
+    attributes map[string]interface{}
+    links []Span
+    ended bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+    s.attributes[key] = value
+}
+
+func (s *testSpan) End() {
+    s.ended = true
+}
+
+func (s *testSpan) AddLink(span Span) {
+    s.links = append(s.links, span)
+}
+
+type testTracer struct {
+    spans []*testSpan
+}
+
+func (tr *testTracer) Start(operation string) Span {
+    span := &testSpan{operation: operation, attributes: map[string]interface{}{}}
+    tr.spans = append(tr.spans, span)
+    return span
+}
+
+func TestTracer(t *testing.T) {
+    tracer := &testTracer{}
+    testMap := NewManagedMap(WithTracer(tracer))
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Get("A")
+    testMap.Get("A")
+
+    var tests = []struct {
+        operation string
+        hit       interface{}
+    }{
+        {"Put", nil},
+        {"Get", true},
+        {"Get", false},
+    }
+    if len(tracer.spans) != len(tests) {
+        t.Fatalf("Expected %d spans, Recieved %d\n", len(tests), len(tracer.spans))
+    }
+    for num, test := range tests {
+        span := tracer.spans[num]
+        if span.operation != test.operation || !span.ended {
+            t.Errorf("Test %d Failed: Expected ended span %v, Recieved %v ended %v\n", num+1, test.operation, span.operation, span.ended)
+        }
+        if span.attributes["hit"] != test.hit {
+            t.Errorf("Test %d Failed: Expected hit %v, Recieved %v\n", num+1, test.hit, span.attributes["hit"])
+        }
+        if span.attributes["key.class"] != "string" {
+            t.Errorf("Test %d Failed: Expected key class string, Recieved %v\n", num+1, span.attributes["key.class"])
+        }
+    }
+}
+
+func TestTouchAll(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 50 * time.Millisecond, AccessCount: 2})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.Get("A")
+    time.Sleep(30 * time.Millisecond)
+    if touched := testMap.TouchAll("A", "B", "C"); touched != 2 {
+        t.Errorf("Expected 2 keys touched, Recieved %d\n", touched)
+    }
+    // Both keys would have expired without the touch
+    time.Sleep(30 * time.Millisecond)
+    var tests = []struct {
+        key interface{}
+        has bool
+    }{
+        {"A", true},
+        {"A", true},
+        {"A", false},
+        {"B", true},
+        {"C", false},
+    }
+    for num, test := range tests {
+        if _, has := testMap.Get(test.key); has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected Exists: %v, Recieved Exists: %v\n", num+1, test.key, test.has, has)
+        }
+    }
+}
+
+func BenchmarkGetInfiniteAccess(b *testing.B) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            testMap.Get("A")
+        }
+    })
+}
+
+func TestPendingDeletion(t *testing.T) {
+    testMap := NewManagedMap()
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    // Simulate "A" having run out of accesses before its goroutine deleted it
+    atomic.StoreUint64(&testMap.m["A"].accessRemaining, 0)
+    pending := testMap.PendingDeletion()
+    if len(pending) != 1 || pending[0] != "A" {
+        t.Errorf("Expected key A pending deletion, Recieved %v\n", pending)
+    }
+    testMap.Remove("A")
+    if pending := testMap.PendingDeletion(); len(pending) != 0 {
+        t.Errorf("Expected no keys pending deletion, Recieved %v\n", pending)
+    }
+}
+
+func TestKeyTypeCheck(t *testing.T) {
+    var tests = []struct {
+        key    interface{}
+        panics bool
+    }{
+        {"A", false},
+        {[2]int{1, 2}, false},
+        {[]int{1, 2}, true},
+        {map[string]int{}, true},
+        {[1]interface{}{[]int{}}, true},
+    }
+    testMap := NewManagedMap(WithKeyTypeCheck())
+    defer testMap.Close()
+    for num, test := range tests {
+        func() {
+            defer func() {
+                r := recover()
+                if (r != nil) != test.panics {
+                    t.Errorf("Test %d Failed: Key %v - Expected Panic: %v, Recieved Panic: %v\n", num+1, test.key, test.panics, r)
+                }
+                if msg, ok := r.(string); r != nil && (!ok || !strings.Contains(msg, fmt.Sprintf("%T", test.key))) {
+                    t.Errorf("Test %d Failed: Expected panic naming type %T, Recieved %v\n", num+1, test.key, r)
+                }
+            }()
+            testMap.Put(test.key, 1)
+        }()
+    }
+    // Methods that only look keys up check them too
+    methods := map[string]func(key interface{}){
+        "TouchAll": func(key interface{}) { testMap.TouchAll("A", key) },
+        "Pin": func(key interface{}) { testMap.Pin(key) },
+        "Unpin": func(key interface{}) { testMap.Unpin(key) },
+    }
+    for name, method := range methods {
+        func() {
+            defer func() {
+                if msg, ok := recover().(string); !ok || !strings.Contains(msg, "[]int") {
+                    t.Errorf("Expected %s to panic naming type []int, Recieved %v\n", name, msg)
+                }
+            }()
+            method([]int{1, 2})
+        }()
+    }
+}
+
+func TestPutGetChecked(t *testing.T) {
+    var tests = []struct {
+        key interface{}
+        err error
+    }{
+        {"A", nil},
+        {[2]int{1, 2}, nil},
+        {[]int{1, 2}, ErrKeyNotComparable},
+        {map[string]int{}, ErrKeyNotComparable},
+        {[1]interface{}{[]int{}}, ErrKeyNotComparable},
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    for num, test := range tests {
+        if err := testMap.PutChecked(test.key, 1, Config{}); err != test.err {
+            t.Errorf("Test %d Failed: Key %v - Expected PutChecked Error: %v, Recieved: %v\n", num+1, test.key, test.err, err)
+        }
+        value, has, err := testMap.GetChecked(test.key)
+        if err != test.err || has != (test.err == nil) || (has && value != 1) {
+            t.Errorf("Test %d Failed: Key %v - Expected GetChecked Error: %v, Recieved: %v %v %v\n", num+1, test.key, test.err, value, has, err)
+        }
+    }
+}
+
+func TestPinUnpin(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    if !testMap.Pin("A") {
+        t.Fatalf("Expected key A to be pinned\n")
+    }
+    if testMap.Pin("B") {
+        t.Errorf("Expected absent key B not to be pinned\n")
+    }
+    // Neither the timeout nor the access count remove a pinned item
+    time.Sleep(40 * time.Millisecond)
+    for i := 0; i < 3; i++ {
+        if _, has := testMap.Get("A"); !has {
+            t.Errorf("Get %d Failed: Expected pinned key A to exist\n", i+1)
+        }
+    }
+    testMap.Unpin("A")
+    time.Sleep(40 * time.Millisecond)
+    if _, has := testMap.Get("A"); has {
+        t.Errorf("Expected key A to expire after being unpinned\n")
+    }
+    // Pinned items can still be removed explicitly
+    testMap.Put("C", 1)
+    testMap.Pin("C")
+    testMap.Remove("C")
+    if testMap.Size() != 0 {
+        t.Errorf("Expected pinned key C to be removed\n")
+    }
+}
+
+func TestGetN(t *testing.T) {
+    var tests = []struct {
+        n    uint64
+        has  bool
+        size int
+    }{
+        {2, true, 1},
+        {4, false, 1},
+        {0, true, 1},
+        {3, true, 0},
+        {1, false, 0},
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 5})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    for num, test := range tests {
+        _, has := testMap.GetN("A", test.n)
+        if has != test.has {
+            t.Errorf("Test %d Failed: GetN %d - Expected Exists: %v, Recieved Exists: %v\n", num+1, test.n, test.has, has)
+        }
+        time.Sleep(time.Millisecond)
+        if size := testMap.Size(); size != test.size {
+            t.Errorf("Test %d Failed: Incorrect Size - Expected: %d, Recieved: %d\n", num+1, test.size, size)
+        }
+    }
+}
+
+func TestMoveEntry(t *testing.T) {
+    src := NewCustomManagedMap(Config{Timeout: 40 * time.Millisecond, AccessCount: 3})
+    defer src.Close()
+    dst := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer dst.Close()
+    src.Put("A", 1)
+    src.Get("A")
+    dst.Put("B", 2)
+    if MoveEntry(src, dst, "C") {
+        t.Errorf("Expected moving absent key C to fail\n")
+    }
+    if !MoveEntry(src, dst, "A") {
+        t.Fatalf("Expected key A to be moved\n")
+    }
+    if src.Has("A") || src.Size() != 0 {
+        t.Errorf("Expected key A to be removed from source\n")
+    }
+    // Moving back the other way takes the locks in the same order
+    if !MoveEntry(dst, src, "B") || !MoveEntry(src, dst, "B") {
+        t.Errorf("Expected key B to be moved back and forth\n")
+    }
+    // The remaining accesses and timeout move with the item
+    for i := 0; i < 2; i++ {
+        if value, has := dst.Get("A"); !has || value != 1 {
+            t.Errorf("Get %d Failed: Expected key A with value 1, Recieved %v %v\n", i+1, value, has)
+        }
+    }
+    if _, has := dst.Get("A"); has {
+        t.Errorf("Expected key A to have run out of accesses\n")
+    }
+    src.Put("D", 4)
+    MoveEntry(src, dst, "D")
+    time.Sleep(60 * time.Millisecond)
+    if dst.Has("D") {
+        t.Errorf("Expected key D to keep its timeout after moving\n")
+    }
+}
+
+func TestCopyOnWrite(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 2}, WithCopyOnWrite())
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    var tests = []struct {
+        has  bool
+        size int
+    }{
+        {true, 1},
+        {true, 0},
+        {false, 0},
+    }
+    for num, test := range tests {
+        if _, has := testMap.Get("A"); has != test.has {
+            t.Errorf("Test %d Failed: Expected Exists: %v, Recieved Exists: %v\n", num+1, test.has, has)
+        }
+        time.Sleep(time.Millisecond)
+        if size := testMap.Size(); size != test.size {
+            t.Errorf("Test %d Failed: Incorrect Size - Expected: %d, Recieved: %d\n", num+1, test.size, size)
+        }
+    }
+    // Readers run against snapshots while writers replace them
+    done := make(chan bool)
+    for i := 0; i < 4; i++ {
+        go func(i int) {
+            for j := 0; j < 100; j++ {
+                testMap.Put(i*100+j, j)
+                testMap.Get(i*100 + j)
+                testMap.Has(i*100 + j)
+                testMap.Remove(i*100 + j)
+            }
+            done <- true
+        }(i)
+    }
+    for i := 0; i < 4; i++ {
+        <-done
+    }
+    if testMap.Has(5) || testMap.Size() != 0 {
+        t.Errorf("Expected all concurrently written keys to be removed\n")
+    }
+}
+
+func TestCopyOnWriteLockFree(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, SlideOnAccess: true}, WithCopyOnWrite())
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    // Peek and Keys read the snapshot even while a writer holds the lock
+    release := make(chan struct{})
+    held := make(chan struct{})
+    go testMap.WithLock(func(u UnsafeMap) {
+        close(held)
+        <-release
+    })
+    <-held
+    read := make(chan bool)
+    go func() {
+        value, has := testMap.Peek("A")
+        keys := testMap.Keys()
+        read <- has && value == 1 && len(keys) == 1
+    }()
+    select {
+    case ok := <-read:
+        if !ok {
+            t.Errorf("Expected Peek and Keys to see key A\n")
+        }
+    case <-time.After(time.Second):
+        t.Errorf("Expected Peek and Keys not to wait for the lock\n")
+    }
+    close(release)
+    // Run with -race; writers re-arm items that lock-free readers are reading
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for j := 0; j < 100; j++ {
+                if i % 2 == 0 {
+                    testMap.Touch("A")
+                    testMap.Extend("A", time.Millisecond)
+                    testMap.Put("A", j)
+                    continue
+                }
+                testMap.Get("A")
+                testMap.Peek("A")
+                testMap.Has("A")
+                testMap.Keys()
+            }
+        }(i)
+    }
+    wg.Wait()
+}
+
+func BenchmarkGetCopyOnWrite(b *testing.B) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithCopyOnWrite())
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            testMap.Get("A")
+        }
+    })
+}
+
+func TestTTLResolution(t *testing.T) {
+    resolution := 50 * time.Millisecond
+    timeout := 20 * time.Millisecond
+    testMap := NewCustomManagedMap(Config{Timeout: timeout, AccessCount: 0}, WithTTLResolution(resolution))
+    defer testMap.Close()
+    for i := 0; i < 10; i++ {
+        testMap.Put(i, i)
+    }
+    testMap.lock.RLock()
+    buckets := len(testMap.buckets)
+    testMap.lock.RUnlock()
+    if buckets < 1 || buckets > 2 {
+        t.Errorf("Expected items inserted together to share timers, Recieved %d buckets\n", buckets)
+    }
+    // Items are never deleted before their deadline
+    time.Sleep(timeout - 5 * time.Millisecond)
+    if size := testMap.Size(); size != 10 {
+        t.Errorf("Expected 10 items before the deadline, Recieved %d\n", size)
+    }
+    // Items are always deleted within one resolution after their deadline
+    time.Sleep(resolution + 15 * time.Millisecond)
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected 0 items after deadline plus resolution, Recieved %d\n", size)
+    }
+    testMap.lock.RLock()
+    buckets = len(testMap.buckets)
+    testMap.lock.RUnlock()
+    if buckets != 0 {
+        t.Errorf("Expected expired buckets to be released, Recieved %d buckets\n", buckets)
+    }
+    // Removing the last item of a bucket releases it
+    testMap.Put("A", 1)
+    testMap.Remove("A")
+    if len(testMap.buckets) != 0 {
+        t.Errorf("Expected removed item's bucket to be released\n")
+    }
+}
+
+func TestDedupValues(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithDedupValues())
+    defer testMap.Close()
+    shared := []int{1}
+    for i := 0; i < 3; i++ {
+        // Build an equal string with its own backing array each time
+        testMap.Put(i, strings.Repeat("ab", 8))
+        testMap.Put(fmt.Sprint("slice", i), shared)
+    }
+    first, _ := testMap.Get(0)
+    second, _ := testMap.Get(1)
+    if unsafe.StringData(first.(string)) != unsafe.StringData(second.(string)) {
+        t.Errorf("Expected equal values to share one stored copy\n")
+    }
+    if refs := testMap.dedup.values[first].refs; refs != 3 {
+        t.Errorf("Expected 3 references to the shared value, Recieved %d\n", refs)
+    }
+    // Removing one key does not affect the value of the others
+    testMap.Remove(0)
+    if value, has := testMap.Get(1); !has || value != strings.Repeat("ab", 8) {
+        t.Errorf("Expected key 1 to keep the shared value, Recieved %v %v\n", value, has)
+    }
+    // Replacing and removing the remaining references releases the shared value
+    testMap.Put(1, "other")
+    testMap.Remove(2)
+    if _, has := testMap.dedup.values[first]; has {
+        t.Errorf("Expected the unreferenced shared value to be released\n")
+    }
+    if value, _ := testMap.Get("slice1"); value.([]int)[0] != 1 {
+        t.Errorf("Expected non-comparable values to be stored as they are\n")
+    }
+}
+
+func TestActiveGoroutines(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 1}, WithPerItemTimers())
+    for i := 0; i < 5; i++ {
+        testMap.Put(i, i)
+    }
+    // Items with an infinite timeout don't need a goroutine
+    testMap.PutCustom("infinite", 1, Config{Timeout: 0, AccessCount: 0})
+    if active := testMap.Stats().ActiveGoroutines; active != 5 {
+        t.Errorf("Expected 5 active goroutines, Recieved %d\n", active)
+    }
+    testMap.Remove(0)
+    testMap.Get(1)
+    testMap.Close()
+    time.Sleep(10 * time.Millisecond)
+    if active := testMap.Stats().ActiveGoroutines; active != 0 {
+        t.Errorf("Expected 0 active goroutines after Close, Recieved %d\n", active)
+    }
+}
+
+func TestPrivateScheduler(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0})
+    defer testMap.Close()
+    for i := 0; i < 100; i++ {
+        testMap.Put(i, i)
+    }
+    // Items are expired by the map's Scheduler rather than their own goroutines
+    if active := testMap.Stats().ActiveGoroutines; active != 0 {
+        t.Errorf("Expected 0 active goroutines, Recieved %d\n", active)
+    }
+    if features := testMap.Features(); features.PerItemTimers || features.SharedScheduler {
+        t.Errorf("Expected map to use a private Scheduler, Recieved %+v\n", features)
+    }
+    time.Sleep(60 * time.Millisecond)
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected all items to expire, Recieved size %d\n", size)
+    }
+}
+
+func TestSharedScheduler(t *testing.T) {
+    scheduler := NewScheduler()
+    scheduler.Start()
+    defer scheduler.Stop()
+    first := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0}, WithSharedScheduler(scheduler))
+    defer first.Close()
+    second := NewCustomManagedMap(Config{Timeout: 40 * time.Millisecond, AccessCount: 0}, WithSharedScheduler(scheduler))
+    defer second.Close()
+    for i := 0; i < 5; i++ {
+        first.Put(i, i)
+        second.Put(i, i)
+    }
+    if active := first.Stats().ActiveGoroutines + second.Stats().ActiveGoroutines; active != 0 {
+        t.Errorf("Expected no per-item goroutines, Recieved %d\n", active)
+    }
+    second.Remove(0)
+    second.TouchAll(1)
+    time.Sleep(30 * time.Millisecond)
+    if first.Size() != 0 || second.Size() != 4 {
+        t.Errorf("Expected only the first map's items to expire, Recieved sizes %d and %d\n", first.Size(), second.Size())
+    }
+    // Items do not expire while the scheduler is stopped
+    scheduler.Stop()
+    time.Sleep(30 * time.Millisecond)
+    if second.Size() != 4 {
+        t.Errorf("Expected items to remain while the scheduler is stopped, Recieved %d\n", second.Size())
+    }
+    scheduler.Start()
+    time.Sleep(10 * time.Millisecond)
+    if second.Size() != 0 {
+        t.Errorf("Expected items to expire once the scheduler is restarted, Recieved %d\n", second.Size())
+    }
+}
+
+func TestGetAndRemaining(t *testing.T) {
+    var tests = []struct {
+        key       interface{}
+        remaining uint64
+        has       bool
+    }{
+        {"A", 2, true},
+        {"A", 1, true},
+        {"A", 0, true},
+        {"A", 0, false},
+        {"B", math.MaxUint64, true},
+        {"C", 0, false},
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 3})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 0})
+    for num, test := range tests {
+        _, remaining, has := testMap.GetAndRemaining(test.key)
+        if has != test.has || remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected %d remaining Exists: %v, Recieved %d remaining Exists: %v\n", num+1, test.key, test.remaining, test.has, remaining, has)
+        }
+    }
+}
+
+func TestUpdateIfStale(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 40 * time.Millisecond, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    increment := func(old interface{}) interface{} {
+        return old.(int) + 1
+    }
+    var tests = []struct {
+        wait    time.Duration
+        updated bool
+        value   int
+    }{
+        {0, false, 1},
+        {30 * time.Millisecond, true, 2},
+        // The update re-armed the timer so it is no longer stale
+        {0, false, 2},
+        {30 * time.Millisecond, true, 3},
+    }
+    for num, test := range tests {
+        time.Sleep(test.wait)
+        if updated := testMap.UpdateIfStale("A", 20 * time.Millisecond, increment); updated != test.updated {
+            t.Errorf("Test %d Failed: Expected Updated: %v, Recieved Updated: %v\n", num+1, test.updated, updated)
+        }
+        if value, _ := testMap.Get("A"); value != test.value {
+            t.Errorf("Test %d Failed: Expected Value: %v, Recieved Value: %v\n", num+1, test.value, value)
+        }
+    }
+    if testMap.UpdateIfStale("B", time.Hour, increment) {
+        t.Errorf("Expected absent key B not to be updated\n")
+    }
+}
+
+func TestMaxValueSize(t *testing.T) {
+    var tests = []struct {
+        value interface{}
+        err   error
+    }{
+        {strings.Repeat("a", 8), nil},
+        {strings.Repeat("a", 9), ErrValueTooLarge},
+        {[]byte{1, 2, 3, 4, 5, 6, 7, 8}, nil},
+        {[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, ErrValueTooLarge},
+    }
+    sizer := func(value interface{}) int64 {
+        return int64(reflect.ValueOf(value).Len())
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithMaxValueSize(8, sizer))
+    defer testMap.Close()
+    for num, test := range tests {
+        if err := testMap.PutChecked(num, test.value, Config{}); err != test.err {
+            t.Errorf("Test %d Failed: Value %v - Expected Error: %v, Recieved Error: %v\n", num+1, test.value, test.err, err)
+        }
+        if has := testMap.Has(num); has != (test.err == nil) {
+            t.Errorf("Test %d Failed: Value %v - Expected Exists: %v, Recieved Exists: %v\n", num+1, test.value, test.err == nil, has)
+        }
+    }
+    // Put silently drops values that are too large, including updates
+    testMap.Put(0, strings.Repeat("a", 9))
+    if value, _ := testMap.Get(0); value != strings.Repeat("a", 8) {
+        t.Errorf("Expected oversized update to be dropped, Recieved %v\n", value)
+    }
+
+    // The default sizer counts the string header plus its bytes
+    header := int64(reflect.TypeOf("").Size())
+    defaultMap := NewManagedMap(WithMaxValueSize(header + 4, nil))
+    defer defaultMap.Close()
+    if err := defaultMap.PutChecked("A", "abcd", Config{}); err != nil {
+        t.Errorf("Expected value at the limit to be stored, Recieved %v\n", err)
+    }
+    if err := defaultMap.PutChecked("B", "abcde", Config{}); err != ErrValueTooLarge {
+        t.Errorf("Expected value over the limit to be rejected, Recieved %v\n", err)
+    }
+}
+
+func TestLoaderGroup(t *testing.T) {
+    loads := int64(0)
+    loader := func(ctx context.Context, key interface{}) (interface{}, error) {
+        atomic.AddInt64(&loads, 1)
+        time.Sleep(20 * time.Millisecond)
+        if key == "missing" {
+            return nil, errors.New("not found")
+        }
+        return fmt.Sprint(key, "-loaded"), nil
+    }
+    group := NewGroup()
+    maps := []*managedMap{
+        NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithLoader(loader), WithLoaderGroup(group)),
+        NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithLoader(loader), WithLoaderGroup(group)),
+    }
+    done := make(chan bool)
+    for i := 0; i < 6; i++ {
+        go func(m *managedMap) {
+            value, err := m.GetLoad(context.Background(), "A")
+            if err != nil || value != "A-loaded" {
+                t.Errorf("Expected loaded value A-loaded, Recieved %v %v\n", value, err)
+            }
+            done <- true
+        }(maps[i % 2])
+    }
+    for i := 0; i < 6; i++ {
+        <-done
+    }
+    if loads != 1 {
+        t.Errorf("Expected a single load across maps sharing a group, Recieved %d\n", loads)
+    }
+    // Both maps store the shared result
+    for num, m := range maps {
+        if value, has := m.Get("A"); !has || value != "A-loaded" {
+            t.Errorf("Map %d Failed: Expected stored value A-loaded, Recieved %v %v\n", num+1, value, has)
+        }
+        defer m.Close()
+    }
+    if _, err := maps[0].GetLoad(context.Background(), "missing"); err == nil || maps[0].Has("missing") {
+        t.Errorf("Expected a failed load to return its error and store nothing\n")
+    }
+    noLoader := NewManagedMap()
+    defer noLoader.Close()
+    if _, err := noLoader.GetLoad(context.Background(), "A"); err != ErrNoLoader {
+        t.Errorf("Expected ErrNoLoader, Recieved %v\n", err)
+    }
+}
+
+func TestForEachByDeadline(t *testing.T) {
+    testMap := NewManagedMap()
+    defer testMap.Close()
+    testMap.PutCustom("late", 3, Config{Timeout: time.Hour, AccessCount: 1})
+    testMap.PutCustom("never", 4, Config{Timeout: 0, AccessCount: 1})
+    testMap.PutCustom("soon", 1, Config{Timeout: time.Minute, AccessCount: 1})
+    testMap.PutCustom("middle", 2, Config{Timeout: 30 * time.Minute, AccessCount: 1})
+    expected := []interface{}{"soon", "middle", "late", "never"}
+    keys := []interface{}{}
+    testMap.ForEachByDeadline(func(key, value interface{}, remaining time.Duration) bool {
+        keys = append(keys, key)
+        return true
+    })
+    if !reflect.DeepEqual(keys, expected) {
+        t.Errorf("Expected keys in deadline order %v, Recieved %v\n", expected, keys)
+    }
+    // Stopping early and not consuming accesses
+    keys = keys[:0]
+    testMap.ForEachByDeadline(func(key, value interface{}, remaining time.Duration) bool {
+        keys = append(keys, key)
+        return len(keys) < 2
+    })
+    if !reflect.DeepEqual(keys, expected[:2]) {
+        t.Errorf("Expected iteration to stop after %v, Recieved %v\n", expected[:2], keys)
+    }
+    if _, has := testMap.Get("soon"); !has {
+        t.Errorf("Expected ForEachByDeadline not to consume accesses\n")
+    }
+}
+
+func TestWriteBack(t *testing.T) {
+    var testMap *managedMap
+    var lock sync.Mutex
+    flushed := map[interface{}]interface{}{}
+    get := func(key interface{}) interface{} {
+        lock.Lock()
+        defer lock.Unlock()
+        return flushed[key]
+    }
+    failure := errors.New("store unavailable")
+    flush := func(key, value interface{}) error {
+        // The item must still be in the map while it is flushed
+        if _, has := testMap.m[key]; !has {
+            t.Errorf("Expected key %v to be flushed before it is evicted\n", key)
+        }
+        if key == "fail" {
+            return failure
+        }
+        lock.Lock()
+        defer lock.Unlock()
+        flushed[key] = value
+        return nil
+    }
+    testMap = NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0}, WithWriteBack(flush))
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.Put("fail", 3)
+    testMap.PutCustom("C", 4, Config{Timeout: time.Hour, AccessCount: 1})
+    if err := testMap.FlushKey("B"); err != nil || get("B") != 2 {
+        t.Errorf("Expected FlushKey to flush B, Recieved %v\n", err)
+    }
+    lock.Lock()
+    delete(flushed, "B")
+    lock.Unlock()
+    // Evicting by access count flushes the item
+    testMap.Get("C")
+    time.Sleep(40 * time.Millisecond)
+    if get("A") != 1 || get("C") != 4 {
+        t.Errorf("Expected dirty items to be flushed on eviction, Recieved %v\n", flushed)
+    }
+    // B was clean so its eviction didn't flush it again
+    if get("B") != nil {
+        t.Errorf("Expected clean item B not to be flushed again\n")
+    }
+    select {
+    case letter := <-testMap.DeadLetters():
+        if letter.Key != "fail" || letter.Err != failure {
+            t.Errorf("Expected dead letter for key fail, Recieved %v\n", letter)
+        }
+    default:
+        t.Errorf("Expected failed flush to be dead lettered\n")
+    }
+    testMap.PutCustom("D", 5, Config{Timeout: time.Hour, AccessCount: 0})
+    testMap.PutCustom("fail", 6, Config{Timeout: time.Hour, AccessCount: 0})
+    if err := testMap.Flush(); !errors.Is(err, failure) || get("D") != 5 {
+        t.Errorf("Expected Flush to flush D and return the failure, Recieved %v\n", err)
+    }
+    testMap.Remove("fail")
+    testMap.Put("E", 7)
+    testMap.Close()
+    if get("E") != 7 {
+        t.Errorf("Expected Close to flush dirty items\n")
+    }
+}
+
+func TestFlushRetry(t *testing.T) {
+    var lock sync.Mutex
+    attempts := map[interface{}]int{}
+    flush := func(key, value interface{}) error {
+        lock.Lock()
+        defer lock.Unlock()
+        attempts[key]++
+        // "A" recovers on its third attempt while "B" never does
+        if key == "B" || attempts[key] < 3 {
+            return errors.New("store unavailable")
+        }
+        return nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1}, WithWriteBack(flush), WithFlushRetry(3, 4 * time.Millisecond))
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.Get("A")
+    testMap.Get("B")
+    time.Sleep(5 * time.Millisecond)
+    if depth := testMap.Stats().RetryQueueDepth; depth == 0 {
+        t.Errorf("Expected failed flushes to wait in the retry queue\n")
+    }
+    time.Sleep(80 * time.Millisecond)
+    lock.Lock()
+    if attempts["A"] != 3 || attempts["B"] != 4 {
+        t.Errorf("Expected 3 attempts for A and 4 for B, Recieved %v\n", attempts)
+    }
+    lock.Unlock()
+    if depth := testMap.Stats().RetryQueueDepth; depth != 0 {
+        t.Errorf("Expected an empty retry queue, Recieved %d\n", depth)
+    }
+    select {
+    case letter := <-testMap.DeadLetters():
+        if letter.Key != "B" {
+            t.Errorf("Expected only key B to be dead lettered, Recieved %v\n", letter.Key)
+        }
+    default:
+        t.Errorf("Expected key B to be dead lettered after its retries\n")
+    }
+    if len(testMap.DeadLetters()) != 0 {
+        t.Errorf("Expected a single dead letter\n")
+    }
+}
+
+func TestManagedMultiMap(t *testing.T) {
+    testMap := NewCustomManagedMultiMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.AddCustom("A", 1, Config{Timeout: 20 * time.Millisecond, AccessCount: 0})
+    testMap.AddCustom("A", 2, Config{Timeout: 60 * time.Millisecond, AccessCount: 0})
+    testMap.AddCustom("A", 2, Config{Timeout: 0, AccessCount: 1})
+    testMap.Add("B", 3)
+    var tests = []struct {
+        wait   time.Duration
+        key    interface{}
+        values []interface{}
+        size   int
+    }{
+        // Duplicate values are kept separately
+        {0, "A", []interface{}{1, 2, 2}, 2},
+        // The single access value has been consumed
+        {0, "A", []interface{}{1, 2}, 2},
+        {40 * time.Millisecond, "A", []interface{}{2}, 2},
+        // The key is removed once its last value expires
+        {40 * time.Millisecond, "A", []interface{}{}, 1},
+        {0, "B", []interface{}{3}, 1},
+    }
+    for num, test := range tests {
+        time.Sleep(test.wait)
+        if values := testMap.Get(test.key); !reflect.DeepEqual(values, test.values) {
+            t.Errorf("Test %d Failed: Key %v - Expected Values: %v, Recieved Values: %v\n", num+1, test.key, test.values, values)
+        }
+        time.Sleep(time.Millisecond)
+        if size := testMap.Size(); size != test.size {
+            t.Errorf("Test %d Failed: Incorrect Size - Expected: %d, Recieved: %d\n", num+1, test.size, size)
+        }
+    }
+    testMap.Remove("B")
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected Remove to remove key B and its values, Recieved size %d\n", size)
+    }
+}
+
+func TestTransformAll(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.PutCustom("C", 3, Config{Timeout: 0, AccessCount: 2})
+    testMap.TransformAll(func(key, value interface{}) interface{} {
+        return fmt.Sprintf("%v%d", key, value.(int)*10)
+    })
+    var tests = []struct {
+        key       interface{}
+        value     interface{}
+        remaining uint64
+    }{
+        {"A", "A10", math.MaxUint64},
+        {"B", "B20", math.MaxUint64},
+        // Access counts are preserved
+        {"C", "C30", 1},
+    }
+    for num, test := range tests {
+        value, remaining, has := testMap.GetAndRemaining(test.key)
+        if !has || value != test.value || remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v %d, Recieved: %v %d %v\n", num+1, test.key, test.value, test.remaining, value, remaining, has)
+        }
+    }
+}
+
+func TestAge(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    time.Sleep(30 * time.Millisecond)
+    testMap.Put("B", 2)
+    // Updating a key does not reset its age
+    testMap.Put("A", 3)
+    var tests = []struct {
+        key interface{}
+        min time.Duration
+        has bool
+    }{
+        {"A", 30 * time.Millisecond, true},
+        {"B", 0, true},
+        {"C", 0, false},
+    }
+    for num, test := range tests {
+        age, has := testMap.Age(test.key)
+        if has != test.has || age < test.min || (test.min == 0 && age >= 30*time.Millisecond) {
+            t.Errorf("Test %d Failed: Key %v - Expected age of at least %v and %v, Recieved: %v %v\n", num+1, test.key, test.min, test.has, age, has)
+        }
+    }
+    if keys := testMap.OlderThan(20 * time.Millisecond); !reflect.DeepEqual(keys, []interface{}{"A"}) {
+        t.Errorf("Expected OlderThan to return [A], Recieved: %v\n", keys)
+    }
+    if keys := testMap.OlderThan(time.Hour); len(keys) != 0 {
+        t.Errorf("Expected OlderThan to return no keys, Recieved: %v\n", keys)
+    }
+}
+
+func TestCloseGrace(t *testing.T) {
+    var tests = []struct {
+        name string
+        fn   func(m *managedMap)
+    }{
+        {"Get", func(m *managedMap) {
+            if value, has := m.Get("A"); value != nil || has {
+                t.Errorf("Expected Get to return nil false, Recieved: %v %v\n", value, has)
+            }
+        }},
+        {"Has", func(m *managedMap) {
+            if m.Has("A") {
+                t.Errorf("Expected Has to return false\n")
+            }
+        }},
+        {"Put", func(m *managedMap) {
+            m.Put("B", 2)
+            if size := m.Size(); size != 0 {
+                t.Errorf("Expected Put to be dropped, Recieved size %d\n", size)
+            }
+        }},
+        {"Remove", func(m *managedMap) { m.Remove("A") }},
+        {"Close", func(m *managedMap) { m.Close() }},
+    }
+    for _, cow := range []bool{false, true} {
+        opts := []Option{WithCloseGrace(50 * time.Millisecond)}
+        if cow {
+            opts = append(opts, WithCopyOnWrite())
+        }
+        testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, opts...)
+        testMap.Put("A", 1)
+        testMap.Close()
+        for num, test := range tests {
+            func() {
+                defer func() {
+                    if r := recover(); r != nil {
+                        t.Errorf("Test %d Failed: %s panicked during the close grace period: %v\n", num+1, test.name, r)
+                    }
+                }()
+                test.fn(testMap)
+            }()
+        }
+        time.Sleep(60 * time.Millisecond)
+        for num, test := range tests {
+            // Close never panics on a closed map
+            if test.name == "Close" {
+                continue
+            }
+            func() {
+                defer func() {
+                    if r := recover(); r == nil {
+                        t.Errorf("Test %d Failed: %s did not panic after the close grace period\n", num+1, test.name)
+                    }
+                }()
+                test.fn(testMap)
+            }()
+        }
+    }
+}
+
+func TestEvictVeto(t *testing.T) {
+    var lock sync.Mutex
+    reasons := map[interface{}][]EvictReason{}
+    veto := func(key, value interface{}, reason EvictReason) bool {
+        lock.Lock()
+        defer lock.Unlock()
+        reasons[key] = append(reasons[key], reason)
+        // Keep "A" through its first expiry and "B" through its first exhaustion
+        return len(reasons[key]) == 1 && key != "C"
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 40 * time.Millisecond, AccessCount: 2}, WithEvictVeto(veto))
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 1})
+    testMap.PutCustom("C", 3, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    testMap.Get("B")
+    time.Sleep(25 * time.Millisecond)
+    var tests = []struct {
+        key       interface{}
+        has       bool
+        remaining uint64
+    }{
+        // Vetoed expiry re-armed with the default timeout
+        {"A", true, math.MaxUint64},
+        // Vetoed exhaustion given the default access count
+        {"B", true, 1},
+        {"C", false, 0},
+    }
+    for num, test := range tests {
+        if _, remaining, has := testMap.GetAndRemaining(test.key); has != test.has || remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v %d, Recieved: %v %d\n", num+1, test.key, test.has, test.remaining, has, remaining)
+        }
+    }
+    time.Sleep(50 * time.Millisecond)
+    if testMap.Has("A") || testMap.Has("B") {
+        t.Errorf("Expected A and B to expire after their vetoed evictions\n")
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    expected := map[interface{}][]EvictReason{
+        "A": {EvictExpired, EvictExpired},
+        // B is re-armed with the default timeout so it expires after its veto
+        "B": {EvictAccessExhausted, EvictExpired},
+        "C": {EvictExpired},
+    }
+    if !reflect.DeepEqual(reasons, expected) {
+        t.Errorf("Expected eviction reasons %v, Recieved: %v\n", expected, reasons)
+    }
+    if vetoes := testMap.Stats().Vetoes; vetoes != 2 {
+        t.Errorf("Expected 2 vetoes, Recieved: %d\n", vetoes)
+    }
+}
+
+func TestGetAsync(t *testing.T) {
+    loads := int64(0)
+    loader := func(ctx context.Context, key interface{}) (interface{}, error) {
+        atomic.AddInt64(&loads, 1)
+        time.Sleep(20 * time.Millisecond)
+        if key == "missing" {
+            return nil, errors.New("not found")
+        }
+        return fmt.Sprint(key, "-loaded"), nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithLoader(loader))
+    defer testMap.Close()
+    testMap.Put("A", "A-stored")
+    var tests = []struct {
+        key    interface{}
+        result Result
+    }{
+        {"A", Result{Value: "A-stored", OK: true}},
+        {"B", Result{Value: "B-loaded", OK: true}},
+        {"B", Result{Value: "B-loaded", OK: true}},
+        {"missing", Result{Err: errors.New("not found")}},
+    }
+    results := []<-chan Result{}
+    for _, test := range tests {
+        results = append(results, testMap.GetAsync(test.key))
+    }
+    for num, test := range tests {
+        result := <-results[num]
+        if !reflect.DeepEqual(result, test.result) {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.result, result)
+        }
+        if _, open := <-results[num]; open {
+            t.Errorf("Test %d Failed: Expected the channel to be closed after delivery\n", num+1)
+        }
+    }
+    if loads != 2 {
+        t.Errorf("Expected concurrent async gets of a key to share a load, Recieved %d loads\n", loads)
+    }
+    if result := <-NewManagedMap().GetAsync("A"); result.Err != ErrNoLoader {
+        t.Errorf("Expected ErrNoLoader without a Loader, Recieved: %v\n", result.Err)
+    }
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+    running, peak := int64(0), int64(0)
+    release := make(chan struct{})
+    loader := func(ctx context.Context, key interface{}) (interface{}, error) {
+        n := atomic.AddInt64(&running, 1)
+        defer atomic.AddInt64(&running, -1)
+        for {
+            p := atomic.LoadInt64(&peak)
+            if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+                break
+            }
+        }
+        <-release
+        return key, nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithLoader(loader), WithMaxConcurrentLoads(2))
+    defer testMap.Close()
+    var wg sync.WaitGroup
+    for i := 0; i < 5; i++ {
+        wg.Add(1)
+        go func(key int) {
+            defer wg.Done()
+            if value, err := testMap.GetLoad(context.Background(), key); err != nil || value != key {
+                t.Errorf("Expected loaded value %d, Recieved %v %v\n", key, value, err)
+            }
+        }(i)
+    }
+    time.Sleep(20 * time.Millisecond)
+    if loads := testMap.Stats().InFlightLoads; loads != 2 {
+        t.Errorf("Expected 2 in flight loads, Recieved %d\n", loads)
+    }
+    // A load waiting for a slot gives up when its context is done
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if _, err := testMap.GetLoad(ctx, "waiting"); err != context.DeadlineExceeded {
+        t.Errorf("Expected context.DeadlineExceeded while waiting for a slot, Recieved %v\n", err)
+    }
+    close(release)
+    wg.Wait()
+    if peak != 2 {
+        t.Errorf("Expected at most 2 concurrent loads, Recieved %d\n", peak)
+    }
+    if size := testMap.Size(); size != 5 {
+        t.Errorf("Expected 5 loaded keys, Recieved %d\n", size)
+    }
+}
+
+func TestStatus(t *testing.T) {
+    // A coarse resolution leaves expired items in the map for a while
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithTTLResolution(time.Hour))
+    defer testMap.Close()
+    testMap.Put("Live", 1)
+    testMap.PutCustom("Expired", 2, Config{Timeout: time.Millisecond, AccessCount: 0})
+    testMap.PutCustom("Exhausted", 3, Config{Timeout: 0, AccessCount: 1})
+    testMap.lock.Lock()
+    atomic.StoreUint64(&testMap.m["Exhausted"].accessRemaining, 0)
+    testMap.lock.Unlock()
+    time.Sleep(5 * time.Millisecond)
+    var tests = []struct {
+        key    interface{}
+        status EntryStatus
+    }{
+        {"Live", StatusLive},
+        {"Expired", StatusExpiredPendingDelete},
+        {"Exhausted", StatusAccessExhaustedPendingDelete},
+        {"Missing", StatusAbsent},
+    }
+    for num, test := range tests {
+        if status := testMap.Status(test.key); status != test.status {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.status, status)
+        }
+    }
+    if _, remaining, _ := testMap.GetAndRemaining("Live"); remaining != math.MaxUint64 {
+        t.Errorf("Expected Status not to consume accesses, Recieved %d remaining\n", remaining)
+    }
+}
+
+func TestMetricsInterval(t *testing.T) {
+    emitted := make(chan Stats, 100)
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithPerItemTimers(), WithMetricsInterval(5*time.Millisecond, func(s Stats) {
+        emitted <- s
+    }))
+    testMap.Put("A", 1)
+    time.Sleep(30 * time.Millisecond)
+    testMap.Close()
+    // Let an emit racing with Close finish
+    time.Sleep(2 * time.Millisecond)
+    count := len(emitted)
+    if count < 2 {
+        t.Errorf("Expected Stats to be emitted periodically, Recieved %d snapshots\n", count)
+    }
+    time.Sleep(20 * time.Millisecond)
+    if after := len(emitted); after > count {
+        t.Errorf("Expected no Stats to be emitted after Close, Recieved %d more\n", after-count)
+    }
+    if s := <-emitted; s.ActiveGoroutines != 1 {
+        t.Errorf("Expected emitted Stats to count 1 goroutine, Recieved %d\n", s.ActiveGoroutines)
+    }
+}
+
+func TestConfigLoader(t *testing.T) {
+    loader := func(ctx context.Context, key interface{}) (interface{}, Config, error) {
+        switch key {
+        case "Short":
+            return 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0}, nil
+        case "Limited":
+            return 2, Config{Timeout: 0, AccessCount: 2}, nil
+        }
+        return 3, Config{}, nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 5}, WithConfigLoader(loader))
+    defer testMap.Close()
+    for _, key := range []string{"Short", "Limited", "Default"} {
+        if _, err := testMap.GetLoad(context.Background(), key); err != nil {
+            t.Errorf("Expected %s to load, Recieved %v\n", key, err)
+        }
+    }
+    time.Sleep(20 * time.Millisecond)
+    var tests = []struct {
+        key       interface{}
+        has       bool
+        remaining uint64
+    }{
+        {"Short", false, 0},
+        {"Limited", true, 1},
+        // A zero Config falls back to the defaults
+        {"Default", true, 4},
+    }
+    for num, test := range tests {
+        if _, remaining, has := testMap.GetAndRemaining(test.key); has != test.has || remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v %d, Recieved: %v %d\n", num+1, test.key, test.has, test.remaining, has, remaining)
+        }
+    }
+}
+
+func TestCloseOrdered(t *testing.T) {
+    flushed := []interface{}{}
+    flush := func(key, value interface{}) error {
+        flushed = append(flushed, key)
+        return nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithWriteBack(flush))
+    expected := []interface{}{}
+    for i := 9; i >= 0; i-- {
+        testMap.Put(i, i)
+        expected = append(expected, i)
+    }
+    // Tear down in reverse order of the keys
+    testMap.CloseOrdered(func(a, b interface{}) bool {
+        return a.(int) > b.(int)
+    })
+    if !reflect.DeepEqual(flushed, expected) {
+        t.Errorf("Expected items to be flushed in order %v, Recieved: %v\n", expected, flushed)
+    }
+}
+
+func TestIncrementCapped(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    var tests = []struct {
+        wait  time.Duration
+        key   interface{}
+        delta int64
+        count int64
+        ok    bool
+    }{
+        {0, "A", 1, 1, true},
+        {0, "A", 1, 2, true},
+        {0, "A", 1, 3, true},
+        // Over the cap the counter is still stored
+        {0, "A", 1, 4, false},
+        {0, "B", 5, 5, false},
+        // The counter starts over after the window
+        {40 * time.Millisecond, "A", 2, 2, true},
+    }
+    for num, test := range tests {
+        time.Sleep(test.wait)
+        count, ok := testMap.IncrementCapped(test.key, test.delta, 3, 30*time.Millisecond)
+        if count != test.count || ok != test.ok {
+            t.Errorf("Test %d Failed: Key %v - Expected: %d %v, Recieved: %d %v\n", num+1, test.key, test.count, test.ok, count, ok)
+        }
+    }
+    testMap.Put("C", "not a counter")
+    defer func() {
+        if r := recover(); r == nil {
+            t.Errorf("Expected IncrementCapped to panic on a value that is not an int64\n")
+        }
+    }()
+    testMap.IncrementCapped("C", 1, 3, time.Second)
+}
+
+type serializedRecord struct {
+    Name string
+    Tags []string
+}
+
+func recordSerializer() Option {
+    return WithSerializer(json.Marshal, func(data []byte) (interface{}, error) {
+        var record serializedRecord
+        err := json.Unmarshal(data, &record)
+        return record, err
+    })
+}
+
+func TestSerializer(t *testing.T) {
+    flushed := make(chan interface{}, 1)
+    flush := func(key, value interface{}) error {
+        flushed <- value
+        return nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, recordSerializer(), WithWriteBack(flush))
+    defer testMap.Close()
+    record := serializedRecord{Name: "A", Tags: []string{"x", "y"}}
+    testMap.Put("A", record)
+    if _, stored := testMap.m["A"].load().([]byte); !stored {
+        t.Errorf("Expected the value to be stored as bytes, Recieved %T\n", testMap.m["A"].load())
+    }
+    if value, has := testMap.Get("A"); !has || !reflect.DeepEqual(value, record) {
+        t.Errorf("Expected Get to return %v, Recieved: %v %v\n", record, value, has)
+    }
+    testMap.TransformAll(func(key, value interface{}) interface{} {
+        r := value.(serializedRecord)
+        r.Name = "B"
+        return r
+    })
+    testMap.FlushKey("A")
+    if value := <-flushed; value.(serializedRecord).Name != "B" {
+        t.Errorf("Expected the flushed value to be unmarshaled and transformed, Recieved: %v\n", value)
+    }
+    if err := testMap.PutChecked("C", make(chan int), Config{}); err == nil {
+        t.Errorf("Expected PutChecked to return the marshal error\n")
+    }
+    if testMap.Has("C") {
+        t.Errorf("Expected a value that fails to marshal not to be stored\n")
+    }
+}
+
+func BenchmarkGCSerializer(b *testing.B) {
+    for _, serialized := range []bool{false, true} {
+        name := "Live"
+        opts := []Option{}
+        if serialized {
+            name = "Serialized"
+            opts = append(opts, recordSerializer())
+        }
+        b.Run(name, func(b *testing.B) {
+            testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, opts...)
+            defer testMap.Close()
+            for i := 0; i < 100000; i++ {
+                testMap.Put(i, serializedRecord{Name: fmt.Sprint(i), Tags: []string{"a", "b", "c"}})
+            }
+            var before, after runtime.MemStats
+            runtime.GC()
+            runtime.ReadMemStats(&before)
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                runtime.GC()
+            }
+            b.StopTimer()
+            runtime.ReadMemStats(&after)
+            b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "pause-ns/op")
+            b.ReportMetric(float64(after.HeapObjects), "heap-objects")
+        })
+    }
+}
+
+func TestLiveSize(t *testing.T) {
+    // A coarse resolution leaves expired items in the map for a while
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithTTLResolution(time.Hour))
+    defer testMap.Close()
+    testMap.Put("Live", 1)
+    testMap.PutCustom("Expired", 2, Config{Timeout: time.Millisecond, AccessCount: 0})
+    testMap.PutCustom("Exhausted", 3, Config{Timeout: 0, AccessCount: 1})
+    testMap.lock.Lock()
+    atomic.StoreUint64(&testMap.m["Exhausted"].accessRemaining, 0)
+    testMap.lock.Unlock()
+    time.Sleep(5 * time.Millisecond)
+    if size, live := testMap.Size(), testMap.LiveSize(); size != 3 || live != 1 {
+        t.Errorf("Expected a Size of 3 and a LiveSize of 1, Recieved: %d %d\n", size, live)
+    }
+}
+
+func TestCompactThreshold(t *testing.T) {
+    defer func(interval time.Duration) { compactInterval = interval }(compactInterval)
+    compactInterval = 5 * time.Millisecond
+    // A coarse resolution leaves expired items in the map until they are compacted
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithTTLResolution(time.Hour), WithCompactThreshold(0.5))
+    defer testMap.Close()
+    for i := 0; i < 4; i++ {
+        testMap.Put(i, i)
+    }
+    testMap.PutCustom("A", 1, Config{Timeout: time.Millisecond, AccessCount: 0})
+    time.Sleep(20 * time.Millisecond)
+    // One of five items pending is under the threshold
+    if stats := testMap.Stats(); stats.PendingDeletes != 1 || stats.Compactions != 0 || testMap.Size() != 5 {
+        t.Errorf("Expected 1 pending item and no compaction, Recieved %+v with size %d\n", stats, testMap.Size())
+    }
+    for i := 0; i < 4; i++ {
+        testMap.PutCustom(fmt.Sprint("B", i), i, Config{Timeout: time.Millisecond, AccessCount: 0})
+    }
+    time.Sleep(20 * time.Millisecond)
+    if stats := testMap.Stats(); stats.PendingDeletes != 0 || stats.Compactions != 1 || testMap.Size() != 4 {
+        t.Errorf("Expected a compaction removing the 5 pending items, Recieved %+v with size %d\n", stats, testMap.Size())
+    }
+}
+
+type persistedValue struct {
+    Name  string
+    Count int
+}
+
+func TestSaveLoad(t *testing.T) {
+    RegisterType(persistedValue{})
+    if types := RegisteredTypes(); !reflect.DeepEqual(types, []string{"ManagedMap.persistedValue"}) {
+        t.Errorf("Expected the registered types to be [ManagedMap.persistedValue], Recieved: %v\n", types)
+    }
+    source := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer source.Close()
+    source.Put("A", persistedValue{"A", 1})
+    source.PutCustom("B", 2, Config{Timeout: time.Hour, AccessCount: 3})
+    source.PutCustom("C", "short", Config{Timeout: 30 * time.Millisecond, AccessCount: 0})
+    var buf strings.Builder
+    if err := source.Save(&buf); err != nil {
+        t.Fatalf("Expected Save to succeed, Recieved: %v\n", err)
+    }
+    loaded := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer loaded.Close()
+    loaded.Put("A", "replaced")
+    if err := loaded.Load(strings.NewReader(buf.String())); err != nil {
+        t.Fatalf("Expected Load to succeed, Recieved: %v\n", err)
+    }
+    var tests = []struct {
+        key       interface{}
+        value     interface{}
+        remaining uint64
+    }{
+        {"A", persistedValue{"A", 1}, math.MaxUint64},
+        {"B", 2, 2},
+        {"C", "short", math.MaxUint64},
+    }
+    for num, test := range tests {
+        if value, remaining, has := loaded.GetAndRemaining(test.key); !has || value != test.value || remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v %d, Recieved: %v %d %v\n", num+1, test.key, test.value, test.remaining, value, remaining, has)
+        }
+    }
+    // C expires when it would have in the saved map
+    time.Sleep(40 * time.Millisecond)
+    if loaded.Has("C") {
+        t.Errorf("Expected loaded key C to keep its deadline\n")
+    }
+    if err := loaded.Load(strings.NewReader("not gob")); err != ErrInvalidSnapshot {
+        t.Errorf("Expected Load of invalid data to return ErrInvalidSnapshot, Recieved: %v\n", err)
+    }
+}
+
+func TestSnapshotCompression(t *testing.T) {
+    sizes := map[Compression]int{}
+    for _, compression := range []Compression{NoCompression, GzipCompression} {
+        source := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithSnapshotCompression(compression))
+        for i := 0; i < 100; i++ {
+            source.Put(i, strings.Repeat("value", 20))
+        }
+        var buf strings.Builder
+        if err := source.Save(&buf); err != nil {
+            t.Fatalf("Expected Save with compression %d to succeed, Recieved: %v\n", compression, err)
+        }
+        source.Close()
+        sizes[compression] = buf.Len()
+        // Load detects the compression without being told
+        loaded := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+        if err := loaded.Load(strings.NewReader(buf.String())); err != nil {
+            t.Fatalf("Expected Load with compression %d to succeed, Recieved: %v\n", compression, err)
+        }
+        if value, has := loaded.Get(42); !has || value != strings.Repeat("value", 20) || loaded.Size() != 100 {
+            t.Errorf("Expected all items to round trip with compression %d, Recieved %v %v and size %d\n", compression, value, has, loaded.Size())
+        }
+        loaded.Close()
+    }
+    if sizes[GzipCompression] >= sizes[NoCompression] {
+        t.Errorf("Expected the compressed snapshot to be smaller, Recieved sizes %v\n", sizes)
+    }
+}
+
+func TestValueEncryption(t *testing.T) {
+    RegisterType(persistedValue{})
+    key := []byte("0123456789abcdef")
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithValueEncryption(key))
+    defer testMap.Close()
+    value := persistedValue{"secret", 7}
+    testMap.Put("A", value)
+    if data, _ := testMap.m["A"].load().([]byte); bytes.Contains(data, []byte("secret")) {
+        t.Errorf("Expected the stored value to be encrypted, Recieved %q\n", data)
+    }
+    if got, has := testMap.Get("A"); !has || got != value {
+        t.Errorf("Expected Get to decrypt %v, Recieved: %v %v\n", value, got, has)
+    }
+    var buf bytes.Buffer
+    if err := testMap.Save(&buf); err != nil {
+        t.Fatalf("Expected Save to succeed, Recieved: %v\n", err)
+    }
+    if bytes.Contains(buf.Bytes(), []byte("secret")) {
+        t.Errorf("Expected the snapshot to hold only ciphertext\n")
+    }
+    var tests = []struct {
+        opts []Option
+        err  error
+    }{
+        {[]Option{WithValueEncryption(key)}, nil},
+        {[]Option{WithValueEncryption([]byte("fedcba9876543210"))}, ErrDecryption},
+        {[]Option{}, ErrDecryption},
+    }
+    for num, test := range tests {
+        loaded := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, test.opts...)
+        if err := loaded.Load(bytes.NewReader(buf.Bytes())); err != test.err {
+            t.Errorf("Test %d Failed: Expected Load Error: %v, Recieved: %v\n", num+1, test.err, err)
+        }
+        if got, has := loaded.Get("A"); (test.err == nil) != has || (has && got != value) {
+            t.Errorf("Test %d Failed: Expected loaded value %v, Recieved: %v %v\n", num+1, value, got, has)
+        }
+        loaded.Close()
+    }
+}
+
+func BenchmarkValueEncryption(b *testing.B) {
+    for _, encrypted := range []bool{false, true} {
+        name := "Plain"
+        opts := []Option{WithSerializer(gobMarshal, gobUnmarshal)}
+        if encrypted {
+            name = "Encrypted"
+            opts = []Option{WithValueEncryption([]byte("0123456789abcdef"))}
+        }
+        b.Run(name, func(b *testing.B) {
+            testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, opts...)
+            defer testMap.Close()
+            for i := 0; i < b.N; i++ {
+                testMap.Put("A", i)
+                testMap.Get("A")
+            }
+        })
+    }
+}
+
+func TestSnapshotKeys(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 0)
+    testMap.Put("B", 0)
+    testMap.PutCustom("C", 1, Config{Timeout: 0, AccessCount: 1})
+    // A writer that keeps A and B equal
+    stop := make(chan bool)
+    done := make(chan bool)
+    go func() {
+        defer close(done)
+        for i := 1; ; i++ {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            testMap.lock.Lock()
+            testMap.m["A"].store(i)
+            testMap.m["B"].store(i)
+            testMap.lock.Unlock()
+        }
+    }()
+    for i := 0; i < 1000; i++ {
+        values := testMap.SnapshotKeys("A", "B", "D")
+        if len(values) != 2 || values["A"] != values["B"] {
+            t.Errorf("Expected a consistent snapshot of A and B, Recieved: %v\n", values)
+            break
+        }
+    }
+    close(stop)
+    <-done
+    if values := testMap.SnapshotKeys("C"); values["C"] != 1 || !testMap.Has("C") {
+        t.Errorf("Expected SnapshotKeys to read C without consuming its access, Recieved: %v\n", values)
+    }
+}
+
+func TestGetPastDeadline(t *testing.T) {
+    // A coarse resolution keeps the expired item stored long after its deadline
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithTTLResolution(time.Hour))
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 50 * time.Microsecond, AccessCount: 0})
+    time.Sleep(100 * time.Microsecond)
+    if value, has := testMap.Get("A"); has {
+        t.Errorf("Expected Get past the deadline to miss, Recieved: %v\n", value)
+    }
+    if testMap.Has("A") {
+        t.Errorf("Expected Has past the deadline to be false\n")
+    }
+    if _, has := testMap.GetN("A", 1); has {
+        t.Errorf("Expected GetN past the deadline to miss\n")
+    }
+    // The miss schedules the removal of the item
+    time.Sleep(10 * time.Millisecond)
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected the expired item to be removed after the miss, Recieved size %d\n", size)
+    }
+}
+
+func TestOnExpire(t *testing.T) {
+    expired := make(chan [2]interface{}, 10)
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithOnExpire(func(key, value interface{}) {
+        expired <- [2]interface{}{key, value}
+    }))
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 1})
+    testMap.PutCustom("C", 3, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    // Neither running out of accesses nor Remove is an expiry
+    testMap.Get("B")
+    testMap.Remove("C")
+    time.Sleep(30 * time.Millisecond)
+    if len(expired) != 1 {
+        t.Fatalf("Expected a single expiry, Recieved %d\n", len(expired))
+    }
+    if got := <-expired; got != [2]interface{}{"A", 1} {
+        t.Errorf("Expected the expiry of A with 1, Recieved: %v\n", got)
+    }
+}
+
+func TestGetOrComputeMany(t *testing.T) {
+    var lock sync.Mutex
+    computed := []interface{}{}
+    release := make(chan struct{})
+    compute := func(missing []interface{}) map[interface{}]interface{} {
+        lock.Lock()
+        computed = append(computed, missing...)
+        lock.Unlock()
+        <-release
+        values := map[interface{}]interface{}{}
+        for _, key := range missing {
+            if key != "skip" {
+                values[key] = fmt.Sprint(key, "-computed")
+            }
+        }
+        return values
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", "A-stored")
+    results := make(chan map[interface{}]interface{}, 2)
+    go func() {
+        results <- testMap.GetOrComputeMany([]interface{}{"A", "B", "C"}, compute)
+    }()
+    time.Sleep(10 * time.Millisecond)
+    // B and C are already being computed so only D and skip are
+    go func() {
+        results <- testMap.GetOrComputeMany([]interface{}{"B", "C", "D", "skip"}, compute)
+    }()
+    time.Sleep(10 * time.Millisecond)
+    close(release)
+    expected := []map[interface{}]interface{}{
+        {"A": "A-stored", "B": "B-computed", "C": "C-computed"},
+        {"B": "B-computed", "C": "C-computed", "D": "D-computed"},
+    }
+    for i := 0; i < 2; i++ {
+        result := <-results
+        if !reflect.DeepEqual(result, expected[0]) && !reflect.DeepEqual(result, expected[1]) {
+            t.Errorf("Expected one of %v, Recieved: %v\n", expected, result)
+        }
+    }
+    if len(computed) != 4 {
+        t.Errorf("Expected each missing key to be computed once, Recieved: %v\n", computed)
+    }
+    if testMap.Size() != 4 || testMap.Has("skip") {
+        t.Errorf("Expected the computed values to be stored, Recieved size %d\n", testMap.Size())
+    }
+    called := false
+    testMap.GetOrComputeMany([]interface{}{"A", "B"}, func(missing []interface{}) map[interface{}]interface{} {
+        called = true
+        return nil
+    })
+    if called {
+        t.Errorf("Expected compute not to be called without missing keys\n")
+    }
+}
+
+func TestResetAccess(t *testing.T) {
+    var tests = []struct {
+        defaults  Config
+        remaining uint64
+    }{
+        {Config{Timeout: time.Hour, AccessCount: 3}, 2},
+        // An infinite default gives infinite accesses
+        {Config{Timeout: time.Hour, AccessCount: 0}, math.MaxUint64},
+    }
+    for num, test := range tests {
+        testMap := NewCustomManagedMap(test.defaults)
+        testMap.PutCustom("A", 1, Config{Timeout: 30 * time.Millisecond, AccessCount: 2})
+        testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 1})
+        testMap.Get("A")
+        testMap.Get("B")
+        time.Sleep(5 * time.Millisecond)
+        if !testMap.ResetAccess("A") {
+            t.Errorf("Test %d Failed: Expected ResetAccess of A to succeed\n", num+1)
+        }
+        if testMap.ResetAccess("B") || testMap.ResetAccess("C") {
+            t.Errorf("Test %d Failed: Expected ResetAccess of exhausted and absent keys to fail\n", num+1)
+        }
+        if _, remaining, _ := testMap.GetAndRemaining("A"); remaining != test.remaining {
+            t.Errorf("Test %d Failed: Expected %d accesses remaining, Recieved: %d\n", num+1, test.remaining, remaining)
+        }
+        // The timer is left untouched
+        time.Sleep(40 * time.Millisecond)
+        if testMap.Has("A") {
+            t.Errorf("Test %d Failed: Expected A to expire on its original timer\n", num+1)
+        }
+        testMap.Close()
+    }
+}
+
+func TestPeek(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 0, AccessCount: 1})
+    for i := 0; i < 3; i++ {
+        if value, has := testMap.Peek("A"); !has || value != 1 {
+            t.Errorf("Expected Peek %d to return 1, Recieved: %v %v\n", i+1, value, has)
+        }
+    }
+    if _, has := testMap.Peek("B"); has {
+        t.Errorf("Expected Peek of an absent key to miss\n")
+    }
+    // The single access is still there for Get
+    if value, has := testMap.Get("A"); !has || value != 1 {
+        t.Errorf("Expected Get after Peek to return 1, Recieved: %v %v\n", value, has)
+    }
+    if _, has := testMap.Peek("A"); has {
+        t.Errorf("Expected Peek of an exhausted key to miss\n")
+    }
+}
+
+func TestFeatures(t *testing.T) {
+    var tests = []struct {
+        opts     []Option
+        features FeatureSet
+    }{
+        {nil, FeatureSet{DefaultTimeout: time.Second, DefaultAccessCount: 2}},
+        {[]Option{WithCopyOnWrite(), WithTTLResolution(time.Minute), WithMaxConcurrentLoads(4), WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+            return nil, nil
+        })}, FeatureSet{DefaultTimeout: time.Second, DefaultAccessCount: 2, CopyOnWrite: true, TTLResolution: time.Minute, MaxConcurrentLoads: 4, Loader: true}},
+        {[]Option{WithValueEncryption([]byte("0123456789abcdef")), WithSnapshotCompression(GzipCompression)}, FeatureSet{DefaultTimeout: time.Second, DefaultAccessCount: 2, Serializer: true, Encryption: true, SnapshotCompression: GzipCompression}},
+        {[]Option{WithServeStaleOnError()}, FeatureSet{DefaultTimeout: time.Second, DefaultAccessCount: 2, ServeStaleOnError: true}},
+    }
+    for num, test := range tests {
+        testMap := NewCustomManagedMap(Config{Timeout: time.Second, AccessCount: 2}, test.opts...)
+        if features := testMap.Features(); features != test.features {
+            t.Errorf("Test %d Failed: Expected: %+v, Recieved: %+v\n", num+1, test.features, features)
+        }
+        testMap.Close()
+        // The configuration is still reported once the map is closed
+        if features := testMap.Features(); features != test.features {
+            t.Errorf("Test %d Failed after Close: Expected: %+v, Recieved: %+v\n", num+1, test.features, features)
+        }
+    }
+}
+
+func TestKeysValues(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    if keys, values := testMap.Keys(), testMap.Values(); keys == nil || len(keys) != 0 || values == nil || len(values) != 0 {
+        t.Errorf("Expected empty non-nil slices, Recieved: %#v %#v\n", keys, values)
+    }
+    testMap.Put("A", 1)
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 1})
+    testMap.Put("C", 3)
+    keys := testMap.Keys()
+    sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+    if !reflect.DeepEqual(keys, []interface{}{"A", "B", "C"}) {
+        t.Errorf("Expected keys [A B C], Recieved: %v\n", keys)
+    }
+    values := testMap.Values()
+    sort.Slice(values, func(i, j int) bool { return values[i].(int) < values[j].(int) })
+    if !reflect.DeepEqual(values, []interface{}{1, 2, 3}) {
+        t.Errorf("Expected values [1 2 3], Recieved: %v\n", values)
+    }
+    // Listing the keys and values is not an access
+    if value, has := testMap.Get("B"); !has || value != 2 {
+        t.Errorf("Expected Keys and Values not to consume the access of B, Recieved: %v %v\n", value, has)
+    }
+}
+
+func TestMaxLifetime(t *testing.T) {
+    vetoes := int64(0)
+    veto := func(key, value interface{}, reason EvictReason) bool {
+        atomic.AddInt64(&vetoes, 1)
+        return true
+    }
+    expired := make(chan interface{}, 10)
+    onExpire := func(key, value interface{}) {
+        expired <- key
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0}, WithMaxLifetime(50*time.Millisecond), WithEvictVeto(veto), WithOnExpire(onExpire))
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 0})
+    // Keep touching A well within its timeout
+    for i := 0; i < 5; i++ {
+        time.Sleep(8 * time.Millisecond)
+        testMap.TouchAll("A")
+    }
+    if !testMap.Has("A") || !testMap.Has("B") {
+        t.Errorf("Expected A and B to be present before their lifetime ends\n")
+    }
+    time.Sleep(30 * time.Millisecond)
+    if testMap.Has("A") || testMap.Has("B") {
+        t.Errorf("Expected A and B to be removed once their lifetime ended\n")
+    }
+    if len(expired) != 2 {
+        t.Errorf("Expected both items to expire, Recieved %d expiries\n", len(expired))
+    }
+    if atomic.LoadInt64(&vetoes) != 0 {
+        t.Errorf("Expected lifetime evictions not to be vetoable, Recieved %d veto calls\n", vetoes)
+    }
+}
+
+func TestSample(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    for i := 0; i < 100; i++ {
+        testMap.Put(i, i)
+    }
+    var tests = []struct {
+        n       int
+        sampled int
+    }{
+        {10, 10},
+        {0, 0},
+        {1000, 100},
+    }
+    for num, test := range tests {
+        seen := map[interface{}]bool{}
+        testMap.Sample(test.n, func(key, value interface{}) {
+            if key != value {
+                t.Errorf("Test %d Failed: Expected key %v to hold %v, Recieved: %v\n", num+1, key, key, value)
+            }
+            seen[key] = true
+        })
+        if len(seen) != test.sampled {
+            t.Errorf("Test %d Failed: Expected %d distinct items, Recieved: %d\n", num+1, test.sampled, len(seen))
+        }
+    }
+    // Sampling is not an access
+    if testMap.LiveSize() != 100 {
+        t.Errorf("Expected Sample not to consume accesses, Recieved %d live items\n", testMap.LiveSize())
+    }
+}
+
+func TestRange(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    for i := 0; i < 10; i++ {
+        testMap.Put(i, i*10)
+    }
+    visited := map[interface{}]interface{}{}
+    testMap.Range(func(key, value interface{}) bool {
+        visited[key] = value
+        // Calling back into the map does not deadlock
+        testMap.Remove(key)
+        return true
+    })
+    if len(visited) != 10 || visited[3] != 30 || testMap.Size() != 0 {
+        t.Errorf("Expected every item to be visited and removed, Recieved: %v with size %d\n", visited, testMap.Size())
+    }
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    count := 0
+    testMap.Range(func(key, value interface{}) bool {
+        count++
+        return false
+    })
+    if count != 1 {
+        t.Errorf("Expected Range to stop after fn returns false, Recieved %d calls\n", count)
+    }
+    // Ranging is not an access
+    if !testMap.Has("A") || !testMap.Has("B") {
+        t.Errorf("Expected Range not to consume accesses\n")
+    }
+}
+
+func TestServeStaleOnError(t *testing.T) {
+    failing := int32(0)
+    loader := func(ctx context.Context, key interface{}) (interface{}, error) {
+        if atomic.LoadInt32(&failing) == 1 {
+            return nil, errors.New("backend down")
+        }
+        return fmt.Sprint(key, "-loaded"), nil
+    }
+    var tests = []struct {
+        opts  []Option
+        value interface{}
+        has   bool
+    }{
+        // A failed load is a miss by default
+        {nil, nil, false},
+        {[]Option{WithServeStaleOnError()}, "A-loaded", true},
+    }
+    for num, test := range tests {
+        atomic.StoreInt32(&failing, 0)
+        testMap := NewCustomManagedMap(Config{Timeout: 10 * time.Millisecond, AccessCount: 0}, append(test.opts, WithLoader(loader))...)
+        // Get loads missing keys through the Loader
+        if value, has := testMap.Get("A"); !has || value != "A-loaded" {
+            t.Errorf("Test %d Failed: Expected Get to load A, Recieved: %v %v\n", num+1, value, has)
+        }
+        time.Sleep(20 * time.Millisecond)
+        atomic.StoreInt32(&failing, 1)
+        if value, has := testMap.Get("A"); has != test.has || value != test.value {
+            t.Errorf("Test %d Failed: Expected: %v %v, Recieved: %v %v\n", num+1, test.value, test.has, value, has)
+        }
+        if _, err := testMap.GetLoad(context.Background(), "A"); err == nil {
+            t.Errorf("Test %d Failed: Expected GetLoad to return the load error\n", num+1)
+        }
+        // Remove forgets the stale value
+        testMap.Remove("A")
+        if _, has := testMap.Get("A"); has {
+            t.Errorf("Test %d Failed: Expected no stale value after Remove\n", num+1)
+        }
+        testMap.Close()
+    }
+}
+
+func TestTypedManagedMap(t *testing.T) {
+    testMap := NewCustomTypedManagedMap[string, int](Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.PutCustom("B", 2, Config{Timeout: 0, AccessCount: 1})
+    var tests = []struct {
+        key   string
+        value int
+        has   bool
+    }{
+        {"A", 1, true},
+        {"B", 2, true},
+        // B has used its only access
+        {"B", 0, false},
+        {"C", 0, false},
+    }
+    for num, test := range tests {
+        if value, has := testMap.Get(test.key); value != test.value || has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %d %v, Recieved: %d %v\n", num+1, test.key, test.value, test.has, value, has)
+        }
+    }
+    testMap.Remove("A")
+    time.Sleep(time.Millisecond)
+    if testMap.Has("A") || testMap.Size() != 0 {
+        t.Errorf("Expected Remove to empty the map, Recieved size %d\n", testMap.Size())
+    }
+    errs := NewTypedManagedMap[int, error]()
+    defer errs.Close()
+    errs.Put(1, nil)
+    if value, has := errs.Get(1); value != nil || !has {
+        t.Errorf("Expected a stored nil error to be returned, Recieved: %v %v\n", value, has)
+    }
+    // Values of another type, here from a Loader, are missing rather than a zero V
+    loaded := NewTypedManagedMap[string, int](WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+        if key == "nil" {
+            return nil, nil
+        }
+        return "not an int", nil
+    }))
+    defer loaded.Close()
+    for _, key := range []string{"A", "nil"} {
+        if value, has := loaded.Get(key); value != 0 || has {
+            t.Errorf("Expected a value of the wrong type to be missing, Recieved: %v %v\n", value, has)
+        }
+    }
+}
+
+func TestTryGetPut(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    if err := testMap.TryPut("A", 1); err != nil {
+        t.Errorf("Expected TryPut on an open map to succeed, Recieved: %v\n", err)
+    }
+    if value, has, err := testMap.TryGet("A"); value != 1 || !has || err != nil {
+        t.Errorf("Expected TryGet to return 1 true <nil>, Recieved: %v %v %v\n", value, has, err)
+    }
+    testMap.Close()
+    if err := testMap.TryPut("A", 2); err != ErrClosed {
+        t.Errorf("Expected TryPut on a closed map to return ErrClosed, Recieved: %v\n", err)
+    }
+    if value, has, err := testMap.TryGet("A"); value != nil || has || err != ErrClosed {
+        t.Errorf("Expected TryGet on a closed map to return <nil> false ErrClosed, Recieved: %v %v %v\n", value, has, err)
+    }
+    graceMap := NewManagedMap(WithCloseGrace(time.Hour))
+    graceMap.Close()
+    if err := graceMap.TryPut("A", 1); err != ErrClosed {
+        t.Errorf("Expected TryPut during the close grace period to return ErrClosed, Recieved: %v\n", err)
+    }
+}
+
+func TestMaxGoroutines(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0}, WithPerItemTimers(), WithMaxGoroutines(2))
+    defer testMap.Close()
+    for i := 0; i < 4; i++ {
+        testMap.Put(i, i)
+    }
+    if health := testMap.Health(); health.Goroutines != 2 || health.DegradedItems != 2 || !health.Degraded {
+        t.Errorf("Expected 2 goroutines and 2 degraded items, Recieved: %+v\n", health)
+    }
+    for i := 0; i < 4; i++ {
+        if value, has := testMap.Get(i); value != i || !has {
+            t.Errorf("Test %d Failed: Expected: %d true, Recieved: %v %v\n", i+1, i, value, has)
+        }
+    }
+    time.Sleep(60 * time.Millisecond)
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected every item to expire, Recieved size %d\n", size)
+    }
+    if health := testMap.Health(); health.Goroutines != 0 || health.Degraded {
+        t.Errorf("Expected the map to recover once the items expired, Recieved: %+v\n", health)
+    }
+}
+
+func TestIsClosed(t *testing.T) {
+    testMap := NewManagedMap()
+    if testMap.IsClosed() {
+        t.Errorf("Expected a new map to be open\n")
+    }
+    done := make(chan bool)
+    go func() {
+        for !testMap.IsClosed() {
+        }
+        done <- true
+    }()
+    testMap.Close()
+    <-done
+    if !testMap.IsClosed() {
+        t.Errorf("Expected the map to be closed after Close\n")
+    }
+}
+
+func TestManualExpiry(t *testing.T) {
+    before := runtime.NumGoroutine()
+    testMap := NewCustomManagedMap(Config{Timeout: 5 * time.Millisecond, AccessCount: 0}, WithManualExpiry())
+    defer testMap.Close()
+    for i := 0; i < 10; i++ {
+        testMap.Put(i, i)
+    }
+    testMap.PutCustom("once", 1, Config{Timeout: 0, AccessCount: 1})
+    testMap.PutCustom("forever", 1, Config{Timeout: 0, AccessCount: 0})
+    if after := runtime.NumGoroutine(); after > before {
+        t.Errorf("Expected no goroutines to be started, Recieved %d more\n", after-before)
+    }
+    testMap.Get("once")
+    time.Sleep(10 * time.Millisecond)
+    var tests = []struct {
+        key interface{}
+        has bool
+    }{
+        {0, false},
+        {9, false},
+        {"once", false},
+        {"forever", true},
+    }
+    for num, test := range tests {
+        if _, has := testMap.Get(test.key); has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.has, has)
+        }
+    }
+    if size := testMap.Size(); size != 12 {
+        t.Errorf("Expected items to stay stored until EvictExpired, Recieved size %d\n", size)
+    }
+    if evicted := testMap.EvictExpired(); evicted != 11 {
+        t.Errorf("Expected EvictExpired to remove 11 items, Recieved %d\n", evicted)
+    }
+    if size := testMap.Size(); size != 1 {
+        t.Errorf("Expected 1 item after EvictExpired, Recieved size %d\n", size)
+    }
+}
+
+func TestCloseTwice(t *testing.T) {
+    testMap := NewManagedMap()
+    testMap.Put("A", 1)
+    testMap.Close()
+    defer func() {
+        if r := recover(); r != nil {
+            t.Errorf("Expected a second Close to do nothing, Recieved panic: %v\n", r)
+        }
+    }()
+    testMap.Close()
+    testMap.CloseOrdered(nil)
+}
+
+// waitGoroutines waits up to a second for the per-item goroutines of m to exit until want
+// are left, as they exit asynchronously once their items are released, and returns how
+// many are left.
+func waitGoroutines(m *managedMap, want int64) int64 {
+    deadline := time.Now().Add(time.Second)
+    for m.Stats().ActiveGoroutines != want && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    return m.Stats().ActiveGoroutines
+}
+
+func TestClear(t *testing.T) {
+    for _, opts := range [][]Option{nil, {WithCopyOnWrite()}, {WithTTLResolution(time.Millisecond)}} {
+        testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, opts...)
+        for i := 0; i < 10; i++ {
+            testMap.Put(i, i)
+        }
+        testMap.Clear()
+        if size := testMap.Size(); size != 0 {
+            t.Errorf("Expected Clear to empty the map, Recieved size %d\n", size)
+        }
+        if goroutines := waitGoroutines(testMap, 0); goroutines != 0 {
+            t.Errorf("Expected Clear to stop every goroutine, Recieved %d\n", goroutines)
+        }
+        if _, has := testMap.Get(1); has {
+            t.Errorf("Expected a cleared key to be absent\n")
+        }
+        testMap.Put(1, "B")
+        if value, has := testMap.Get(1); value != "B" || !has {
+            t.Errorf("Expected Put after Clear to work, Recieved: %v %v\n", value, has)
+        }
+        testMap.Close()
+    }
+    multi := NewCustomManagedMultiMap(Config{Timeout: 0, AccessCount: 0})
+    defer multi.Close()
+    multi.Add("A", 1)
+    multi.Add("A", 2)
+    multi.m.Clear()
+    if values := multi.Get("A"); len(values) != 0 {
+        t.Errorf("Expected Clear to remove every multimap value, Recieved %v\n", values)
+    }
+}
+
+func TestClearConcurrentReaders(t *testing.T) {
+    const size = 100
+    for _, opts := range [][]Option{nil, {WithCopyOnWrite()}} {
+        testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, opts...)
+        for round := 0; round < 20; round++ {
+            for i := 0; i < size; i++ {
+                testMap.Put(i, i)
+            }
+            stop := make(chan struct{})
+            var wg sync.WaitGroup
+            for r := 0; r < 4; r++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    for {
+                        select {
+                        case <-stop:
+                            return
+                        default:
+                        }
+                        if n := testMap.Size(); n != 0 && n != size {
+                            t.Errorf("Expected Size to see %d or 0 items during Clear, Recieved %d\n", size, n)
+                        }
+                        if n := len(testMap.Keys()); n != 0 && n != size {
+                            t.Errorf("Expected Keys to see %d or 0 keys during Clear, Recieved %d\n", size, n)
+                        }
+                    }
+                }()
+            }
+            testMap.Clear()
+            close(stop)
+            wg.Wait()
+            if n := testMap.Size(); n != 0 {
+                t.Errorf("Expected Clear to empty the map, Recieved size %d\n", n)
+            }
+        }
+        testMap.Close()
+    }
+}
+
+func TestGetCtx(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 2})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    metered := WithCountAccess(context.Background(), true)
+    unmetered := WithCountAccess(context.Background(), false)
+    var tests = []struct {
+        ctx context.Context
+        has bool
+    }{
+        {context.Background(), true},
+        {unmetered, true},
+        {metered, true},
+        {unmetered, true},
+        {metered, true},
+        // Both metered accesses have been used
+        {unmetered, false},
+        {metered, false},
+    }
+    for num, test := range tests {
+        if value, has := testMap.GetCtx(test.ctx, "A"); has != test.has || (has && value != 1) {
+            t.Errorf("Test %d Failed: Expected: %v, Recieved: %v %v\n", num+1, test.has, value, has)
+        }
+    }
+}
+
+func TestContains(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    var tests = []struct {
+        get      bool
+        contains bool
+    }{
+        {false, true},
+        // Contains does not consume the only access
+        {false, true},
+        {true, false},
+        {false, false},
+    }
+    for num, test := range tests {
+        if test.get {
+            testMap.Get("A")
+        }
+        if contains := testMap.Contains("A"); contains != test.contains {
+            t.Errorf("Test %d Failed: Expected: %v, Recieved: %v\n", num+1, test.contains, contains)
+        }
+    }
+}
+
+func TestSwapOut(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0})
+    defer testMap.Close()
+    for i := 0; i < 5; i++ {
+        testMap.Put(i, i*10)
+    }
+    testMap.PutCustom("used", 1, Config{Timeout: 0, AccessCount: 1})
+    testMap.Get("used")
+    out := testMap.SwapOut()
+    if len(out) != 5 {
+        t.Errorf("Expected 5 swapped out values, Recieved %v\n", out)
+    }
+    for i := 0; i < 5; i++ {
+        if value := out[i]; value != i*10 {
+            t.Errorf("Test %d Failed: Expected: %d, Recieved: %v\n", i+1, i*10, value)
+        }
+    }
+    if size, goroutines := testMap.Size(), waitGoroutines(testMap, 0); size != 0 || goroutines != 0 {
+        t.Errorf("Expected an empty map without goroutines, Recieved size %d and %d goroutines\n", size, goroutines)
+    }
+    testMap.Put("A", 1)
+    if out := testMap.SwapOut(); len(out) != 1 || out["A"] != 1 {
+        t.Errorf("Expected the map to keep working after SwapOut, Recieved %v\n", out)
+    }
+}
+
+func TestGetOrPut(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    var wg sync.WaitGroup
+    var lock sync.Mutex
+    inserted := 0
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            actual, loaded := testMap.GetOrPut("A", i, Config{Timeout: 0, AccessCount: 0})
+            if !loaded {
+                lock.Lock()
+                inserted++
+                lock.Unlock()
+            } else if _, ok := actual.(int); !ok {
+                t.Errorf("Expected a loaded int, Recieved %v\n", actual)
+            }
+        }(i)
+    }
+    wg.Wait()
+    if inserted != 1 {
+        t.Errorf("Expected exactly one insert, Recieved %d\n", inserted)
+    }
+    var tests = []struct {
+        key    interface{}
+        value  interface{}
+        actual interface{}
+        loaded bool
+    }{
+        {"B", 1, 1, false},
+        // B has 2 accesses, the first was used by the loaded GetOrPut
+        {"B", 2, 1, true},
+        {"B", 3, 1, true},
+        // B is used up so it is replaced
+        {"B", 4, 4, false},
+    }
+    for num, test := range tests {
+        actual, loaded := testMap.GetOrPut(test.key, test.value, Config{Timeout: 0, AccessCount: 2})
+        if actual != test.actual || loaded != test.loaded {
+            t.Errorf("Test %d Failed: Expected: %v %v, Recieved: %v %v\n", num+1, test.actual, test.loaded, actual, loaded)
+        }
+    }
+}
+
+func TestOnExpireBeforeReinsert(t *testing.T) {
+    entered := make(chan struct{})
+    release := make(chan struct{})
+    var seen interface{}
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithOnExpire(func(key, value interface{}) {
+        seen = value
+        close(entered)
+        <-release
+    }))
+    defer testMap.Close()
+    testMap.PutCustom("A", "old", Config{Timeout: 5 * time.Millisecond, AccessCount: 0})
+    <-entered
+    inserted := make(chan struct{})
+    go func() {
+        testMap.Put("A", "new")
+        close(inserted)
+    }()
+    select {
+    case <-inserted:
+        t.Errorf("Expected Put to wait for onExpire to return\n")
+    case <-time.After(10 * time.Millisecond):
+    }
+    close(release)
+    <-inserted
+    if seen != "old" {
+        t.Errorf("Expected onExpire to see the expired value, Recieved %v\n", seen)
+    }
+    if value, has := testMap.Get("A"); value != "new" || !has {
+        t.Errorf("Expected the re-inserted value, Recieved: %v %v\n", value, has)
+    }
+}
+
+func TestPeekFresh(t *testing.T) {
+    // Manual expiry keeps the expired item stored until something removes it
+    testMap := NewCustomManagedMap(Config{Timeout: 5 * time.Millisecond, AccessCount: 1}, WithManualExpiry())
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    for i := 0; i < 3; i++ {
+        if value, has := testMap.PeekFresh("A"); value != 1 || !has {
+            t.Errorf("Test %d Failed: Expected PeekFresh not to consume the access, Recieved: %v %v\n", i+1, value, has)
+        }
+    }
+    time.Sleep(10 * time.Millisecond)
+    if value, has := testMap.PeekFresh("A"); value != nil || has {
+        t.Errorf("Expected an expired item to be absent, Recieved: %v %v\n", value, has)
+    }
+    normal := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithTTLResolution(time.Hour))
+    defer normal.Close()
+    normal.PutCustom("A", 1, Config{Timeout: 5 * time.Millisecond, AccessCount: 0})
+    time.Sleep(10 * time.Millisecond)
+    // The bucket's timer is an hour away, so only PeekFresh removes the item
+    normal.PeekFresh("A")
+    time.Sleep(time.Millisecond)
+    if size := normal.Size(); size != 0 {
+        t.Errorf("Expected PeekFresh to delete the expired item, Recieved size %d\n", size)
+    }
+}
+
+func TestGetOrCompute(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    var calls int64
+    fn := func() (interface{}, Config) {
+        atomic.AddInt64(&calls, 1)
+        return "computed", Config{Timeout: 0, AccessCount: 0}
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if actual, _ := testMap.GetOrCompute("A", fn); actual != "computed" {
+                t.Errorf("Expected the computed value, Recieved %v\n", actual)
+            }
+        }()
+    }
+    wg.Wait()
+    if calls != 1 {
+        t.Errorf("Expected fn to be called once, Recieved %d\n", calls)
+    }
+    once := func() (interface{}, Config) {
+        return 1, Config{Timeout: 0, AccessCount: 1}
+    }
+    var tests = []struct {
+        actual interface{}
+        loaded bool
+    }{
+        {1, false},
+        {1, true},
+        // The only access has been used so the value is computed again
+        {1, false},
+    }
+    for num, test := range tests {
+        if actual, loaded := testMap.GetOrCompute("B", once); actual != test.actual || loaded != test.loaded {
+            t.Errorf("Test %d Failed: Expected: %v %v, Recieved: %v %v\n", num+1, test.actual, test.loaded, actual, loaded)
+        }
+    }
+}
+
+func TestTouch(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 30 * time.Millisecond, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    for i := 0; i < 4; i++ {
+        time.Sleep(15 * time.Millisecond)
+        if !testMap.Touch("A") {
+            t.Errorf("Test %d Failed: Expected Touch to find A\n", i+1)
+        }
+    }
+    if testMap.Touch("B") || testMap.Touch("C") {
+        t.Errorf("Expected Touch to report expired and missing keys as absent\n")
+    }
+    // Touch did not consume the only access
+    if value, has := testMap.Get("A"); value != 1 || !has {
+        t.Errorf("Expected the touched item to be readable, Recieved: %v %v\n", value, has)
+    }
+    if testMap.Touch("A") {
+        t.Errorf("Expected Touch to skip an item without accesses\n")
+    }
+}
+
+func TestEvictWhere(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    for i := 0; i < 10; i++ {
+        testMap.Put(i, i%3)
+    }
+    read := false
+    evicted := testMap.EvictWhere(func(key, value interface{}) bool {
+        // Reading the map from another goroutine while matching is allowed
+        if !read {
+            read = true
+            done := make(chan struct{})
+            go func() {
+                testMap.Get(0)
+                close(done)
+            }()
+            <-done
+        }
+        return value == 0
+    })
+    if evicted != 4 {
+        t.Errorf("Expected 4 items to be evicted, Recieved %d\n", evicted)
+    }
+    for i := 0; i < 10; i++ {
+        if has := testMap.Has(i); has != (i%3 != 0) {
+            t.Errorf("Test %d Failed: Key %d - Expected: %v, Recieved: %v\n", i+1, i, i%3 != 0, has)
+        }
+    }
+    if evicted := testMap.EvictWhere(func(key, value interface{}) bool { return false }); evicted != 0 {
+        t.Errorf("Expected nothing to be evicted, Recieved %d\n", evicted)
+    }
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0}, WithAdaptiveTTL(20*time.Millisecond, 200*time.Millisecond, 2))
+    defer testMap.Close()
+    timeout := func(key interface{}) time.Duration {
+        remaining := time.Duration(-1)
+        testMap.ForEachByDeadline(func(k, value interface{}, left time.Duration) bool {
+            if k == key {
+                remaining = left
+            }
+            return true
+        })
+        return remaining
+    }
+    testMap.Put("hot", 1)
+    testMap.Put("cold", 2)
+    // Reads in quick succession grow the timeout up to the maximum
+    for i := 0; i < 5; i++ {
+        time.Sleep(2 * time.Millisecond)
+        if _, has := testMap.Get("hot"); !has {
+            t.Fatalf("Test %d Failed: Expected hot to be readable\n", i+1)
+        }
+    }
+    time.Sleep(5 * time.Millisecond)
+    if left := timeout("hot"); left <= 150*time.Millisecond {
+        t.Errorf("Expected the timeout of hot to grow towards 200ms, Recieved %v left\n", left)
+    }
+    time.Sleep(30 * time.Millisecond)
+    if testMap.Has("cold") {
+        t.Errorf("Expected cold to expire after its starting timeout\n")
+    }
+    // A read after a long gap shrinks the timeout
+    time.Sleep(90 * time.Millisecond)
+    if _, has := testMap.Get("hot"); !has {
+        t.Fatalf("Expected hot to be readable after the gap\n")
+    }
+    time.Sleep(5 * time.Millisecond)
+    if left := timeout("hot"); left > 100*time.Millisecond || left <= 0 {
+        t.Errorf("Expected the timeout of hot to shrink to 100ms, Recieved %v left\n", left)
+    }
+}
+
+func TestSlideOnAccess(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 30 * time.Millisecond, AccessCount: 0, SlideOnAccess: true})
+    defer testMap.Close()
+    testMap.Put("read", 1)
+    testMap.Put("idle", 2)
+    testMap.PutCustom("absolute", 3, Config{Timeout: 30 * time.Millisecond, AccessCount: 0})
+    for i := 0; i < 5; i++ {
+        time.Sleep(15 * time.Millisecond)
+        if _, has := testMap.Get("read"); !has {
+            t.Errorf("Test %d Failed: Expected a key that is read to stay alive\n", i+1)
+        }
+        testMap.Get("absolute")
+    }
+    var tests = []struct {
+        key interface{}
+        has bool
+    }{
+        {"read", true},
+        {"idle", false},
+        {"absolute", false},
+    }
+    for num, test := range tests {
+        if has := testMap.Has(test.key); has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.has, has)
+        }
+    }
+}
+
+func TestWithLock(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    var kept UnsafeMap
+    // Swap A and B atomically
+    testMap.WithLock(func(u UnsafeMap) {
+        kept = u
+        a, _ := u.GetRaw("A")
+        b, _ := u.GetRaw("B")
+        u.PutRaw("A", b, Config{Timeout: 0, AccessCount: 1})
+        u.PutRaw("B", a, Config{Timeout: 0, AccessCount: 1})
+        u.DeleteRaw("C")
+        u.PutRaw("C", 3, Config{Timeout: 0, AccessCount: 1})
+        u.DeleteRaw("C")
+    })
+    var tests = []struct {
+        key   interface{}
+        value interface{}
+        has   bool
+    }{
+        {"A", 2, true},
+        {"B", 1, true},
+        {"C", nil, false},
+    }
+    for num, test := range tests {
+        if value, has := testMap.Get(test.key); value != test.value || has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v %v, Recieved: %v %v\n", num+1, test.key, test.value, test.has, value, has)
+        }
+    }
+    defer func() {
+        if r := recover(); r == nil {
+            t.Errorf("Expected an UnsafeMap used after WithLock returned to panic\n")
+        }
+    }()
+    kept.GetRaw("A")
+}
+
+func TestOnEvict(t *testing.T) {
+    var lock sync.Mutex
+    reasons := map[interface{}]EvictReason{}
+    var testMap *managedMap
+    testMap = NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithOnEvict(func(key, value interface{}, reason EvictReason) {
+        // The callback runs outside the lock so it can use the map
+        if reason != EvictClosed {
+            testMap.Has(key)
+        }
+        lock.Lock()
+        defer lock.Unlock()
+        reasons[key] = reason
+    }))
+    testMap.PutCustom("expired", 1, Config{Timeout: 5 * time.Millisecond, AccessCount: 0})
+    testMap.PutCustom("exhausted", 2, Config{Timeout: 0, AccessCount: 1})
+    testMap.Put("removed", 3)
+    testMap.Put("closed", 4)
+    testMap.Put("updated", 5)
+    testMap.Put("updated", 6)
+    testMap.Put("silent", 7)
+    testMap.Get("exhausted")
+    testMap.Remove("removed")
+    if !testMap.RemoveSilent("silent") || testMap.RemoveSilent("silent") || testMap.Has("silent") {
+        t.Errorf("Expected RemoveSilent to remove the key once\n")
+    }
+    time.Sleep(20 * time.Millisecond)
+    if removals := testMap.Stats().Removals; removals != 2 {
+        t.Errorf("Expected RemoveSilent to count as a removal, Recieved %d removals\n", removals)
+    }
+    testMap.Close()
+    var tests = []struct {
+        key    interface{}
+        reason EvictReason
+    }{
+        {"expired", EvictExpired},
+        {"exhausted", EvictAccessExhausted},
+        {"removed", EvictRemoved},
+        {"closed", EvictClosed},
+        {"updated", EvictClosed},
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    for num, test := range tests {
+        if reason, has := reasons[test.key]; reason != test.reason || !has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v %v\n", num+1, test.key, test.reason, reason, has)
+        }
+    }
+    if reason, has := reasons["silent"]; has {
+        t.Errorf("Expected RemoveSilent not to report an eviction, Recieved %v\n", reason)
+    }
+}
+
+func TestOnEvictLocked(t *testing.T) {
+    var testMap *managedMap
+    evicted := 0
+    testMap = NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithOnEvictLocked(func(key, value interface{}, reason EvictReason) {
+        // The write lock is held, so the item being evicted is still the one stored
+        if it, has := testMap.m[key]; !has || it.load() != value {
+            t.Errorf("Expected %v to still hold its evicted value %v\n", key, value)
+        }
+        evicted++
+    }))
+    // One goroutine keeps re-inserting the key while another keeps removing it
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            testMap.Set("A", i, Config{Timeout: 0, AccessCount: 0})
+        }
+    }()
+    removed := 0
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            if testMap.Has("A") {
+                testMap.Remove("A")
+                removed++
+            }
+        }
+    }()
+    wg.Wait()
+    if testMap.Has("A") {
+        testMap.Remove("A")
+        removed++
+    }
+    if evicted != removed {
+        t.Errorf("Expected %d evictions, Recieved %d\n", removed, evicted)
+    }
+    testMap.Put("closed", 1)
+    testMap.Close()
+    if evicted != removed + 1 {
+        t.Errorf("Expected Close to report an eviction, Recieved %d\n", evicted - removed)
+    }
+}
+
+func TestBatchTick(t *testing.T) {
+    scheduler := NewScheduler(WithBatchTick(10 * time.Millisecond))
+    scheduler.Start()
+    defer scheduler.Stop()
+    first := NewCustomManagedMap(Config{Timeout: 5 * time.Millisecond, AccessCount: 0}, WithSharedScheduler(scheduler))
+    defer first.Close()
+    second := NewCustomManagedMap(Config{Timeout: 5 * time.Millisecond, AccessCount: 0}, WithSharedScheduler(scheduler))
+    defer second.Close()
+    for i := 0; i < 100; i++ {
+        first.Put(i, i)
+        second.Put(i, i)
+    }
+    second.PutCustom("kept", 1, Config{Timeout: time.Hour, AccessCount: 0})
+    time.Sleep(40 * time.Millisecond)
+    if first.Size() != 0 || second.Size() != 1 {
+        t.Errorf("Expected every due item to be deleted, Recieved sizes %d and %d\n", first.Size(), second.Size())
+    }
+}
+
+func TestBatchTickWake(t *testing.T) {
+    scheduler := NewScheduler(WithBatchTick(200 * time.Millisecond))
+    scheduler.Start()
+    defer scheduler.Stop()
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithSharedScheduler(scheduler))
+    defer testMap.Close()
+    // Let the Scheduler dispatch its first, empty batch, which starts the tick
+    time.Sleep(10 * time.Millisecond)
+    testMap.PutCustom("A", 1, Config{Timeout: 100 * time.Millisecond, AccessCount: 0})
+    time.Sleep(50 * time.Millisecond)
+    // A new earliest deadline neither cuts the tick short nor starts it over
+    testMap.PutCustom("B", 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    time.Sleep(90 * time.Millisecond)
+    if size := testMap.Size(); size != 2 {
+        t.Errorf("Expected the due items to wait for the end of the tick, Recieved size %d\n", size)
+    }
+    time.Sleep(80 * time.Millisecond)
+    if size := testMap.Size(); size != 0 {
+        t.Errorf("Expected the due items to be deleted at the end of the tick, Recieved size %d\n", size)
+    }
+}
+
+// benchmarkMassExpiry measures how long it takes a Scheduler to delete 10000 items of a
+// map that all expire at the same time while readers contend for the lock.
+func benchmarkMassExpiry(b *testing.B, opts ...SchedulerOption) {
+    for n := 0; n < b.N; n++ {
+        b.StopTimer()
+        scheduler := NewScheduler(opts...)
+        testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithSharedScheduler(scheduler))
+        for i := 0; i < 10000; i++ {
+            testMap.PutCustom(i, i, Config{Timeout: time.Millisecond, AccessCount: 0})
+        }
+        testMap.Put("reader", 1)
+        time.Sleep(time.Millisecond)
+        stop := make(chan struct{})
+        var wg sync.WaitGroup
+        for r := 0; r < 4; r++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for {
+                    select {
+                    case <-stop:
+                        return
+                    default:
+                        testMap.Get("reader")
+                    }
+                }
+            }()
+        }
+        b.StartTimer()
+        scheduler.Start()
+        for testMap.Size() != 1 {
+            runtime.Gosched()
+        }
+        b.StopTimer()
+        close(stop)
+        wg.Wait()
+        scheduler.Stop()
+        testMap.Close()
+    }
+}
+
+func BenchmarkMassExpiry(b *testing.B) {
+    b.Run("PerItem", func(b *testing.B) {
+        benchmarkMassExpiry(b)
+    })
+    b.Run("Batched", func(b *testing.B) {
+        benchmarkMassExpiry(b, WithBatchTick(time.Millisecond))
+    })
+}
+
+func TestTimeToLive(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: time.Hour, AccessCount: 1})
+    testMap.Put("B", 2)
+    var tests = []struct {
+        key interface{}
+        min time.Duration
+        max time.Duration
+        has bool
+    }{
+        {"A", 59 * time.Minute, time.Hour, true},
+        // TimeToLive does not consume A's only access
+        {"A", 59 * time.Minute, time.Hour, true},
+        {"B", math.MaxInt64, math.MaxInt64, true},
+        {"C", 0, 0, false},
+    }
+    for num, test := range tests {
+        if ttl, has := testMap.TimeToLive(test.key); ttl < test.min || ttl > test.max || has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v-%v %v, Recieved: %v %v\n", num+1, test.key, test.min, test.max, test.has, ttl, has)
+        }
+    }
+}
+
+func TestAccessesRemaining(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 0, AccessCount: 2})
+    testMap.Put("B", 2)
+    var tests = []struct {
+        get       bool
+        key       interface{}
+        remaining uint64
+        has       bool
+    }{
+        {false, "A", 2, true},
+        {false, "A", 2, true},
+        {true, "A", 1, true},
+        {true, "A", 0, false},
+        {true, "B", math.MaxUint64, true},
+        {false, "C", 0, false},
+    }
+    for num, test := range tests {
+        if test.get {
+            testMap.Get(test.key)
+        }
+        if remaining, has := testMap.AccessesRemaining(test.key); remaining != test.remaining || has != test.has {
+            t.Errorf("Test %d Failed: Key %v - Expected: %d %v, Recieved: %d %v\n", num+1, test.key, test.remaining, test.has, remaining, has)
+        }
+    }
+}
+
+func TestExtend(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 20 * time.Millisecond, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.PutCustom("forever", 3, Config{Timeout: 0, AccessCount: 0})
+    if !testMap.Extend("A", 30*time.Millisecond) || !testMap.Extend("forever", time.Hour) || testMap.Extend("C", time.Hour) {
+        t.Errorf("Expected Extend to report whether each key exists\n")
+    }
+    if ttl, _ := testMap.TimeToLive("A"); ttl <= 40*time.Millisecond || ttl > 50*time.Millisecond {
+        t.Errorf("Expected A to have about 50ms left, Recieved %v\n", ttl)
+    }
+    if ttl, _ := testMap.TimeToLive("forever"); ttl != math.MaxInt64 {
+        t.Errorf("Expected an infinite item to stay infinite, Recieved %v\n", ttl)
+    }
+    time.Sleep(30 * time.Millisecond)
+    if !testMap.Has("A") || testMap.Has("B") {
+        t.Errorf("Expected only the extended item to outlive its timeout\n")
+    }
+    time.Sleep(30 * time.Millisecond)
+    if testMap.Has("A") {
+        t.Errorf("Expected the extended item to expire after its extension\n")
+    }
+}
+
+func TestSetAccessCount(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.Get("B")
+    var tests = []struct {
+        key       interface{}
+        count     uint64
+        set       bool
+        remaining uint64
+    }{
+        {"A", 3, true, 3},
+        {"A", 0, true, math.MaxUint64},
+        {"A", 2, true, 2},
+        // B has run out of accesses and is waiting to be deleted
+        {"B", 5, false, 0},
+        {"C", 5, false, 0},
+    }
+    for num, test := range tests {
+        if set := testMap.SetAccessCount(test.key, test.count); set != test.set {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.set, set)
+        }
+        if remaining, _ := testMap.AccessesRemaining(test.key); remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected %d remaining, Recieved: %d\n", num+1, test.key, test.remaining, remaining)
+        }
+    }
+}
+
+func TestSet(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 20 * time.Millisecond, AccessCount: 2})
+    testMap.Get("A")
+    // PutCustom only updates the value
+    testMap.PutCustom("A", 2, Config{Timeout: 0, AccessCount: 5})
+    if remaining, _ := testMap.AccessesRemaining("A"); remaining != 1 {
+        t.Errorf("Expected PutCustom to keep the access count, Recieved %d\n", remaining)
+    }
+    // Set replaces the whole item
+    testMap.Set("A", 3, Config{Timeout: 0, AccessCount: 5})
+    if remaining, _ := testMap.AccessesRemaining("A"); remaining != 5 {
+        t.Errorf("Expected Set to reset the access count, Recieved %d\n", remaining)
+    }
+    time.Sleep(30 * time.Millisecond)
+    if value, has := testMap.Get("A"); value != 3 || !has {
+        t.Errorf("Expected Set to reset the timer, Recieved: %v %v\n", value, has)
+    }
+    testMap.Set("B", 4, Config{Timeout: 0, AccessCount: 1})
+    if value, has := testMap.Get("B"); value != 4 || !has {
+        t.Errorf("Expected Set to insert a new key, Recieved: %v %v\n", value, has)
+    }
+}
+
+func TestPutMany(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.PutCustom("A", 1, Config{Timeout: 0, AccessCount: 3})
+    testMap.PutMany(map[interface{}]interface{}{"A": 10, "B": 20, "C": 30}, Config{Timeout: 0, AccessCount: 1})
+    var tests = []struct {
+        key       interface{}
+        value     interface{}
+        remaining uint64
+    }{
+        // A existed so only its value changed
+        {"A", 10, 3},
+        {"B", 20, 1},
+        {"C", 30, 1},
+    }
+    for num, test := range tests {
+        if value, _ := testMap.Peek(test.key); value != test.value {
+            t.Errorf("Test %d Failed: Key %v - Expected: %v, Recieved: %v\n", num+1, test.key, test.value, value)
+        }
+        if remaining, _ := testMap.AccessesRemaining(test.key); remaining != test.remaining {
+            t.Errorf("Test %d Failed: Key %v - Expected %d remaining, Recieved: %d\n", num+1, test.key, test.remaining, remaining)
+        }
+    }
+}
+
+func BenchmarkPutMany(b *testing.B) {
+    entries := make(map[interface{}]interface{}, 1000)
+    for i := 0; i < 1000; i++ {
+        entries[i] = i
+    }
+    for n := 0; n < b.N; n++ {
+        testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0})
+        testMap.PutMany(entries, Config{Timeout: time.Hour, AccessCount: 0})
+        testMap.Close()
+    }
+}
+
+func TestGetMany(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 1})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    testMap.Put("B", 2)
+    testMap.PutCustom("C", 3, Config{Timeout: 0, AccessCount: 0})
+    var tests = []struct {
+        keys   []interface{}
+        values map[interface{}]interface{}
+    }{
+        {[]interface{}{"A", "C", "D"}, map[interface{}]interface{}{"A": 1, "C": 3}},
+        // A's only access was consumed and B's is consumed by its first occurrence
+        {[]interface{}{"A", "B", "B", "C"}, map[interface{}]interface{}{"B": 2, "C": 3}},
+        {[]interface{}{"A", "B"}, map[interface{}]interface{}{}},
+    }
+    for num, test := range tests {
+        if values := testMap.GetMany(test.keys); !reflect.DeepEqual(values, test.values) {
+            t.Errorf("Test %d Failed: Expected: %v, Recieved: %v\n", num+1, test.values, values)
+        }
+    }
+}
+
+func TestRemoveMany(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithPerItemTimers())
+    defer testMap.Close()
+    for i := 0; i < 10; i++ {
+        testMap.Put(i, i)
+    }
+    if removed := testMap.RemoveMany([]interface{}{0, 1, 2, 2, 42}); removed != 3 {
+        t.Errorf("Expected 3 keys to be removed, Recieved %d\n", removed)
+    }
+    for i := 0; i < 10; i++ {
+        if has := testMap.Has(i); has != (i > 2) {
+            t.Errorf("Test %d Failed: Key %d - Expected: %v, Recieved: %v\n", i+1, i, i > 2, has)
+        }
+    }
+    if goroutines := waitGoroutines(testMap, 7); goroutines != 7 {
+        t.Errorf("Expected the removed items' goroutines to stop, Recieved %d\n", goroutines)
+    }
+}
+
+func TestShardedMap(t *testing.T) {
+    testMap := NewCustomShardedManagedMap(Config{Timeout: time.Hour, AccessCount: 0, ShardCount: 4})
+    if shards := len(testMap.shards); shards != 4 {
+        t.Errorf("Expected 4 shards, Recieved %d\n", shards)
+    }
+    for i := 0; i < 100; i++ {
+        testMap.Put(i, i * 2)
+    }
+    if size := testMap.Size(); size != 100 {
+        t.Errorf("Expected size 100, Recieved %d\n", size)
+    }
+    for i, shard := range testMap.shards {
+        if shard.Size() == 0 {
+            t.Errorf("Expected shard %d to hold keys\n", i)
+        }
+    }
+    for i := 0; i < 100; i++ {
+        if value, has := testMap.Get(i); !has || value != i * 2 {
+            t.Errorf("Test %d Failed: Expected %d, Recieved %v %t\n", i, i * 2, value, has)
+        }
+    }
+    testMap.PutCustom("once", 1, Config{Timeout: time.Hour, AccessCount: 1})
+    testMap.Get("once")
+    if testMap.Has("once") {
+        t.Errorf("Expected item to run out of accesses\n")
+    }
+    testMap.PutCustom("short", 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    time.Sleep(50 * time.Millisecond)
+    if testMap.Has("short") {
+        t.Errorf("Expected item to expire\n")
+    }
+    testMap.Remove(0)
+    if _, has := testMap.Peek(0); has {
+        t.Errorf("Expected removed key to be missing\n")
+    }
+    testMap.Close()
+    for i, shard := range testMap.shards {
+        if !shard.IsClosed() {
+            t.Errorf("Expected shard %d to be closed\n", i)
+        }
+    }
+    if defaults := NewShardedManagedMap(); len(defaults.shards) != DefaultShardCount {
+        t.Errorf("Expected %d shards, Recieved %d\n", DefaultShardCount, len(defaults.shards))
+    } else {
+        defaults.Close()
+    }
+    // A map that is not sharded ignores a ShardCount
+    single := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0, ShardCount: 4})
+    single.Put("A", 1)
+    if value, has := single.Get("A"); !has || value != 1 {
+        t.Errorf("Expected 1, Recieved %v %t\n", value, has)
+    }
+    single.Close()
+}
+
+func TestShardedMapAPI(t *testing.T) {
+    loader := WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+        return key.(int) * 10, nil
+    })
+    testMap := NewCustomShardedManagedMap(Config{Timeout: time.Hour, AccessCount: 0, ShardCount: 4}, loader)
+    entries := make(map[interface{}]interface{})
+    keys := make([]interface{}, 0, 20)
+    for i := 0; i < 20; i++ {
+        entries[i] = i * 2
+        keys = append(keys, i)
+    }
+    testMap.PutMany(entries, Config{Timeout: time.Hour, AccessCount: 0})
+    if got := len(testMap.Keys()); got != 20 {
+        t.Errorf("Expected 20 keys, Recieved %d\n", got)
+    }
+    if got := testMap.GetMany(keys); len(got) != 20 || got[7] != 14 {
+        t.Errorf("Expected every key to be read, Recieved %v\n", got)
+    }
+    if value, err := testMap.GetLoad(context.Background(), 100); err != nil || value != 1000 {
+        t.Errorf("Expected 1000 to be loaded, Recieved %v %v\n", value, err)
+    }
+    if !testMap.Touch(100) || !testMap.Contains(100) {
+        t.Errorf("Expected the loaded key to be stored in its shard\n")
+    }
+    if removed := testMap.RemoveMany([]interface{}{0, 1, 2, 100, "missing"}); removed != 4 {
+        t.Errorf("Expected 4 removed keys, Recieved %d\n", removed)
+    }
+    if stats := testMap.Stats(); stats.Removals != 4 || uint64(stats.Hits) != testMap.HitCount() {
+        t.Errorf("Expected the Stats of every shard to be summed, Recieved %+v\n", stats)
+    }
+    visited := 0
+    testMap.Range(func(key, value interface{}) bool {
+        visited++
+        if value != key.(int) * 2 {
+            t.Errorf("Expected %d, Recieved %v\n", key.(int) * 2, value)
+        }
+        return true
+    })
+    if visited != 17 {
+        t.Errorf("Expected 17 items to be visited, Recieved %d\n", visited)
+    }
+    var buf bytes.Buffer
+    if err := testMap.Save(&buf); err != nil {
+        t.Fatalf("Expected Save to succeed, Recieved %v\n", err)
+    }
+    restored := NewCustomShardedManagedMap(Config{Timeout: time.Hour, AccessCount: 0, ShardCount: 3})
+    if err := restored.Load(&buf); err != nil {
+        t.Fatalf("Expected Load to succeed, Recieved %v\n", err)
+    }
+    for i := 3; i < 20; i++ {
+        if value, has := restored.Get(i); !has || value != i * 2 {
+            t.Errorf("Test %d Failed: Expected %d, Recieved %v %t\n", i, i * 2, value, has)
+        }
+    }
+    testMap.Clear()
+    if size := testMap.LiveSize(); size != 0 {
+        t.Errorf("Expected an empty map, Recieved %d items\n", size)
+    }
+    testMap.Close()
+    restored.Close()
+    if !testMap.IsClosed() {
+        t.Errorf("Expected the map to be closed\n")
+    }
+}
+
+func TestConsistentHashing(t *testing.T) {
+    testMap := NewCustomShardedManagedMap(Config{Timeout: 0, AccessCount: 0, ShardCount: 8}, WithConsistentHashing(100))
+    defer testMap.Close()
+    for i := 0; i < 1000; i++ {
+        testMap.Put(i, i)
+    }
+    total := 0
+    for i, size := range testMap.ShardSizes() {
+        // Each shard should hold about 125 keys
+        if size < 40 {
+            t.Errorf("Expected shard %d to hold its share of keys, Recieved %d\n", i, size)
+        }
+        total += size
+    }
+    if total != 1000 {
+        t.Errorf("Expected the shards to hold 1000 keys, Recieved %d\n", total)
+    }
+    for i := 0; i < 1000; i++ {
+        if value, has := testMap.Get(i); !has || value != i {
+            t.Errorf("Test %d Failed: Expected %d, Recieved %v %t\n", i, i, value, has)
+        }
+    }
+    if nodes := testMap.shards[0].Features().VirtualNodes; nodes != 100 {
+        t.Errorf("Expected Features to report 100 virtual nodes, Recieved %d\n", nodes)
+    }
+    // Adding a shard only moves keys to the new shard
+    grown := newHashRing(testMap.seed, 9, 100)
+    moved := 0
+    for i := 0; i < 1000; i++ {
+        hash := maphash.Comparable(testMap.seed, i)
+        if before, after := testMap.ring.lookup(hash), grown.lookup(hash); before != after {
+            moved++
+            if after != 8 {
+                t.Errorf("Expected key %d to move to the new shard, Recieved shard %d\n", i, after)
+            }
+        }
+    }
+    if moved == 0 || moved > 250 {
+        t.Errorf("Expected about a ninth of the keys to move, Recieved %d\n", moved)
+    }
+}
+
+func TestReshard(t *testing.T) {
+    for _, opts := range [][]Option{nil, {WithConsistentHashing(50)}} {
+        testMap := NewCustomShardedManagedMap(Config{Timeout: time.Hour, AccessCount: 3, ShardCount: 4}, opts...)
+        for i := 0; i < 500; i++ {
+            testMap.Put(i, i)
+        }
+        testMap.Get(0)
+        testMap.PutCustom("short", 1, Config{Timeout: 50 * time.Millisecond, AccessCount: 0})
+        // Readers never see a key missing while it moves
+        stop := make(chan struct{})
+        var wg sync.WaitGroup
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                for i := 0; i < 500; i++ {
+                    select {
+                    case <-stop:
+                        return
+                    default:
+                    }
+                    if _, has := testMap.Peek(i); !has {
+                        t.Errorf("Expected key %d to stay readable during Reshard\n", i)
+                    }
+                }
+            }
+        }()
+        old := testMap.shards
+        for _, count := range []int{7, 3} {
+            testMap.Reshard(count)
+            if shards := len(testMap.ShardSizes()); shards != count {
+                t.Errorf("Expected %d shards, Recieved %d\n", count, shards)
+            }
+            if size := testMap.Size(); size != 501 {
+                t.Errorf("Expected Reshard to keep every key, Recieved size %d\n", size)
+            }
+            for i := 0; i < 500; i++ {
+                if !testMap.shard(i).Has(i) {
+                    t.Errorf("Expected key %d in its shard after resharding to %d\n", i, count)
+                }
+            }
+        }
+        close(stop)
+        wg.Wait()
+        for i, shard := range old[3:] {
+            if !shard.IsClosed() {
+                t.Errorf("Expected removed shard %d to be closed\n", i + 3)
+            }
+        }
+        // Moved items keep their accesses and timeouts
+        for i := 0; i < 2; i++ {
+            if _, has := testMap.Get(0); !has {
+                t.Errorf("Expected key 0 to keep its remaining accesses\n")
+            }
+        }
+        if testMap.Has(0) {
+            t.Errorf("Expected key 0 to run out of accesses\n")
+        }
+        time.Sleep(100 * time.Millisecond)
+        if testMap.Has("short") {
+            t.Errorf("Expected a moved item to expire on time\n")
+        }
+        testMap.Close()
+    }
+}
+
+func TestReshardMaxSize(t *testing.T) {
+    testMap := NewCustomShardedManagedMap(Config{Timeout: 0, AccessCount: 0, ShardCount: 4, MaxSize: 100})
+    defer testMap.Close()
+    for i := 0; i < 60; i++ {
+        testMap.Put(i, i)
+    }
+    // Two shards of 25 could not hold the 60 items, two shards of 50 can
+    testMap.Reshard(2)
+    if size := testMap.Size(); size != 60 {
+        t.Errorf("Expected shrinking to keep all 60 items, Recieved %d\n", size)
+    }
+    if evictions := testMap.EvictionCount(); evictions != 0 {
+        t.Errorf("Expected no evictions, Recieved %d\n", evictions)
+    }
+    if max := testMap.Features().MaxSize; max != 50 {
+        t.Errorf("Expected a MaxSize of 50 per shard, Recieved %d\n", max)
+    }
+    testMap.Reshard(5)
+    for i, shard := range testMap.shards {
+        if max := shard.Features().MaxSize; max != 20 {
+            t.Errorf("Expected shard %d to have a MaxSize of 20, Recieved %d\n", i, max)
+        }
+    }
+}
+
+type benchmarkMap interface {
+    Get(key interface{}) (interface{}, bool)
+    Put(key, value interface{})
+    Close()
+}
+
+func benchmarkParallel(b *testing.B, m benchmarkMap) {
+    defer m.Close()
+    var next int64
+    b.RunParallel(func(pb *testing.PB) {
+        // Every goroutine works on its own keys
+        base := atomic.AddInt64(&next, 1) << 32
+        i := int64(0)
+        for pb.Next() {
+            key := base + i % 1024
+            m.Put(key, i)
+            m.Get(key)
+            i++
+        }
+    })
+}
+
+func BenchmarkParallel(b *testing.B) {
+    conf := Config{Timeout: time.Hour, AccessCount: 0}
+    b.Run("Single", func(b *testing.B) {
+        benchmarkParallel(b, NewCustomManagedMap(conf))
+    })
+    b.Run("Sharded", func(b *testing.B) {
+        benchmarkParallel(b, NewCustomShardedManagedMap(conf))
+    })
+}
+
+func TestMaxSize(t *testing.T) {
+    var lock sync.Mutex
+    evicted := make(map[interface{}] EvictReason)
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 3}, WithOnEvict(func(key, value interface{}, reason EvictReason) {
+        lock.Lock()
+        defer lock.Unlock()
+        evicted[key] = reason
+    }))
+    defer testMap.Close()
+    testMap.Put(1, 1)
+    testMap.Put(2, 2)
+    testMap.Put(3, 3)
+    // Reading 1 and updating 2 leaves 3 as the least recently used
+    testMap.Get(1)
+    testMap.Put(2, 4)
+    testMap.Put(4, 4)
+    if size := testMap.Size(); size != 3 {
+        t.Errorf("Expected size 3, Recieved %d\n", size)
+    }
+    if testMap.Has(3) {
+        t.Errorf("Expected least recently used key 3 to be evicted\n")
+    }
+    lock.Lock()
+    if reason, has := evicted[3]; !has || reason != EvictCapacity {
+        t.Errorf("Expected key 3 evicted with %v, Recieved %v %t\n", EvictCapacity, reason, has)
+    }
+    lock.Unlock()
+    // Updating a key of a full map does not evict anything
+    testMap.Put(4, 5)
+    if size := testMap.Size(); size != 3 {
+        t.Errorf("Expected size 3 after update, Recieved %d\n", size)
+    }
+    // Pinned items are skipped
+    testMap.Pin(1)
+    testMap.Put(5, 5)
+    if !testMap.Has(1) || testMap.Has(2) {
+        t.Errorf("Expected pinned key 1 kept and key 2 evicted\n")
+    }
+    // Removed and expired items free their space
+    testMap.Remove(4)
+    testMap.PutCustom(6, 6, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    time.Sleep(50 * time.Millisecond)
+    testMap.Put(7, 7)
+    testMap.Put(8, 8)
+    for _, key := range []int{1, 7, 8} {
+        if !testMap.Has(key) {
+            t.Errorf("Expected key %d to be kept\n", key)
+        }
+    }
+    if size := testMap.Size(); size != 3 {
+        t.Errorf("Expected size 3 after refill, Recieved %d\n", size)
+    }
+    if testMap.Features().MaxSize != 3 {
+        t.Errorf("Expected Features to report MaxSize 3\n")
+    }
+    testMap.Clear()
+    for i := 0; i < 5; i++ {
+        testMap.Put(i, i)
+    }
+    if size := testMap.Size(); size != 3 {
+        t.Errorf("Expected size 3 after Clear, Recieved %d\n", size)
+    }
+}
+
+func TestEvictionPolicyLFU(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 3, EvictionPolicy: LFU})
+    defer testMap.Close()
+    testMap.Put(1, 1)
+    testMap.Put(2, 2)
+    testMap.Put(3, 3)
+    for i := 0; i < 3; i++ {
+        testMap.Get(1)
+    }
+    testMap.Get(2)
+    testMap.Get(3)
+    // 2 and 3 are tied and 2 was used longest ago
+    testMap.Put(4, 4)
+    if testMap.Has(2) || !testMap.Has(1) || !testMap.Has(3) {
+        t.Errorf("Expected key 2 to be evicted, Recieved keys %v\n", testMap.Keys())
+    }
+    // The new key has not been used so it goes first
+    testMap.Put(5, 5)
+    if testMap.Has(4) || !testMap.Has(1) || !testMap.Has(3) || !testMap.Has(5) {
+        t.Errorf("Expected key 4 to be evicted, Recieved keys %v\n", testMap.Keys())
+    }
+    if policy := testMap.Features().EvictionPolicy; policy != LFU {
+        t.Errorf("Expected Features to report %v, Recieved %v\n", LFU, policy)
+    }
+}
+
+func TestEvictVetoCapacity(t *testing.T) {
+    var reasons []EvictReason
+    veto := WithEvictVeto(func(key, value interface{}, reason EvictReason) bool {
+        reasons = append(reasons, reason)
+        return key == 1
+    })
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 2}, veto)
+    defer testMap.Close()
+    testMap.Put(1, 1)
+    testMap.Put(2, 2)
+    // The least recently used key 1 is kept, so key 2 is evicted in its place
+    testMap.Put(3, 3)
+    if !testMap.Has(1) || testMap.Has(2) || !testMap.Has(3) {
+        t.Errorf("Expected the vetoed key to be kept, Recieved keys %v\n", testMap.Keys())
+    }
+    if len(reasons) != 2 || reasons[0] != EvictCapacity || reasons[1] != EvictCapacity {
+        t.Errorf("Expected two capacity vetoes, Recieved %v\n", reasons)
+    }
+    if vetoes := testMap.Stats().Vetoes; vetoes != 1 {
+        t.Errorf("Expected 1 veto, Recieved %d\n", vetoes)
+    }
+}
+
+func TestEvictionPriority(t *testing.T) {
+    // LFU evicts key 1 as it is tied with key 2 and used longest ago, then the unused key 3
+    evicted := map[EvictionPolicy][]int{LRU: {1, 2}, LFU: {1, 3}}
+    for _, policy := range []EvictionPolicy{LRU, LFU} {
+        testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 3, EvictionPolicy: policy})
+        testMap.PutCustom("important", 1, Config{Timeout: time.Hour, AccessCount: 0, Priority: 1})
+        testMap.Put(1, 1)
+        testMap.Put(2, 2)
+        // The low priority keys are used more, yet go before the important one
+        for i := 0; i < 3; i++ {
+            testMap.Get(1)
+            testMap.Get(2)
+        }
+        testMap.Put(3, 3)
+        testMap.Put(4, 4)
+        if !testMap.Has("important") || testMap.Size() != 3 {
+            t.Errorf("Expected %v to keep the important key, Recieved keys %v\n", policy, testMap.Keys())
+        }
+        // Among the lowest priority the policy picks the victim
+        if keys := evicted[policy]; testMap.Has(keys[0]) || testMap.Has(keys[1]) {
+            t.Errorf("Expected %v to evict keys %v, Recieved keys %v\n", policy, keys, testMap.Keys())
+        }
+        testMap.Close()
+    }
+    // A map holding only items of the same priority evicts by its policy
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 2, Priority: 5})
+    defer testMap.Close()
+    testMap.Put(1, 1)
+    testMap.Put(2, 2)
+    testMap.Get(1)
+    testMap.Put(3, 3)
+    if testMap.Has(2) || !testMap.Has(1) || !testMap.Has(3) {
+        t.Errorf("Expected key 2 to be evicted, Recieved keys %v\n", testMap.Keys())
+    }
+    if priority := testMap.Features().DefaultPriority; priority != 5 {
+        t.Errorf("Expected Features to report priority 5, Recieved %d\n", priority)
+    }
+}
+
+func TestStatsCounters(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 4})
+    defer testMap.Close()
+    testMap.PutCustom("once", 1, Config{Timeout: time.Hour, AccessCount: 1})
+    testMap.PutCustom("short", 1, Config{Timeout: 10 * time.Millisecond, AccessCount: 0})
+    testMap.Put("removed", 1)
+    testMap.Put("kept", 1)
+    testMap.Get("once")
+    testMap.Get("kept")
+    testMap.Get("missing")
+    testMap.Remove("removed")
+    time.Sleep(50 * time.Millisecond)
+    for i := 0; i < 4; i++ {
+        testMap.Put(i, i)
+    }
+    expected := Stats{Hits: 2, Misses: 1, Expirations: 1, AccessExhaustions: 1, Removals: 1, CapacityEvictions: 1}
+    s := testMap.Stats()
+    if s.Hits != expected.Hits || s.Misses != expected.Misses || s.Expirations != expected.Expirations || s.AccessExhaustions != expected.AccessExhaustions || s.Removals != expected.Removals || s.CapacityEvictions != expected.CapacityEvictions {
+        t.Errorf("Expected counters %+v, Recieved %+v\n", expected, s)
+    }
+    if hits, misses, evictions := testMap.HitCount(), testMap.MissCount(), testMap.EvictionCount(); hits != 2 || misses != 1 || evictions != 3 {
+        t.Errorf("Expected 2 hits, 1 miss and 3 evictions, Recieved %d %d %d\n", hits, misses, evictions)
+    }
+}
+
+func TestGetPutContext(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0})
+    ctx := context.Background()
+    if err := testMap.PutContext(ctx, "key", 1, Config{Timeout: time.Hour, AccessCount: 0}); err != nil {
+        t.Errorf("Expected PutContext to succeed, Recieved %v\n", err)
+    }
+    if value, has, err := testMap.GetContext(ctx, "key"); err != nil || !has || value != 1 {
+        t.Errorf("Expected 1, Recieved %v %t %v\n", value, has, err)
+    }
+    if _, has, err := testMap.GetContext(ctx, "missing"); err != nil || has {
+        t.Errorf("Expected a miss, Recieved %t %v\n", has, err)
+    }
+    cancelled, cancel := context.WithCancel(ctx)
+    cancel()
+    if err := testMap.PutContext(cancelled, "other", 1, Config{}); err != context.Canceled {
+        t.Errorf("Expected %v, Recieved %v\n", context.Canceled, err)
+    }
+    if testMap.Has("other") {
+        t.Errorf("Expected cancelled PutContext not to store the value\n")
+    }
+    // A caller waiting on the lock gives up at its deadline
+    release := make(chan struct{})
+    held := make(chan struct{})
+    go testMap.WithLock(func(u UnsafeMap) {
+        close(held)
+        <-release
+    })
+    <-held
+    timed, stop := context.WithTimeout(ctx, 10 * time.Millisecond)
+    defer stop()
+    if _, _, err := testMap.GetContext(timed, "key"); err != context.DeadlineExceeded {
+        t.Errorf("Expected %v, Recieved %v\n", context.DeadlineExceeded, err)
+    }
+    close(release)
+    testMap.Close()
+    if _, _, err := testMap.GetContext(ctx, "key"); err != ErrClosed {
+        t.Errorf("Expected %v, Recieved %v\n", ErrClosed, err)
+    }
+    if err := testMap.PutContext(ctx, "key", 1, Config{}); err != ErrClosed {
+        t.Errorf("Expected %v, Recieved %v\n", ErrClosed, err)
+    }
+}
+
+func TestJSON(t *testing.T) {
+    source := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer source.Close()
+    source.PutCustom("counted", "a", Config{Timeout: time.Hour, AccessCount: 3})
+    source.Get("counted")
+    source.PutCustom("short", []interface{}{"b", 1.5}, Config{Timeout: 40 * time.Millisecond, AccessCount: 0})
+    source.Put("forever", map[string]interface{}{"c": true})
+    data, err := json.Marshal(source)
+    if err != nil {
+        t.Fatalf("Expected MarshalJSON to succeed, Recieved %v\n", err)
+    }
+    // Marshaling is not an access
+    if remaining, _ := source.AccessesRemaining("counted"); remaining != 2 {
+        t.Errorf("Expected 2 accesses left in the source, Recieved %d\n", remaining)
+    }
+    restored := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 1})
+    defer restored.Close()
+    if err := json.Unmarshal(data, restored); err != nil {
+        t.Fatalf("Expected UnmarshalJSON to succeed, Recieved %v\n", err)
+    }
+    if size := restored.Size(); size != 3 {
+        t.Errorf("Expected 3 items, Recieved %d\n", size)
+    }
+    if remaining, _ := restored.AccessesRemaining("counted"); remaining != 2 {
+        t.Errorf("Expected 2 accesses left, Recieved %d\n", remaining)
+    }
+    if ttl, _ := restored.TimeToLive("counted"); ttl <= 59 * time.Minute || ttl > time.Hour {
+        t.Errorf("Expected about an hour left, Recieved %v\n", ttl)
+    }
+    if value, _ := restored.Peek("short"); !reflect.DeepEqual(value, []interface{}{"b", 1.5}) {
+        t.Errorf("Expected [b 1.5], Recieved %v\n", value)
+    }
+    if value, _ := restored.Peek("forever"); !reflect.DeepEqual(value, map[string]interface{}{"c": true}) {
+        t.Errorf("Expected map[c:true], Recieved %v\n", value)
+    }
+    if ttl, _ := restored.TimeToLive("forever"); ttl != math.MaxInt64 {
+        t.Errorf("Expected an infinite timeout, Recieved %v\n", ttl)
+    }
+    time.Sleep(80 * time.Millisecond)
+    if restored.Has("short") {
+        t.Errorf("Expected restored item to expire with its remaining time\n")
+    }
+    if err := restored.UnmarshalJSON([]byte(`[{"key":{"a":1},"value":1}]`)); err != ErrKeyNotComparable {
+        t.Errorf("Expected %v, Recieved %v\n", ErrKeyNotComparable, err)
+    }
+}
+
+func TestSnapshotFull(t *testing.T) {
+    for _, policy := range []EvictionPolicy{LRU, LFU} {
+        source := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 4, EvictionPolicy: policy}, WithSnapshotCompression(GzipCompression))
+        for i := 1; i <= 4; i++ {
+            source.Put(i, i)
+        }
+        source.PutCustom(1, 1, Config{Timeout: time.Hour, AccessCount: 0})
+        // From least to most recently used: 2 3 4 1, where 3 is used most often
+        for i := 0; i < 3; i++ {
+            source.Get(3)
+        }
+        source.Get(4)
+        source.Get(1)
+        var buf bytes.Buffer
+        if err := source.SnapshotFull(&buf); err != nil {
+            t.Fatalf("Expected SnapshotFull to succeed, Recieved %v\n", err)
+        }
+        source.Close()
+        restored := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0, MaxSize: 4, EvictionPolicy: policy})
+        if err := restored.RestoreFull(&buf); err != nil {
+            t.Fatalf("Expected RestoreFull to succeed, Recieved %v\n", err)
+        }
+        // The restored map evicts as the saved one would have
+        expected := map[EvictionPolicy][]int{LRU: {2, 3}, LFU: {2, 5}}[policy]
+        evicted := []int{}
+        for i := 5; i <= 6; i++ {
+            restored.Put(i, i)
+            for k := 1; k < i; k++ {
+                if !restored.Has(k) && (len(evicted) == 0 || evicted[0] != k) {
+                    evicted = append(evicted, k)
+                }
+            }
+        }
+        if !reflect.DeepEqual(evicted, expected) {
+            t.Errorf("Expected %v to evict %v after a restore, Recieved %v\n", policy, expected, evicted)
+        }
+        restored.Close()
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("A", 1)
+    var buf bytes.Buffer
+    testMap.SnapshotFull(&buf)
+    data := buf.Bytes()
+    // A newer format is refused rather than misread
+    data[len(fullSnapshotMagic)] = fullSnapshotVersion + 1
+    if err := testMap.RestoreFull(bytes.NewReader(data)); err != ErrSnapshotVersion {
+        t.Errorf("Expected ErrSnapshotVersion, Recieved %v\n", err)
+    }
+    buf.Reset()
+    testMap.Save(&buf)
+    if err := testMap.RestoreFull(&buf); err != ErrInvalidSnapshot {
+        t.Errorf("Expected a Save snapshot to be rejected, Recieved %v\n", err)
+    }
+}
+
+func TestClone(t *testing.T) {
+    source := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithValueEncryption(make([]byte, 32)))
+    defer source.Close()
+    source.PutCustom("counted", 1, Config{Timeout: time.Hour, AccessCount: 3})
+    source.PutCustom("short", 2, Config{Timeout: 40 * time.Millisecond, AccessCount: 0})
+    source.Put("kept", 3)
+    clone, err := source.Clone()
+    if err != nil {
+        t.Fatalf("Expected Clone to succeed, Recieved %v\n", err)
+    }
+    defer clone.Close()
+    if remaining, _ := source.AccessesRemaining("counted"); remaining != 3 {
+        t.Errorf("Expected Clone not to consume accesses, Recieved %d left\n", remaining)
+    }
+    if remaining, _ := clone.AccessesRemaining("counted"); remaining != 3 {
+        t.Errorf("Expected 3 accesses in the clone, Recieved %d\n", remaining)
+    }
+    if value, has := clone.Get("kept"); !has || value != 3 {
+        t.Errorf("Expected 3, Recieved %v %t\n", value, has)
+    }
+    // The maps are independent
+    clone.Remove("kept")
+    clone.Put("new", 4)
+    if !source.Has("kept") || source.Has("new") {
+        t.Errorf("Expected changes to the clone to leave the source alone\n")
+    }
+    if clone.Features().Encryption {
+        t.Errorf("Expected the clone to have no Options\n")
+    }
+    time.Sleep(80 * time.Millisecond)
+    if clone.Has("short") {
+        t.Errorf("Expected the cloned item to expire with its remaining time\n")
+    }
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0})
+    defer testMap.Close()
+    testMap.Put("key", 0)
+    var wg sync.WaitGroup
+    // Run with -race; updating an existing key must not race with readers or other writers
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                testMap.Put("key", g * 1000 + i)
+                testMap.Get("key")
+                testMap.SnapshotKeys("key")
+            }
+        }(g)
+    }
+    wg.Wait()
+    if _, has := testMap.Get("key"); !has {
+        t.Errorf("Expected key to exist after concurrent updates\n")
+    }
+}
+
+func TestConcurrentInsert(t *testing.T) {
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithPerItemTimers())
+    defer testMap.Close()
+    var wg sync.WaitGroup
+    // Every goroutine races to insert the same keys
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 100; i++ {
+                testMap.Put(i, g)
+                runtime.Gosched()
+            }
+        }(g)
+    }
+    wg.Wait()
+    if size := testMap.Size(); size != 100 {
+        t.Errorf("Expected size 100, Recieved %d\n", size)
+    }
+    // An item overwritten by a racing insert would leave its goroutine behind
+    if active := waitGoroutines(testMap, 100); active != 100 {
+        t.Errorf("Expected 100 active goroutines, Recieved %d\n", active)
+    }
+}
+
+func TestConcurrentAccessCount(t *testing.T) {
+    const accesses = 2000
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: accesses})
+    defer testMap.Close()
+    testMap.Put("key", 1)
+    var reads int64
+    var wg sync.WaitGroup
+    // Get, GetAndRemaining and GetN race for the same accesses
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < accesses; i++ {
+                var ok bool
+                switch (g + i) % 3 {
+                case 0:
+                    _, ok = testMap.Get("key")
+                case 1:
+                    _, _, ok = testMap.GetAndRemaining("key")
+                default:
+                    if _, ok = testMap.GetN("key", 2); ok {
+                        atomic.AddInt64(&reads, 1)
+                    }
+                }
+                if ok {
+                    atomic.AddInt64(&reads, 1)
+                }
+                runtime.Gosched()
+            }
+        }(g)
+    }
+    wg.Wait()
+    if reads != accesses {
+        t.Errorf("Expected exactly %d accesses to be handed out, Recieved %d\n", accesses, reads)
+    }
+}
+
+func TestLoaderPanic(t *testing.T) {
+    started := make(chan struct{})
+    release := make(chan struct{})
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+        close(started)
+        <-release
+        panic("backend exploded")
+    }))
+    defer testMap.Close()
+    panicked := make(chan interface{})
+    go func() {
+        defer func() {
+            panicked <- recover()
+        }()
+        testMap.GetLoad(context.Background(), "key")
+    }()
+    <-started
+    waited := make(chan error)
+    go func() {
+        _, err := testMap.GetLoad(context.Background(), "key")
+        waited <- err
+    }()
+    // Give the waiter time to join the load
+    time.Sleep(20 * time.Millisecond)
+    close(release)
+    if r := <-panicked; r != "backend exploded" {
+        t.Errorf("Expected the panic to reach the caller running the load, Recieved %v\n", r)
+    }
+    if err := <-waited; err != ErrLoaderPanicked {
+        t.Errorf("Expected %v, Recieved %v\n", ErrLoaderPanicked, err)
+    }
+    if testMap.Has("key") {
+        t.Errorf("Expected nothing to be stored after the loader panicked\n")
+    }
+}
+
+func TestGetLoadCountedOnce(t *testing.T) {
+    tracer := &testTracer{}
+    testMap := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithTracer(tracer), WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+        return "loaded", nil
+    }))
+    defer testMap.Close()
+    if value, has := testMap.Get("key"); !has || value != "loaded" {
+        t.Errorf("Expected the loaded value, Recieved %v %t\n", value, has)
+    }
+    if hits, misses := testMap.HitCount(), testMap.MissCount(); hits != 0 || misses != 1 {
+        t.Errorf("Expected 0 hits and 1 miss, Recieved %d %d\n", hits, misses)
+    }
+    operations := []string{}
+    for _, span := range tracer.spans {
+        operations = append(operations, span.operation)
+    }
+    if expected := []string{"Get", "Load", "Put"}; !reflect.DeepEqual(operations, expected) {
+        t.Errorf("Expected spans %v, Recieved %v\n", expected, operations)
+    }
+    // GetAsync counts and traces its miss once too
+    tracer.spans = nil
+    if result := <-testMap.GetAsync("async"); !result.OK || result.Value != "loaded" {
+        t.Errorf("Expected GetAsync to load the value, Recieved %+v\n", result)
+    }
+    if misses := testMap.MissCount(); misses != 2 {
+        t.Errorf("Expected GetAsync to count 1 miss, Recieved %d\n", misses - 1)
+    }
+    operations = []string{}
+    for _, span := range tracer.spans {
+        operations = append(operations, span.operation)
+    }
+    if expected := []string{"Get", "Load", "Put"}; !reflect.DeepEqual(operations, expected) {
+        t.Errorf("Expected GetAsync spans %v, Recieved %v\n", expected, operations)
+    }
+}
+
+func TestLoadSpanLinks(t *testing.T) {
+    started := make(chan struct{})
+    release := make(chan struct{})
+    loader := WithLoader(func(ctx context.Context, key interface{}) (interface{}, error) {
+        close(started)
+        <-release
+        return "loaded", nil
+    })
+    // The waiting map is traced separately so each tracer is used by one goroutine
+    group := NewGroup()
+    leaderTracer, waiterTracer := &testTracer{}, &testTracer{}
+    leader := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithTracer(leaderTracer), WithLoaderGroup(group), loader)
+    defer leader.Close()
+    waiter := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithTracer(waiterTracer), WithLoaderGroup(group), loader)
+    defer waiter.Close()
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        leader.GetLoad(context.Background(), "key")
+    }()
+    <-started
+    time.AfterFunc(50 * time.Millisecond, func() {
+        close(release)
+    })
+    if value, err := waiter.GetLoad(context.Background(), "key"); value != "loaded" || err != nil {
+        t.Errorf("Expected the shared load to return loaded, Recieved %v %v\n", value, err)
+    }
+    wg.Wait()
+    find := func(tracer *testTracer) *testSpan {
+        for _, span := range tracer.spans {
+            if span.operation == "Load" {
+                return span
+            }
+        }
+        return nil
+    }
+    leaderSpan, waiterSpan := find(leaderTracer), find(waiterTracer)
+    if leaderSpan == nil || waiterSpan == nil {
+        t.Fatalf("Expected both maps to trace a load\n")
+    }
+    if shared := waiterSpan.attributes["load.shared"]; shared != true {
+        t.Errorf("Expected the waiter's load to be shared, Recieved %v\n", shared)
+    }
+    if len(waiterSpan.links) != 1 || waiterSpan.links[0] != Span(leaderSpan) {
+        t.Errorf("Expected the waiter's span to link to the leader's, Recieved %v\n", waiterSpan.links)
+    }
+    if len(leaderSpan.links) != 0 {
+        t.Errorf("Expected the leader's span to have no links, Recieved %v\n", leaderSpan.links)
+    }
+}
+
+func TestPersistPinnedAndCreated(t *testing.T) {
+    source := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithMaxLifetime(time.Hour))
+    defer source.Close()
+    source.PutCustom("pinned", 1, Config{Timeout: 50 * time.Millisecond, AccessCount: 0})
+    source.Pin("pinned")
+    source.Put("old", 2)
+    source.m["old"].created = time.Now().Add(-30 * time.Minute)
+    var buf bytes.Buffer
+    if err := source.Save(&buf); err != nil {
+        t.Fatalf("Expected Save to succeed, Recieved %v\n", err)
+    }
+    loaded := NewCustomManagedMap(Config{Timeout: time.Hour, AccessCount: 0}, WithMaxLifetime(time.Hour))
+    defer loaded.Close()
+    if err := loaded.Load(&buf); err != nil {
+        t.Fatalf("Expected Load to succeed, Recieved %v\n", err)
+    }
+    // The pinned item comes back as an ordinary item with its own timeout
+    if ttl, _ := loaded.TimeToLive("pinned"); ttl <= 0 || ttl > 50 * time.Millisecond {
+        t.Errorf("Expected at most 50ms left on the pinned item, Recieved %v\n", ttl)
+    }
+    // The maximum lifetime still counts from the original insert
+    if ttl, _ := loaded.TimeToLive("old"); ttl > 31 * time.Minute {
+        t.Errorf("Expected about 30m of lifetime left, Recieved %v\n", ttl)
+    }
+    data, err := json.Marshal(source)
+    if err != nil {
+        t.Fatalf("Expected MarshalJSON to succeed, Recieved %v\n", err)
+    }
+    var items []map[string]interface{}
+    json.Unmarshal(data, &items)
+    for _, item := range items {
+        if item["key"] == "pinned" && item["remaining"].(float64) > float64(50 * time.Millisecond) {
+            t.Errorf("Expected at most 50ms remaining for the pinned item, Recieved %v\n", item["remaining"])
+        }
+    }
+    clone, err := source.Clone()
+    if err != nil {
+        t.Fatalf("Expected Clone to succeed, Recieved %v\n", err)
+    }
+    defer clone.Close()
+    if ttl, _ := clone.TimeToLive("pinned"); ttl <= 0 || ttl > 50 * time.Millisecond {
+        t.Errorf("Expected at most 50ms left on the cloned pinned item, Recieved %v\n", ttl)
+    }
+    if _, err := source.Clone(WithSerializer(func(value interface{}) ([]byte, error) {
+        return nil, errors.New("unserializable")
+    }, nil)); err == nil {
+        t.Errorf("Expected Clone to return the error of its serializer\n")
+    }
+}
+
+func TestFlushRetryStale(t *testing.T) {
+    var lock sync.Mutex
+    failed := false
+    written := []interface{}{}
+    flush := func(key, value interface{}) error {
+        lock.Lock()
+        defer lock.Unlock()
+        // Only the first flush fails
+        if !failed {
+            failed = true
+            return errors.New("store unavailable")
+        }
+        written = append(written, value)
+        return nil
+    }
+    testMap := NewCustomManagedMap(Config{Timeout: 0, AccessCount: 0}, WithWriteBack(flush), WithFlushRetry(3, 20 * time.Millisecond))
+    defer testMap.Close()
+    testMap.PutCustom("key", 1, Config{Timeout: 0, AccessCount: 1})
+    // The eviction flush of 1 fails and is retried later
+    testMap.Get("key")
+    for deadline := time.Now().Add(time.Second); testMap.Size() != 0 && time.Now().Before(deadline); {
+        time.Sleep(time.Millisecond)
+    }
+    // A newer value is written and flushed before the retry runs
+    testMap.Put("key", 2)
+    if err := testMap.FlushKey("key"); err != nil {
+        t.Errorf("Expected FlushKey to succeed, Recieved %v\n", err)
+    }
+    time.Sleep(100 * time.Millisecond)
+    lock.Lock()
+    if !reflect.DeepEqual(written, []interface{}{2}) {
+        t.Errorf("Expected only the newer value to be written, Recieved %v\n", written)
+    }
+    lock.Unlock()
+    if depth := testMap.Stats().RetryQueueDepth; depth != 0 {
+        t.Errorf("Expected an empty retry queue, Recieved %d\n", depth)
+    }
+}
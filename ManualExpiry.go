@@ -0,0 +1,29 @@
+package ManagedMap
+
+// WithManualExpiry returns an Option that stops the map from starting any timers or
+// goroutines to remove items, making its behavior fully driven by explicit calls, for
+// reproducible benchmarks and environments that forbid background goroutines. Items
+// that run out of time or accesses are misses for every read, but are never removed
+// automatically: they stay stored, and counted by Size, until EvictExpired is called.
+// Options that start goroutines of their own, such as WithCompactThreshold, still do.
+func WithManualExpiry() Option {
+    return func(t *managedMap) {
+        t.manualExpiry = true
+    }
+}
+
+// EvictExpired is a method of a managedMap that removes every item that has run out of
+// time or accesses but is still stored, returning how many were removed. Items are
+// evicted as they would be otherwise, so they are flushed and may be vetoed. It is how
+// items leave a map created WithManualExpiry, but can be called on any map. EvictExpired
+// will always panic when called after the Close method has been called.
+func (t *managedMap) EvictExpired() int {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    if t.m == nil {
+        return 0
+    }
+    return t.evictPending()
+}
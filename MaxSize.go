@@ -0,0 +1,168 @@
+package ManagedMap
+
+import (
+    "container/list"
+)
+
+// EvictionPolicy selects which item a full map with a MaxSize evicts to make room for a
+// new key.
+type EvictionPolicy int
+
+const (
+    // LRU evicts the least recently used item. It is the default.
+    LRU EvictionPolicy = iota
+    // LFU evicts the least frequently used item, the one read or updated the fewest times
+    // since it was inserted. Ties are broken by evicting the least recently used of the
+    // tied items, so a new item, which has not been used yet, is evicted before any
+    // older item that has. Finding the item takes time proportional to the map's size.
+    LFU
+)
+
+// String returns the name of the EvictionPolicy.
+func (p EvictionPolicy) String() string {
+    switch p {
+    case LRU:
+        return "LRU"
+    case LFU:
+        return "LFU"
+    }
+    return "Unknown"
+}
+
+// makeRoom is a private method of a managedMap with a maximum size that evicts items
+// chosen by its EvictionPolicy until a new item can be stored at key without exceeding
+// it. A victim whose eviction is vetoed is kept and the next one is evicted instead.
+// Pinned and vetoed items are never evicted, so a map full of them grows past its maximum
+// size. Nothing is evicted when key is already stored, as replacing it does not grow the
+// map. The caller must hold the write lock.
+func (t *managedMap) makeRoom(key interface{}) {
+    if t.lru == nil {
+        return
+    }
+    if _, has := t.m[key]; has {
+        return
+    }
+    var kept map[interface{}]bool
+    for int64(len(t.m)) >= t.maxSize.Load() {
+        victim, ok := t.victim(kept)
+        if !ok {
+            return
+        }
+        if t.vetoed(victim, t.m[victim], EvictCapacity) {
+            if kept == nil {
+                kept = make(map[interface{}]bool)
+            }
+            kept[victim] = true
+            continue
+        }
+        t.flushItem(victim, t.m[victim], true)
+        t.drop(victim, t.m[victim], EvictCapacity)
+    }
+}
+
+// victim is a private method of a managedMap with a maximum size that returns the key of
+// the item it evicts next, skipping pinned items and the keys of kept: the item its
+// EvictionPolicy picks among the items of the lowest priority. The caller must hold the
+// write lock.
+func (t *managedMap) victim(kept map[interface{}]bool) (interface{}, bool) {
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    var victim *list.Element
+    var fewest uint64
+    var lowest int
+    // Items are visited from least to most recently used so the first of equally used
+    // items of the same priority is kept
+    for e := t.lru.Back(); e != nil; e = e.Prev() {
+        it := t.m[e.Value]
+        if it.pinned.Load() || kept[e.Value] {
+            continue
+        }
+        // Without priorities the least recently used item is the victim
+        if t.policy == LRU && !t.prioritized {
+            return e.Value, true
+        }
+        if victim != nil && it.priority > lowest {
+            continue
+        }
+        uses := it.uses.Load()
+        if victim == nil || it.priority < lowest || (t.policy == LFU && uses < fewest) {
+            victim, fewest, lowest = e, uses, it.priority
+        }
+    }
+    if victim == nil {
+        return nil, false
+    }
+    return victim.Value, true
+}
+
+// prioritize is a private method of a managedMap that sets the priority of it, which
+// only matters to a map with a maximum size. The caller must hold the write lock.
+func (t *managedMap) prioritize(it *item, priority int) {
+    it.priority = priority
+    if priority != 0 {
+        t.prioritized = true
+    }
+}
+
+// track is a private method of a managedMap with a maximum size that records it, about to
+// be stored at key, as the most recently used item, replacing any item stored at key
+// before. The caller must hold the write lock.
+func (t *managedMap) track(key interface{}, it *item) {
+    if t.lru == nil {
+        return
+    }
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    if old, has := t.m[key]; has {
+        t.lru.Remove(old.lru)
+    }
+    it.lru = t.lru.PushFront(key)
+}
+
+// untrack is a private method of a managedMap with a maximum size that forgets the
+// recency of an item leaving the map. The caller must hold the write lock.
+func (t *managedMap) untrack(it *item) {
+    if t.lru == nil {
+        return
+    }
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    t.lru.Remove(it.lru)
+}
+
+// resetRecency is a private method of a managedMap with a maximum size that forgets the
+// recency of every item, for when all of them leave the map at once. The caller must hold
+// the write lock.
+func (t *managedMap) resetRecency() {
+    if t.lru == nil {
+        return
+    }
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    // Elements are removed one by one so late reads of the old items are ignored
+    for e := t.lru.Front(); e != nil; e = t.lru.Front() {
+        t.lru.Remove(e)
+    }
+}
+
+// used is a private method of a managedMap with a maximum size that marks an item as the
+// most recently used and counts the use. The caller must hold at least the read lock.
+// Items that have already left the map are ignored.
+func (t *managedMap) used(it *item) {
+    if t.lru == nil {
+        return
+    }
+    it.uses.Add(1)
+    t.lruLock.Lock()
+    defer t.lruLock.Unlock()
+    t.lru.MoveToFront(it.lru)
+}
+
+// newRecency is a private function that returns the recency list of a map with a maximum
+// size of maxSize, or nil when the size is not limited.
+func newRecency(maxSize int) *list.List {
+    if maxSize <= 0 {
+        return nil
+    }
+    return list.New()
+}
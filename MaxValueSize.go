@@ -0,0 +1,100 @@
+package ManagedMap
+
+import (
+    "errors"
+    "reflect"
+)
+
+// ErrValueTooLarge is returned by PutChecked when a value exceeds the maximum value
+// size configured with WithMaxValueSize.
+var ErrValueTooLarge = errors.New("ManagedMap: value exceeds the maximum value size")
+
+// WithMaxValueSize is an Option that rejects any value whose size is larger than bytes,
+// guarding against a single huge value blowing up memory. The size of a value is
+// computed by sizer, or by an estimate of the memory reachable from the value using
+// reflection when sizer is nil. The check runs before the value is stored. PutCustom
+// and Put drop rejected values while PutChecked returns ErrValueTooLarge.
+func WithMaxValueSize(bytes int64, sizer func(value interface{}) int64) Option {
+    return func(t *managedMap) {
+        t.maxValueSize = bytes
+        t.sizer = sizer
+        if t.sizer == nil {
+            t.sizer = valueSize
+        }
+    }
+}
+
+// checkValueSize is a private method of a managedMap that returns ErrValueTooLarge if
+// a maximum value size is configured and value exceeds it.
+func (t *managedMap) checkValueSize(value interface{}) error {
+    if t.sizer == nil || t.sizer(value) <= t.maxValueSize {
+        return nil
+    }
+    return ErrValueTooLarge
+}
+
+// valueSize is a private function that estimates the number of bytes of memory
+// reachable from value, following pointers, slices, maps, strings and interfaces.
+// Memory reachable through more than one path is only counted once.
+func valueSize(value interface{}) int64 {
+    if value == nil {
+        return 0
+    }
+    v := reflect.ValueOf(value)
+    return int64(v.Type().Size()) + indirectSize(v, map[uintptr]bool{})
+}
+
+// indirectSize is a private function that returns the number of bytes reachable from v
+// that are not stored inline in v itself.
+func indirectSize(v reflect.Value, seen map[uintptr]bool) int64 {
+    switch v.Kind() {
+    case reflect.Pointer:
+        if v.IsNil() || seen[v.Pointer()] {
+            return 0
+        }
+        seen[v.Pointer()] = true
+        return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+    case reflect.Interface:
+        if v.IsNil() {
+            return 0
+        }
+        return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+    case reflect.String:
+        return int64(v.Len())
+    case reflect.Slice:
+        if v.IsNil() || seen[v.Pointer()] {
+            return 0
+        }
+        seen[v.Pointer()] = true
+        size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+        for i := 0; i < v.Len(); i++ {
+            size += indirectSize(v.Index(i), seen)
+        }
+        return size
+    case reflect.Array:
+        size := int64(0)
+        for i := 0; i < v.Len(); i++ {
+            size += indirectSize(v.Index(i), seen)
+        }
+        return size
+    case reflect.Map:
+        if v.IsNil() || seen[v.Pointer()] {
+            return 0
+        }
+        seen[v.Pointer()] = true
+        size := int64(0)
+        iter := v.MapRange()
+        for iter.Next() {
+            size += int64(iter.Key().Type().Size()) + indirectSize(iter.Key(), seen)
+            size += int64(iter.Value().Type().Size()) + indirectSize(iter.Value(), seen)
+        }
+        return size
+    case reflect.Struct:
+        size := int64(0)
+        for i := 0; i < v.NumField(); i++ {
+            size += indirectSize(v.Field(i), seen)
+        }
+        return size
+    }
+    return 0
+}
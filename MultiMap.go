@@ -0,0 +1,152 @@
+package ManagedMap
+
+// multiKey is a private struct used as the key of a single value of a managedMultiMap in
+// its underlying managedMap.
+type multiKey struct {
+    key interface{}
+    id uint64
+}
+
+// managedMultiMap is a private struct that associates each key with any number of values,
+// each with its own timeout and access count. Every value is stored as its own item in
+// an underlying managedMap so values expire independently using the same machinery, and
+// a key is removed once its last value has. As with a managedMap, users are required to
+// make use of the provided methods.
+type managedMultiMap struct {
+    m *managedMap
+    keys map[interface{}] []uint64
+    next uint64
+}
+
+// NewManagedMultiMap returns a pointer to a managedMultiMap with the default timeout and
+// accessCount as defined by the DefaultTimeout and DefaultAccessCount constants. The
+// passed Options configure the underlying managedMap.
+func NewManagedMultiMap(opts ...Option) *managedMultiMap {
+    return NewCustomManagedMultiMap(Config{Timeout: DefaultTimeout, AccessCount: DefaultAccessCount}, opts...)
+}
+
+// NewCustomManagedMultiMap returns a pointer to a managedMultiMap whose values default to
+// the timeout and accessCount defined by the passed Config struct. The passed Options
+// configure the underlying managedMap.
+func NewCustomManagedMultiMap(conf Config, opts ...Option) *managedMultiMap {
+    t := &managedMultiMap{
+        m: NewCustomManagedMap(conf, opts...),
+        keys: make(map[interface{}] []uint64),
+    }
+    t.m.onDrop = t.dropped
+    return t
+}
+
+// Add is a method of a managedMultiMap that appends value to the values of key with the
+// map's default timeout and access count. Adding a value that key already holds stores
+// it again as a separate value with its own timeout and access count. Add will always
+// panic when called after the Close method has been called.
+func (t *managedMultiMap) Add(key, value interface{}) {
+    t.AddCustom(key, value, Config{Timeout: t.m.default_timeout, AccessCount: t.m.default_access, SlideOnAccess: t.m.default_slide, Priority: t.m.default_priority})
+}
+
+// AddCustom is a method of a managedMultiMap that appends value to the values of key with
+// the timeout and access count of the passed Config struct. AddCustom will always panic
+// when called after the Close method has been called.
+func (t *managedMultiMap) AddCustom(key, value interface{}, config Config) {
+    t.m.checkKeyType(key)
+    // A value that can not be serialized is dropped like with Put
+    value, err := t.m.encode(value)
+    if err != nil {
+        return
+    }
+    config = config.resolve()
+    t.m.lock.Lock()
+    defer t.m.unlock()
+    // Panic if managedMultiMap is closed
+    t.m.closed()
+    // Drop the value if the map is in its close grace period
+    if t.m.m == nil {
+        return
+    }
+    id := t.next
+    t.next++
+    t.keys[key] = append(t.keys[key], id)
+    inserted := t.m.insert(multiKey{key, id}, value, config.Timeout, config.Timeout, config.AccessCount)
+    inserted.slide.Store(config.SlideOnAccess)
+    t.m.prioritize(inserted, config.Priority)
+}
+
+// Get is a method of a managedMultiMap that returns every value of key that has not
+// expired or run out of accesses, in the order they were added, consuming one access of
+// each. The returned slice is empty if key has no values. Get will always panic when
+// called after the Close method has been called.
+func (t *managedMultiMap) Get(key interface{}) []interface{} {
+    t.m.checkKeyType(key)
+    t.m.lock.RLock()
+    defer t.m.lock.RUnlock()
+    // Panic if managedMultiMap is closed
+    t.m.closed()
+    values := []interface{}{}
+    for _, id := range t.keys[key] {
+        k := multiKey{key, id}
+        item, has := t.m.m[k]
+        if !has {
+            continue
+        }
+        if value, _, has := t.m.consume(k, item); has {
+            values = append(values, value)
+        }
+    }
+    return values
+}
+
+// Remove is a method of a managedMultiMap that removes key and all of its values. Remove
+// will always panic when called after the Close method has been called.
+func (t *managedMultiMap) Remove(key interface{}) {
+    t.m.checkKeyType(key)
+    t.m.lock.Lock()
+    defer t.m.unlock()
+    // Panic if managedMultiMap is closed
+    t.m.closed()
+    // Dropping a value updates t.keys so iterate over a copy
+    for _, id := range append([]uint64{}, t.keys[key]...) {
+        k := multiKey{key, id}
+        if item, has := t.m.m[k]; has {
+            t.m.drop(k, item, EvictRemoved)
+        }
+    }
+}
+
+// Size is a method of a managedMultiMap that returns the number of keys with at least
+// one stored value. Size will panic when called after the Close method has been called.
+func (t *managedMultiMap) Size() int {
+    t.m.lock.RLock()
+    defer t.m.lock.RUnlock()
+    // Panic if managedMultiMap is closed
+    t.m.closed()
+    return len(t.keys)
+}
+
+// Close is a method of a managedMultiMap that cleans the map the same way as the Close
+// method of a managedMap.
+func (t *managedMultiMap) Close() {
+    t.m.Close()
+    t.m.lock.Lock()
+    defer t.m.unlock()
+    t.keys = make(map[interface{}] []uint64)
+}
+
+// dropped is a private method of a managedMultiMap called by the underlying managedMap
+// whenever a value is deleted. It removes the value from its key, removing the key once
+// it has no values left. The write lock of the underlying managedMap is held.
+func (t *managedMultiMap) dropped(k interface{}) {
+    mk := k.(multiKey)
+    ids := t.keys[mk.key]
+    for i, id := range ids {
+        if id == mk.id {
+            ids = append(ids[:i], ids[i+1:]...)
+            break
+        }
+    }
+    if len(ids) == 0 {
+        delete(t.keys, mk.key)
+        return
+    }
+    t.keys[mk.key] = ids
+}
@@ -0,0 +1,97 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// eviction is a private struct recording an item removed from a map created WithOnEvict
+// until its callback can be called outside the write lock.
+type eviction struct {
+    key interface{}
+    value interface{}
+    reason EvictReason
+}
+
+// WithOnEvict returns an Option that calls onEvict with the key, value and reason of
+// every item that leaves the map: by expiring, running out of accesses or exceeding its
+// maximum lifetime, by being removed explicitly and when the map is closed. Updating
+// the value of an existing key, replacing it with Set, vetoed evictions, moves to
+// another map with MoveEntry and removals with RemoveSilent are not evictions and are
+// never reported. onEvict is called after the write lock has been released, by
+// whichever goroutine released it, so it may call back into the map. As a result a key
+// may already have been re-inserted by the time onEvict runs; use WithOnEvictLocked for
+// a callback that runs before that is possible. A goroutine reports the evictions it
+// takes from the queue in the order they happened, but onEvict can be called
+// concurrently from several goroutines and must be safe for that. When an item expires
+// the callbacks run in a fixed order: the one of WithOnEvictLocked before the item is
+// deleted, then the one of WithOnExpire once it is, both under the write lock, and onEvict
+// last, after the lock is released.
+func WithOnEvict(onEvict func(key, value interface{}, reason EvictReason)) Option {
+    return func(t *managedMap) {
+        t.onEvict = onEvict
+    }
+}
+
+// WithOnEvictLocked returns an Option that calls onEvict for the same evictions as
+// WithOnEvict, but synchronously, for resource cleanup that must see exactly the value
+// being evicted. onEvict is called by the goroutine removing the item, under the same
+// hold of the write lock that removes it and before the item is deleted, so no Put can
+// re-insert the key, and no reader can see it missing, until onEvict has returned. As
+// every other method of the map waits for the lock, onEvict must not call back into
+// the map, which deadlocks, and should return quickly. When both Options are used
+// onEvict runs first and the callback of WithOnEvict later, once the lock is released.
+func WithOnEvictLocked(onEvict func(key, value interface{}, reason EvictReason)) Option {
+    return func(t *managedMap) {
+        t.onEvictLocked = onEvict
+    }
+}
+
+// queueEviction is a private method of a managedMap that records the eviction of the item
+// stored at key, to be reported once the write lock is released, after calling the
+// callback set by WithOnEvictLocked. The caller must hold the write lock.
+func (t *managedMap) queueEviction(key interface{}, it *item, reason EvictReason) {
+    if t.onEvictLocked != nil {
+        t.onEvictLocked(key, t.decode(it.load()), reason)
+    }
+    if t.onEvict == nil {
+        return
+    }
+    t.evictLock.Lock()
+    defer t.evictLock.Unlock()
+    t.evictions = append(t.evictions, eviction{key: key, value: t.decode(it.load()), reason: reason})
+}
+
+// fireEvictions is a private method of a managedMap that calls the eviction callback for
+// every queued eviction. The caller must not hold the write lock.
+func (t *managedMap) fireEvictions() {
+    if t.onEvict == nil {
+        return
+    }
+    t.evictLock.Lock()
+    evictions := t.evictions
+    t.evictions = nil
+    t.evictLock.Unlock()
+    for _, e := range evictions {
+        t.onEvict(e.key, e.value, e.reason)
+    }
+}
+
+// unlock is a private method of a managedMap that releases the write lock and then reports
+// the evictions queued while it was held.
+func (t *managedMap) unlock() {
+    t.lock.Unlock()
+    t.fireEvictions()
+}
+
+// pendingReason is a private method of an item pending deletion that returns the reason
+// it is waiting to be deleted.
+func (i *item) pendingReason() EvictReason {
+    if atomic.LoadUint64(&i.accessRemaining) == 0 {
+        return EvictAccessExhausted
+    }
+    if !i.expires.IsZero() && !time.Now().Before(i.expires) {
+        return EvictLifetimeExceeded
+    }
+    return EvictExpired
+}
@@ -0,0 +1,288 @@
+package ManagedMap
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/gob"
+    "errors"
+    "io"
+    "math"
+    "reflect"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ErrInvalidSnapshot is returned by Load when the data read does not start like a
+// snapshot written by Save.
+var ErrInvalidSnapshot = errors.New("ManagedMap: data is not a ManagedMap snapshot")
+
+// snapshotMagic begins every snapshot written by Save and is followed by a byte holding
+// the Compression of the rest of the snapshot, so Load can detect it.
+const snapshotMagic = "MMAP"
+
+// Compression selects how Save compresses snapshots.
+type Compression byte
+
+const (
+    // NoCompression writes snapshots as plain gob.
+    NoCompression Compression = iota
+    // GzipCompression writes snapshots as gzip compressed gob.
+    GzipCompression
+)
+
+// WithSnapshotCompression is an Option that sets the Compression used by Save, trading
+// CPU for smaller snapshots of large maps. Load detects the compression of a snapshot
+// by itself, so it reads snapshots written with any Compression.
+func WithSnapshotCompression(c Compression) Option {
+    return func(t *managedMap) {
+        t.compression = c
+    }
+}
+
+// registry is a private struct that records the names of the types registered with
+// RegisterType.
+var registry = struct {
+    lock sync.Mutex
+    names map[string] bool
+}{names: make(map[string] bool)}
+
+// RegisterType registers the concrete type of sample with encoding/gob so that keys and
+// values of that type can be written by Save and read back by Load. gob can only encode
+// an interface holding a type it has been told about, so every key and value type other
+// than the basic types must be registered before Save or Load is called, typically in an
+// init function. Registering a type more than once is harmless.
+func RegisterType(sample interface{}) {
+    gob.Register(sample)
+    registry.lock.Lock()
+    defer registry.lock.Unlock()
+    registry.names[reflect.TypeOf(sample).String()] = true
+}
+
+// RegisteredTypes returns the sorted names of the types registered with RegisterType.
+func RegisteredTypes() []string {
+    registry.lock.Lock()
+    defer registry.lock.Unlock()
+    names := make([]string, 0, len(registry.names))
+    for name := range registry.names {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// persistedItem is a private struct holding the state of an item written by Save. A
+// zero Deadline means the item never expires. Value holds the ciphertext of the value
+// when Encrypted is set. Created is when the item was first inserted, which its maximum
+// lifetime counts from, and is zero in snapshots written before it was saved.
+type persistedItem struct {
+    Key interface{}
+    Value interface{}
+    Encrypted bool
+    Timeout time.Duration
+    Deadline time.Time
+    Accesses uint64
+    SlideOnAccess bool
+    Created time.Time
+    Priority int
+    // Uses is the number of times the item was used, which LFU eviction counts. Only
+    // SnapshotFull saves it, so it is zero in snapshots written by Save.
+    Uses uint64
+}
+
+// Save is a method of a managedMap that writes every readable item to w using
+// encoding/gob, along with its timeout, the time it expires and its remaining accesses.
+// The snapshot is compressed as set by WithSnapshotCompression. Pinned items are saved
+// as ordinary items with their full timeout. The items are copied under the read lock
+// and encoded after it is released. Key and value types must be registered with
+// RegisterType. Save will always panic when called after the Close method has been
+// called.
+func (t *managedMap) Save(w io.Writer) error {
+    return writeSnapshot(w, t.compression, t.persisted(true))
+}
+
+// writeSnapshot is a private function that writes items to w as a snapshot compressed
+// with c, in the format Save writes and readSnapshot reads.
+func writeSnapshot(w io.Writer, c Compression, items []persistedItem) error {
+    if _, err := io.WriteString(w, snapshotMagic + string([]byte{byte(c)})); err != nil {
+        return err
+    }
+    if c != GzipCompression {
+        return gob.NewEncoder(w).Encode(items)
+    }
+    zw := gzip.NewWriter(w)
+    if err := gob.NewEncoder(zw).Encode(items); err != nil {
+        return err
+    }
+    return zw.Close()
+}
+
+// persisted is a private method of a managedMap that returns the state of every readable
+// item for Save. Encrypted values are returned as ciphertext when sealed is set and
+// decrypted otherwise.
+func (t *managedMap) persisted(sealed bool) []persistedItem {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    items := make([]persistedItem, 0, len(t.m))
+    for k, v := range t.m {
+        if v.pending() {
+            continue
+        }
+        items = append(items, t.persist(k, v, sealed))
+    }
+    return items
+}
+
+// persist is a private method of a managedMap that returns the state of the item v stored
+// at k, as persisted describes. The caller must hold at least the read lock.
+func (t *managedMap) persist(k interface{}, v *item, sealed bool) persistedItem {
+    item := persistedItem{Key: k, Timeout: v.loadTimeout(), Accesses: atomic.LoadUint64(&v.accessRemaining), SlideOnAccess: v.slide.Load(), Created: v.created, Priority: v.priority}
+    // Encrypted values are saved as they are stored
+    if t.aead != nil && sealed {
+        item.Value, item.Encrypted = v.load(), true
+    } else {
+        item.Value = t.decode(v.load())
+    }
+    if v.loadTimeout() != math.MaxInt64 {
+        item.Deadline = v.deadlineAt()
+        // A pinned item has no timer running, so it is saved with the full timeout it
+        // would get if it were unpinned now
+        if v.pinned.Load() {
+            item.Deadline = time.Now().Add(v.loadTimeout())
+        }
+    }
+    return item
+}
+
+// Load is a method of a managedMap that reads items written by Save from r and stores
+// them, replacing any items already stored at their keys. Each item keeps its remaining
+// accesses and expires at the same time it would have in the saved map, so items whose
+// time ran out while saved are skipped. Items also keep the time they were first
+// inserted, so a maximum lifetime set with WithMaxLifetime counts from then. Every key
+// and value type must be registered with RegisterType before Load is called. Load will
+// always panic when called after the Close method has been called. ErrInvalidSnapshot
+// is returned if r does not hold a snapshot.
+func (t *managedMap) Load(r io.Reader) error {
+    items, err := readSnapshot(r)
+    if err != nil {
+        return err
+    }
+    return t.storePersisted(items)
+}
+
+// readSnapshot is a private function that returns the items of a snapshot written by
+// writeSnapshot, or ErrInvalidSnapshot if r does not hold one.
+func readSnapshot(r io.Reader) ([]persistedItem, error) {
+    br := bufio.NewReader(r)
+    header := make([]byte, len(snapshotMagic) + 1)
+    if _, err := io.ReadFull(br, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+        return nil, ErrInvalidSnapshot
+    }
+    var src io.Reader = br
+    switch Compression(header[len(snapshotMagic)]) {
+    case NoCompression:
+    case GzipCompression:
+        zr, err := gzip.NewReader(br)
+        if err != nil {
+            return nil, err
+        }
+        defer zr.Close()
+        src = zr
+    default:
+        return nil, ErrInvalidSnapshot
+    }
+    var items []persistedItem
+    if err := gob.NewDecoder(src).Decode(&items); err != nil {
+        return nil, err
+    }
+    return items, nil
+}
+
+// storePersisted is a private method of a managedMap that stores items read by Load,
+// replacing any items already stored at their keys and skipping those whose deadline
+// has passed. Each item is stored as the most recently used, so the last of items ends up
+// the most recently used. Nothing is stored if the data of any item can not be restored.
+func (t *managedMap) storePersisted(items []persistedItem) error {
+    // Prepare the data of every item first so nothing is stored if any item fails
+    data := make([]interface{}, len(items))
+    for n, i := range items {
+        var err error
+        if data[n], err = t.restore(i); err != nil {
+            return err
+        }
+    }
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    // Nothing is loaded during the close grace period
+    if t.m == nil {
+        return nil
+    }
+    now := time.Now()
+    for n, i := range items {
+        remaining := time.Duration(math.MaxInt64)
+        if !i.Deadline.IsZero() {
+            if remaining = i.Deadline.Sub(now); remaining <= 0 {
+                continue
+            }
+        }
+        created := i.Created
+        if created.IsZero() {
+            created = now
+        }
+        // Items older than the maximum lifetime are not restored
+        if t.maxLifetime > 0 && !now.Before(created.Add(t.maxLifetime)) {
+            continue
+        }
+        if old, has := t.m[i.Key]; has {
+            t.drop(i.Key, old, EvictRemoved)
+        }
+        inserted := t.insertCreated(i.Key, data[n], i.Timeout, remaining, i.Accesses, created)
+        inserted.slide.Store(i.SlideOnAccess)
+        t.prioritize(inserted, i.Priority)
+        inserted.uses.Store(i.Uses)
+    }
+    return nil
+}
+
+// restore is a private method of a managedMap that returns the data to store for an item
+// read by Load. An encrypted value is stored as it is once it is known to decrypt with
+// the map's key, and ErrDecryption is returned otherwise.
+func (t *managedMap) restore(i persistedItem) (interface{}, error) {
+    if !i.Encrypted {
+        return t.encode(i.Value)
+    }
+    sealed, ok := i.Value.([]byte)
+    if !ok || t.aead == nil {
+        return nil, ErrDecryption
+    }
+    if _, err := t.open(sealed); err != nil {
+        return nil, err
+    }
+    return sealed, nil
+}
+
+// Clone is a method of a managedMap that returns a new, independent managedMap holding
+// every readable item of the map, for inspecting its state without risking changes to
+// it. The items are copied under the read lock like Save, so no accesses are consumed and
+// no timers are touched. Each copy keeps its timeout, remaining time and remaining
+// accesses, and expires on its own timer. The clone has the map's default Config, MaxSize
+// and EvictionPolicy but none of its Options, which can be passed again as opts;
+// encrypted or serialized values are copied decoded. Values themselves are not copied, so
+// a pointer value is shared by both maps. Pinned items are copied as ordinary items with
+// their full timeout. If a value can not be stored in the clone, which only a serializer
+// passed in opts can cause, the clone is closed and the error returned. Clone will always
+// panic when called after the Close method has been called.
+func (t *managedMap) Clone(opts ...Option) (*managedMap, error) {
+    items := t.persisted(false)
+    clone := NewCustomManagedMap(Config{Timeout: t.default_timeout, AccessCount: t.default_access, SlideOnAccess: t.default_slide, Priority: t.default_priority, MaxSize: int(t.maxSize.Load()), EvictionPolicy: t.policy}, opts...)
+    if err := clone.storePersisted(items); err != nil {
+        clone.Close()
+        return nil, err
+    }
+    return clone, nil
+}
@@ -0,0 +1,277 @@
+package ManagedMap
+
+import (
+    "container/heap"
+    "math"
+    "sync"
+    "time"
+)
+
+// scheduleEntry is a private struct that records when the scheduler should expire an
+// item and which map the item belongs to. index is the entry's position in the
+// scheduler's heap, or -1 when the entry is not scheduled.
+type scheduleEntry struct {
+    deadline time.Time
+    owner *managedMap
+    key interface{}
+    item *item
+    index int
+}
+
+// scheduleHeap is a private min-heap of scheduleEntry ordered by deadline.
+type scheduleHeap []*scheduleEntry
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h scheduleHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index = i
+    h[j].index = j
+}
+func (h *scheduleHeap) Push(x interface{}) {
+    entry := x.(*scheduleEntry)
+    entry.index = len(*h)
+    *h = append(*h, entry)
+}
+func (h *scheduleHeap) Pop() interface{} {
+    old := *h
+    entry := old[len(old) - 1]
+    old[len(old) - 1] = nil
+    entry.index = -1
+    *h = old[:len(old) - 1]
+    return entry
+}
+
+// Scheduler manages the expiry of items for any number of managedMaps with a single
+// goroutine and a single timer, driven by a min-heap of deadlines. Every map expires its
+// items with a private Scheduler, started and stopped with the map, unless a Scheduler
+// is shared between maps with the WithSharedScheduler Option. Either way items do not
+// have their own timers or goroutines. This bounds the number of goroutines used for
+// expiry regardless of how many items exist. A shared Scheduler does nothing until Start
+// is called and must be stopped with Stop once it is no longer needed. Items of
+// participating maps do not expire while the Scheduler is stopped.
+type Scheduler struct {
+    lock sync.Mutex
+    entries scheduleHeap
+    wake chan struct{}
+    stop chan struct{}
+    batchTick time.Duration
+}
+
+// SchedulerOption is a function that configures optional behavior of a Scheduler.
+// SchedulerOptions are passed to NewScheduler and are applied in order.
+type SchedulerOption func(*Scheduler)
+
+// WithBatchTick returns a SchedulerOption that makes the Scheduler expire items in
+// batches, waking at most once every d. All entries that are due when it wakes are
+// grouped by map and each map deletes its whole group under a single hold of its write
+// lock, so a mass expiry costs one lock acquisition per map and tick rather than one per
+// item. The tradeoff is precision: an item is deleted up to d after its deadline.
+func WithBatchTick(d time.Duration) SchedulerOption {
+    return func(s *Scheduler) {
+        if d > 0 {
+            s.batchTick = d
+        }
+    }
+}
+
+// NewScheduler returns a pointer to a stopped Scheduler configured by the passed
+// SchedulerOptions.
+func NewScheduler(opts ...SchedulerOption) *Scheduler {
+    s := &Scheduler{
+        wake: make(chan struct{}, 1),
+    }
+    for _, opt := range opts {
+        opt(s)
+    }
+    return s
+}
+
+// Start is a method of a Scheduler that starts the goroutine expiring items. Calling
+// Start on a running Scheduler does nothing.
+func (s *Scheduler) Start() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.stop != nil {
+        return
+    }
+    s.stop = make(chan struct{})
+    go s.run(s.stop)
+}
+
+// Stop is a method of a Scheduler that stops the goroutine expiring items. Items that
+// are scheduled stay scheduled and expire once the Scheduler is started again. Calling
+// Stop on a stopped Scheduler does nothing.
+func (s *Scheduler) Stop() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.stop == nil {
+        return
+    }
+    close(s.stop)
+    s.stop = nil
+}
+
+// WithPerItemTimers returns an Option that gives every item with a finite timeout its own
+// timer and a goroutine waiting on it, as maps did before they expired their items with
+// a private Scheduler by default. Each item is deleted by its own goroutine, so expiries
+// do not queue behind each other, at the cost of one parked goroutine per item. It has
+// no effect together with WithSharedScheduler, WithTTLResolution or WithManualExpiry.
+func WithPerItemTimers() Option {
+    return func(t *managedMap) {
+        t.perItemTimers = true
+    }
+}
+
+// WithSharedScheduler is an Option that hands the expiry of the map's items to the passed
+// Scheduler, which may be shared with other maps. The Scheduler dispatches each expiry
+// back to the owning map, which deletes the item under its own write lock. When this
+// Option is used a TTL resolution is ignored.
+func WithSharedScheduler(s *Scheduler) Option {
+    return func(t *managedMap) {
+        t.scheduler = s
+    }
+}
+
+// schedule is a private method of a Scheduler that (re)schedules the expiry of the item
+// stored at key in owner for the item's deadline. The caller must hold the owner's
+// write lock.
+func (s *Scheduler) schedule(owner *managedMap, key interface{}, it *item) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    entry := it.scheduled
+    if entry == nil {
+        entry = &scheduleEntry{owner: owner, key: key, item: it, index: -1}
+        it.scheduled = entry
+    }
+    entry.deadline = it.deadlineAt()
+    if entry.index < 0 {
+        heap.Push(&s.entries, entry)
+    } else {
+        heap.Fix(&s.entries, entry.index)
+    }
+    // Wake the goroutine if it is now sleeping past the earliest deadline
+    if entry.index == 0 {
+        select {
+        case s.wake <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// cancel is a private method of a Scheduler that stops the expiry of an item. The
+// caller must hold the owning map's write lock.
+func (s *Scheduler) cancel(it *item) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if entry := it.scheduled; entry != nil && entry.index >= 0 {
+        heap.Remove(&s.entries, entry.index)
+    }
+}
+
+// run is a private method of a Scheduler run in its goroutine. It sleeps until the
+// earliest deadline, then dispatches every due entry to its owning map. With a batch
+// tick a new earliest deadline only shortens the sleep down to the end of the tick, so
+// batches are never dispatched more often than once every tick. The scheduler's lock is
+// never held while a map's lock is acquired.
+func (s *Scheduler) run(stop chan struct{}) {
+    timer := time.NewTimer(math.MaxInt64)
+    defer timer.Stop()
+    for {
+        s.lock.Lock()
+        now := time.Now()
+        due := []*scheduleEntry{}
+        for len(s.entries) > 0 && !s.entries[0].deadline.After(now) {
+            due = append(due, heap.Pop(&s.entries).(*scheduleEntry))
+        }
+        wait := time.Duration(math.MaxInt64)
+        if len(s.entries) > 0 {
+            wait = time.Until(s.entries[0].deadline)
+        }
+        s.lock.Unlock()
+        if s.batchTick > 0 {
+            s.expireBatches(due)
+            if wait < s.batchTick {
+                wait = s.batchTick
+            }
+        } else {
+            for _, entry := range due {
+                entry.owner.expire(entry.key, entry.item)
+            }
+        }
+        timer.Reset(wait)
+        tick := time.Now().Add(s.batchTick)
+        if !s.sleep(stop, timer, tick) {
+            return
+        }
+    }
+}
+
+// sleep is a private method of a Scheduler that waits on timer until it fires or, without
+// a batch tick, until a new earliest deadline wakes the Scheduler. With a batch tick a
+// wake moves the timer to the new earliest deadline but not before tick. sleep returns
+// false once stop is closed.
+func (s *Scheduler) sleep(stop chan struct{}, timer *time.Timer, tick time.Time) bool {
+    for {
+        select {
+        case <-stop:
+            return false
+        case <-timer.C:
+            return true
+        case <-s.wake:
+            if s.batchTick <= 0 {
+                return true
+            }
+            s.lock.Lock()
+            wait := time.Until(tick)
+            if len(s.entries) > 0 {
+                wait = max(wait, time.Until(s.entries[0].deadline))
+            }
+            s.lock.Unlock()
+            timer.Reset(wait)
+        }
+    }
+}
+
+// expireBatches is a private method of a Scheduler that dispatches due entries to their
+// owning maps grouped by map, in the order the maps first appear among them.
+func (s *Scheduler) expireBatches(due []*scheduleEntry) {
+    owners := []*managedMap{}
+    batches := make(map[*managedMap] []*scheduleEntry)
+    for _, entry := range due {
+        if _, has := batches[entry.owner]; !has {
+            owners = append(owners, entry.owner)
+        }
+        batches[entry.owner] = append(batches[entry.owner], entry)
+    }
+    for _, owner := range owners {
+        owner.expireBatch(batches[owner])
+    }
+}
+
+// expireBatch is a private method of a managedMap called by a batching Scheduler with
+// every entry of the map that is due. Each item is only deleted if it is still stored at
+// its key and still due once the write lock is acquired.
+func (t *managedMap) expireBatch(entries []*scheduleEntry) {
+    t.lock.Lock()
+    defer t.unlock()
+    if t.m == nil {
+        return
+    }
+    for _, entry := range entries {
+        if t.m[entry.key] == entry.item && t.due(entry.item) {
+            t.evict(entry.key, entry.item, EvictExpired)
+        }
+    }
+}
+
+// expire is a private method of a managedMap called by a Scheduler when the item stored
+// at key is due. The item is only deleted if it is still stored at key and still due
+// once the write lock is acquired.
+func (t *managedMap) expire(key interface{}, it *item) {
+    t.lock.Lock()
+    defer t.unlock()
+    if t.m != nil && t.m[key] == it && t.due(it) {
+        t.evict(key, it, EvictExpired)
+    }
+}
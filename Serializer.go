@@ -0,0 +1,68 @@
+package ManagedMap
+
+import (
+    "fmt"
+)
+
+// WithSerializer is an Option that stores every value as the []byte returned by marshal
+// and turns it back into a value with unmarshal whenever it is read, trading CPU for
+// fewer live objects on the heap and less garbage collector scanning in maps holding
+// large values. Values handed to callbacks such as the write-back function, the evict
+// veto and the functions of TransformAll and UpdateIfStale are unmarshaled first, so the
+// serialization is invisible apart from the cost. The size checked by WithMaxValueSize is
+// the size of the marshaled bytes. PutCustom and Put drop values that fail to marshal
+// while PutChecked returns the error. A value that fails to unmarshal, or a value
+// returned by a callback that fails to marshal, causes a panic. IncrementCapped requires
+// unmarshal to return an int64 for a marshaled int64.
+func WithSerializer(marshal func(value interface{}) ([]byte, error), unmarshal func(data []byte) (interface{}, error)) Option {
+    return func(t *managedMap) {
+        t.marshal = marshal
+        t.unmarshal = unmarshal
+    }
+}
+
+// encode is a private method of a managedMap that returns the data stored for value,
+// which is the value itself unless a serializer is configured.
+func (t *managedMap) encode(value interface{}) (interface{}, error) {
+    if t.marshal == nil {
+        return value, nil
+    }
+    data, err := t.marshal(value)
+    if err != nil {
+        return nil, err
+    }
+    if t.aead != nil {
+        return t.seal(data), nil
+    }
+    return data, nil
+}
+
+// mustEncode is a private method of a managedMap that works like encode but panics if the
+// value can not be marshaled.
+func (t *managedMap) mustEncode(value interface{}) interface{} {
+    data, err := t.encode(value)
+    if err != nil {
+        panic(fmt.Sprintf("ManagedMap: could not marshal value of type %T: %v", value, err))
+    }
+    return data
+}
+
+// decode is a private method of a managedMap that returns the value stored as data,
+// panicking if it can not be decrypted or unmarshaled.
+func (t *managedMap) decode(data interface{}) interface{} {
+    if t.unmarshal == nil {
+        return data
+    }
+    raw := data.([]byte)
+    if t.aead != nil {
+        var err error
+        if raw, err = t.open(raw); err != nil {
+            panic(err.Error())
+        }
+    }
+    value, err := t.unmarshal(raw)
+    if err != nil {
+        panic(fmt.Sprintf("ManagedMap: could not unmarshal value: %v", err))
+    }
+    return value
+}
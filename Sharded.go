@@ -0,0 +1,906 @@
+package ManagedMap
+
+import (
+    "context"
+    "errors"
+    "hash/maphash"
+    "io"
+    "sync"
+    "time"
+)
+
+// DefaultShardCount is the number of shards a shardedMap is split into when the ShardCount
+// of its Config is not positive.
+const DefaultShardCount = 16
+
+// shardedMap is a private struct that splits its keys between a number of independent
+// managedMaps, each with its own lock. Keys are hashed to pick their shard, so writers of
+// keys in different shards never wait for each other and a write only blocks the readers
+// of its own shard. Every shard runs the same managedMap machinery, including its own
+// expiry, so items behave exactly as they would in a single managedMap. The shards only
+// change when Reshard holds the write lock, so every other method holds the read lock.
+// Methods operating on a single key are passed to its shard, and methods operating on
+// many keys visit the shards one after another. Methods that rely on a single lock or a
+// single order across every item, such as WithLock, Sample, ForEachByDeadline,
+// CloseOrdered, SnapshotFull and Clone, are only offered by the managedMap of each shard.
+// As with a managedMap, users are required to make use of the provided methods.
+type shardedMap struct {
+    lock sync.RWMutex
+    shards []*managedMap
+    seed maphash.Seed
+    ring *hashRing
+    conf Config
+    opts []Option
+}
+
+// NewShardedManagedMap returns a pointer to a shardedMap of DefaultShardCount shards with
+// the default timeout and accessCount as defined by the DefaultTimeout and
+// DefaultAccessCount constants. The passed Options configure every shard.
+func NewShardedManagedMap(opts ...Option) *shardedMap {
+    return NewCustomShardedManagedMap(Config{Timeout: DefaultTimeout, AccessCount: DefaultAccessCount}, opts...)
+}
+
+// NewCustomShardedManagedMap returns a pointer to a shardedMap of ShardCount shards whose
+// items default to the timeout and accessCount defined by the passed Config struct. The
+// passed Options are applied to every shard separately, so Options such as
+// WithMetricsInterval or WithMaxGoroutines act per shard. A MaxSize is split evenly between
+// the shards, rounding up, and each shard evicts its own least recently used items. Keys
+// are spread by the modulo of their hash unless WithConsistentHashing is passed.
+func NewCustomShardedManagedMap(conf Config, opts ...Option) *shardedMap {
+    count := conf.ShardCount
+    if count <= 0 {
+        count = DefaultShardCount
+    }
+    t := &shardedMap{
+        shards: make([]*managedMap, count),
+        seed: maphash.MakeSeed(),
+        conf: conf,
+        opts: opts,
+    }
+    shardConf := t.shardConf(count)
+    for i := range t.shards {
+        t.shards[i] = NewCustomManagedMap(shardConf, opts...)
+    }
+    if nodes := t.shards[0].virtualNodes; nodes > 0 {
+        t.ring = newHashRing(t.seed, count, nodes)
+    }
+    return t
+}
+
+// shardConf is a private method of a shardedMap that returns the Config of each of count
+// shards, whose MaxSize is the map's MaxSize split evenly between them, rounding up.
+func (t *shardedMap) shardConf(count int) Config {
+    conf := t.conf
+    // Each shard is a single managedMap
+    conf.ShardCount = 0
+    if conf.MaxSize > 0 {
+        conf.MaxSize = (conf.MaxSize + count - 1) / count
+    }
+    return conf
+}
+
+// resize is a private function that sets the MaxSize of every shard of shards created
+// with a MaxSize to size. A shard left holding more items than size evicts the extra
+// ones on its next insert.
+func resize(shards []*managedMap, size int) {
+    for _, shard := range shards {
+        if shard.lru != nil {
+            shard.maxSize.Store(int64(size))
+        }
+    }
+}
+
+// shard is a private method of a shardedMap that returns the shard holding key. The caller
+// must hold the read lock.
+func (t *shardedMap) shard(key interface{}) *managedMap {
+    // Check the key before hashing so WithKeyTypeCheck names the offending type
+    t.shards[0].checkKeyType(key)
+    hash := maphash.Comparable(t.seed, key)
+    if t.ring != nil {
+        return t.shards[t.ring.lookup(hash)]
+    }
+    return t.shards[hash % uint64(len(t.shards))]
+}
+
+// Get is a method of a shardedMap that returns the value associated with key and whether
+// it exists, like the Get method of a managedMap. Get will always panic when called after
+// the Close method has been called.
+func (t *shardedMap) Get(key interface{}) (interface{}, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Get(key)
+}
+
+// Peek is a method of a shardedMap that returns the value associated with key without
+// consuming an access, like the Peek method of a managedMap. Peek will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) Peek(key interface{}) (interface{}, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Peek(key)
+}
+
+// Put is a method of a shardedMap that inserts or updates key with the map's default
+// timeout and access count. Put will always panic when called after the Close method has
+// been called.
+func (t *shardedMap) Put(key, value interface{}) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    t.shard(key).Put(key, value)
+}
+
+// PutCustom is a method of a shardedMap that inserts or updates key with the timeout and
+// access count of the passed Config struct. Its ShardCount is ignored. PutCustom will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) PutCustom(key, value interface{}, config Config) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    t.shard(key).PutCustom(key, value, config)
+}
+
+// Has is a method of a shardedMap that returns whether key exists without consuming an
+// access. Has will always panic when called after the Close method has been called.
+func (t *shardedMap) Has(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Has(key)
+}
+
+// Remove is a method of a shardedMap that removes key if it exists. Remove will always
+// panic when called after the Close method has been called.
+func (t *shardedMap) Remove(key interface{}) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    t.shard(key).Remove(key)
+}
+
+// RemoveSilent is a method of a shardedMap that removes key if it exists, without
+// reporting an eviction, and returns whether it existed. RemoveSilent will always panic
+// when called after the Close method has been called.
+func (t *shardedMap) RemoveSilent(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).RemoveSilent(key)
+}
+
+// Size is a method of a shardedMap that returns the number of items across all shards.
+// The shards are counted one after another, so the result is not a snapshot of a single
+// moment while other goroutines write. Size will always panic when called after the Close
+// method has been called.
+func (t *shardedMap) Size() int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    size := 0
+    for _, shard := range t.shards {
+        size += shard.Size()
+    }
+    return size
+}
+
+// Close is a method of a shardedMap that closes every shard. As with a managedMap the
+// shardedMap must be closed before it can be garbage collected and every method other
+// than Close panics afterwards.
+func (t *shardedMap) Close() {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    for _, shard := range t.shards {
+        shard.Close()
+    }
+}
+
+// Reshard is a method of a shardedMap that changes the number of shards to count,
+// DefaultShardCount when not positive, moving every item whose key now belongs to another
+// shard with MoveEntry, so it keeps its value, remaining timeout and remaining accesses.
+// With WithConsistentHashing only the keys of the shards that were added or removed move,
+// otherwise nearly every key does. New shards are created with the map's Config and
+// Options and removed shards are closed once they are empty. A MaxSize is split again
+// between the new number of shards, so the map as a whole keeps the MaxSize it was
+// created with and fewer shards hold more items each; only a shard that ends up with more
+// than its share evicts. The write lock is held for the whole move, so every other method
+// waits for it and no caller sees a key missing or stored twice. Reshard will always panic
+// when called after the Close method has been called.
+func (t *shardedMap) Reshard(count int) {
+    if count <= 0 {
+        count = DefaultShardCount
+    }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    // Panic if shardedMap is closed
+    t.shards[0].closed()
+    if count == len(t.shards) {
+        return
+    }
+    old := t.shards
+    shards := make([]*managedMap, count)
+    copy(shards, old)
+    conf := t.shardConf(count)
+    for i := len(old); i < count; i++ {
+        shards[i] = NewCustomManagedMap(conf, t.opts...)
+    }
+    // Kept shards grow before the move so they have room for the items of removed shards,
+    // and shrink after it once their items have moved to the new shards
+    if count < len(old) {
+        resize(shards, conf.MaxSize)
+    } else {
+        defer resize(old, conf.MaxSize)
+    }
+    t.shards = shards
+    if t.ring != nil {
+        t.ring = newHashRing(t.seed, count, t.ring.virtualNodes)
+    }
+    for _, src := range old {
+        for _, key := range src.Keys() {
+            if dst := t.shard(key); dst != src {
+                MoveEntry(src, dst, key)
+            }
+        }
+    }
+    for _, removed := range old[min(count, len(old)):] {
+        removed.Close()
+    }
+}
+
+// group is a private method of a shardedMap that splits keys by the shard holding them,
+// keeping their order within each shard. The caller must hold the read lock.
+func (t *shardedMap) group(keys []interface{}) map[*managedMap][]interface{} {
+    groups := make(map[*managedMap][]interface{})
+    for _, key := range keys {
+        shard := t.shard(key)
+        groups[shard] = append(groups[shard], key)
+    }
+    return groups
+}
+
+// Contains is a method of a shardedMap that returns whether key exists without consuming
+// an access, like the Contains method of a managedMap. Contains will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) Contains(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Contains(key)
+}
+
+// GetChecked is a method of a shardedMap that works like Get but reports a type mismatch
+// as an error, like the GetChecked method of a managedMap. GetChecked will always panic
+// when called after the Close method has been called.
+func (t *shardedMap) GetChecked(key interface{}) (interface{}, bool, error) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetChecked(key)
+}
+
+// GetN is a method of a shardedMap that consumes n accesses of key at once, like the GetN
+// method of a managedMap. GetN will always panic when called after the Close method has
+// been called.
+func (t *shardedMap) GetN(key interface{}, n uint64) (interface{}, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetN(key, n)
+}
+
+// GetAndRemaining is a method of a shardedMap that returns the value of key along with
+// its remaining accesses, like the GetAndRemaining method of a managedMap.
+// GetAndRemaining will always panic when called after the Close method has been called.
+func (t *shardedMap) GetAndRemaining(key interface{}) (value interface{}, remaining uint64, ok bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetAndRemaining(key)
+}
+
+// PeekFresh is a method of a shardedMap that returns the value of key without consuming
+// an access if it has not expired, like the PeekFresh method of a managedMap. PeekFresh
+// will always panic when called after the Close method has been called.
+func (t *shardedMap) PeekFresh(key interface{}) (interface{}, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).PeekFresh(key)
+}
+
+// GetCtx is a method of a shardedMap that works like the GetCtx method of a managedMap on
+// the shard holding key. GetCtx will always panic when called after the Close method has
+// been called.
+func (t *shardedMap) GetCtx(ctx context.Context, key interface{}) (interface{}, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetCtx(ctx, key)
+}
+
+// GetContext is a method of a shardedMap that works like the GetContext method of a
+// managedMap on the shard holding key. GetContext will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) GetContext(ctx context.Context, key interface{}) (interface{}, bool, error) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetContext(ctx, key)
+}
+
+// PutContext is a method of a shardedMap that works like the PutContext method of a
+// managedMap on the shard holding key. PutContext will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) PutContext(ctx context.Context, key, value interface{}, config Config) error {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).PutContext(ctx, key, value, config)
+}
+
+// GetLoad is a method of a shardedMap that returns the value of key, loading it with the
+// shard's Loader when it is missing, like the GetLoad method of a managedMap. Concurrent
+// loads of a key are coalesced by the Group of its shard. GetLoad will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) GetLoad(ctx context.Context, key interface{}) (interface{}, error) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetLoad(ctx, key)
+}
+
+// GetAsync is a method of a shardedMap that works like the GetAsync method of a
+// managedMap on the shard holding key. A load still running when Reshard moves keys
+// stores its value in the shard the key belonged to when GetAsync was called. GetAsync
+// will always panic when called after the Close method has been called.
+func (t *shardedMap) GetAsync(key interface{}) <-chan Result {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetAsync(key)
+}
+
+// PutChecked is a method of a shardedMap that works like PutCustom but reports a type
+// mismatch as an error, like the PutChecked method of a managedMap. PutChecked will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) PutChecked(key, value interface{}, config Config) error {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).PutChecked(key, value, config)
+}
+
+// GetOrPut is a method of a shardedMap that returns the value of key if it exists and
+// stores value otherwise, like the GetOrPut method of a managedMap. GetOrPut will always
+// panic when called after the Close method has been called.
+func (t *shardedMap) GetOrPut(key, value interface{}, config Config) (actual interface{}, loaded bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetOrPut(key, value, config)
+}
+
+// GetOrCompute is a method of a shardedMap that returns the value of key if it exists and
+// stores the result of fn otherwise, like the GetOrCompute method of a managedMap. fn
+// must not call back into the shardedMap. GetOrCompute will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) GetOrCompute(key interface{}, fn func() (interface{}, Config)) (actual interface{}, loaded bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).GetOrCompute(key, fn)
+}
+
+// Set is a method of a shardedMap that works like the Set method of a managedMap on the
+// shard holding key. Set will always panic when called after the Close method has been
+// called.
+func (t *shardedMap) Set(key, value interface{}, config Config) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    t.shard(key).Set(key, value, config)
+}
+
+// TryGet is a method of a shardedMap that works like Get but returns ErrClosed instead of
+// panicking once the map is closed, like the TryGet method of a managedMap.
+func (t *shardedMap) TryGet(key interface{}) (value interface{}, has bool, err error) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).TryGet(key)
+}
+
+// TryPut is a method of a shardedMap that works like Put but returns ErrClosed instead of
+// panicking once the map is closed, like the TryPut method of a managedMap.
+func (t *shardedMap) TryPut(key, value interface{}) error {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).TryPut(key, value)
+}
+
+// Touch is a method of a shardedMap that re-arms the timer of key, like the Touch method
+// of a managedMap. Touch will always panic when called after the Close method has been
+// called.
+func (t *shardedMap) Touch(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Touch(key)
+}
+
+// Extend is a method of a shardedMap that adds d to the remaining time of key, like the
+// Extend method of a managedMap. Extend will always panic when called after the Close
+// method has been called.
+func (t *shardedMap) Extend(key interface{}, d time.Duration) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Extend(key, d)
+}
+
+// Pin is a method of a shardedMap that pins the item of key, like the Pin method of a
+// managedMap. A pinned item stays pinned when Reshard moves it. Pin will always panic
+// when called after the Close method has been called.
+func (t *shardedMap) Pin(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Pin(key)
+}
+
+// Unpin is a method of a shardedMap that unpins the item of key, like the Unpin method of
+// a managedMap. Unpin will always panic when called after the Close method has been
+// called.
+func (t *shardedMap) Unpin(key interface{}) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    t.shard(key).Unpin(key)
+}
+
+// ResetAccess is a method of a shardedMap that restores the access count of key, like the
+// ResetAccess method of a managedMap. ResetAccess will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) ResetAccess(key interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).ResetAccess(key)
+}
+
+// SetAccessCount is a method of a shardedMap that sets the remaining accesses of key,
+// like the SetAccessCount method of a managedMap. SetAccessCount will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) SetAccessCount(key interface{}, count uint64) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).SetAccessCount(key, count)
+}
+
+// UpdateIfStale is a method of a shardedMap that works like the UpdateIfStale method of a
+// managedMap on the shard holding key. fn must not call back into the shardedMap.
+// UpdateIfStale will always panic when called after the Close method has been called.
+func (t *shardedMap) UpdateIfStale(key interface{}, staleThreshold time.Duration, fn func(old interface{}) interface{}) bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).UpdateIfStale(key, staleThreshold, fn)
+}
+
+// IncrementCapped is a method of a shardedMap that works like the IncrementCapped method
+// of a managedMap on the shard holding key. IncrementCapped will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) IncrementCapped(key interface{}, delta, cap int64, window time.Duration) (int64, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).IncrementCapped(key, delta, cap, window)
+}
+
+// Age is a method of a shardedMap that returns how long ago key was inserted, like the
+// Age method of a managedMap. Moving a key with Reshard does not reset its age. Age will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) Age(key interface{}) (time.Duration, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Age(key)
+}
+
+// TimeToLive is a method of a shardedMap that returns the remaining time of key, like the
+// TimeToLive method of a managedMap. TimeToLive will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) TimeToLive(key interface{}) (time.Duration, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).TimeToLive(key)
+}
+
+// AccessesRemaining is a method of a shardedMap that returns the remaining accesses of
+// key, like the AccessesRemaining method of a managedMap. AccessesRemaining will always
+// panic when called after the Close method has been called.
+func (t *shardedMap) AccessesRemaining(key interface{}) (uint64, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).AccessesRemaining(key)
+}
+
+// Status is a method of a shardedMap that returns the state of the item of key, like the
+// Status method of a managedMap. Status will always panic when called after the Close
+// method has been called.
+func (t *shardedMap) Status(key interface{}) EntryStatus {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).Status(key)
+}
+
+// FlushKey is a method of a shardedMap that flushes the item of key if it is dirty, like
+// the FlushKey method of a managedMap. FlushKey will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) FlushKey(key interface{}) error {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shard(key).FlushKey(key)
+}
+
+// GetMany is a method of a shardedMap that looks up every key of keys like the GetMany
+// method of a managedMap. The keys of each shard are read under a single hold of that
+// shard's lock, but the shards are read one after another, so the result is not a
+// snapshot of a single moment. GetMany will always panic when called after the Close
+// method has been called.
+func (t *shardedMap) GetMany(keys []interface{}) map[interface{}]interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    values := make(map[interface{}]interface{})
+    for shard, keys := range t.group(keys) {
+        for k, v := range shard.GetMany(keys) {
+            values[k] = v
+        }
+    }
+    return values
+}
+
+// SnapshotKeys is a method of a shardedMap that returns the values of the passed keys
+// without consuming accesses, like the SnapshotKeys method of a managedMap. Only the keys
+// of a single shard are read as one consistent view. SnapshotKeys will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) SnapshotKeys(keys ...interface{}) map[interface{}]interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    values := make(map[interface{}]interface{})
+    for shard, keys := range t.group(keys) {
+        for k, v := range shard.SnapshotKeys(keys...) {
+            values[k] = v
+        }
+    }
+    return values
+}
+
+// GetOrComputeMany is a method of a shardedMap that works like the GetOrComputeMany method
+// of a managedMap, except that compute is called once for each shard with missing keys,
+// with the missing keys of that shard. compute must not call back into the shardedMap.
+// GetOrComputeMany will always panic when called after the Close method has been called.
+func (t *shardedMap) GetOrComputeMany(keys []interface{}, compute func(missing []interface{}) map[interface{}]interface{}) map[interface{}]interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    values := make(map[interface{}]interface{})
+    for shard, keys := range t.group(keys) {
+        for k, v := range shard.GetOrComputeMany(keys, compute) {
+            values[k] = v
+        }
+    }
+    return values
+}
+
+// PutMany is a method of a shardedMap that inserts or updates every entry with the
+// timeout and access count of config, like the PutMany method of a managedMap. The
+// entries of each shard are stored under a single hold of that shard's lock. PutMany will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) PutMany(entries map[interface{}]interface{}, config Config) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    groups := make(map[*managedMap]map[interface{}]interface{})
+    for k, v := range entries {
+        shard := t.shard(k)
+        if groups[shard] == nil {
+            groups[shard] = make(map[interface{}]interface{})
+        }
+        groups[shard][k] = v
+    }
+    for shard, entries := range groups {
+        shard.PutMany(entries, config)
+    }
+}
+
+// RemoveMany is a method of a shardedMap that removes every key of keys and returns how
+// many existed, like the RemoveMany method of a managedMap. RemoveMany will always panic
+// when called after the Close method has been called.
+func (t *shardedMap) RemoveMany(keys []interface{}) int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    removed := 0
+    for shard, keys := range t.group(keys) {
+        removed += shard.RemoveMany(keys)
+    }
+    return removed
+}
+
+// TouchAll is a method of a shardedMap that re-arms the timer of every key of keys and
+// returns how many were touched, like the TouchAll method of a managedMap. TouchAll will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) TouchAll(keys ...interface{}) int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    touched := 0
+    for shard, keys := range t.group(keys) {
+        touched += shard.TouchAll(keys...)
+    }
+    return touched
+}
+
+// Keys is a method of a shardedMap that returns the keys of every readable item across
+// all shards, in no particular order. The shards are listed one after another like Size.
+// Keys will always panic when called after the Close method has been called.
+func (t *shardedMap) Keys() []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    keys := []interface{}{}
+    for _, shard := range t.shards {
+        keys = append(keys, shard.Keys()...)
+    }
+    return keys
+}
+
+// Values is a method of a shardedMap that returns the values of every readable item
+// across all shards, in no particular order. The shards are listed one after another like
+// Size. Values will always panic when called after the Close method has been called.
+func (t *shardedMap) Values() []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    values := []interface{}{}
+    for _, shard := range t.shards {
+        values = append(values, shard.Values()...)
+    }
+    return values
+}
+
+// Range is a method of a shardedMap that calls fn for every readable item across all
+// shards, in no particular order, stopping early if fn returns false, like the Range
+// method of a managedMap. The items are copied before fn is first called and no lock is
+// held while it runs, so fn may call any method of the map, including Reshard. Range will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) Range(fn func(key, value interface{}) bool) {
+    type entry struct {
+        key interface{}
+        value interface{}
+    }
+    var entries []entry
+    t.lock.RLock()
+    for _, shard := range t.shards {
+        shard.Range(func(key, value interface{}) bool {
+            entries = append(entries, entry{key, value})
+            return true
+        })
+    }
+    t.lock.RUnlock()
+    for _, e := range entries {
+        if !fn(e.key, e.value) {
+            return
+        }
+    }
+}
+
+// LiveSize is a method of a shardedMap that returns the number of readable items across
+// all shards, like the LiveSize method of a managedMap. The shards are counted one after
+// another like Size. LiveSize will always panic when called after the Close method has
+// been called.
+func (t *shardedMap) LiveSize() int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    size := 0
+    for _, shard := range t.shards {
+        size += shard.LiveSize()
+    }
+    return size
+}
+
+// Clear is a method of a shardedMap that removes every item of every shard, like the
+// Clear method of a managedMap. The shards are cleared one after another, so an item
+// written to a shard that was already cleared is kept. Clear will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) Clear() {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    for _, shard := range t.shards {
+        shard.Clear()
+    }
+}
+
+// SwapOut is a method of a shardedMap that swaps every shard for an empty one and returns
+// the values of every item that was readable, like the SwapOut method of a managedMap.
+// The shards are swapped one after another, so each item is returned exactly once but the
+// result is not a snapshot of a single moment. SwapOut will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) SwapOut() map[interface{}]interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    values := make(map[interface{}]interface{})
+    for _, shard := range t.shards {
+        for k, v := range shard.SwapOut() {
+            values[k] = v
+        }
+    }
+    return values
+}
+
+// EvictWhere is a method of a shardedMap that removes every item for which pred returns
+// true and returns how many were removed, like the EvictWhere method of a managedMap.
+// pred must not call back into the shardedMap. EvictWhere will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) EvictWhere(pred func(key, value interface{}) bool) int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    evicted := 0
+    for _, shard := range t.shards {
+        evicted += shard.EvictWhere(pred)
+    }
+    return evicted
+}
+
+// EvictExpired is a method of a shardedMap that removes every item of every shard that
+// has run out of time or accesses, like the EvictExpired method of a managedMap, and
+// returns how many were removed. EvictExpired will always panic when called after the
+// Close method has been called.
+func (t *shardedMap) EvictExpired() int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    evicted := 0
+    for _, shard := range t.shards {
+        evicted += shard.EvictExpired()
+    }
+    return evicted
+}
+
+// TransformAll is a method of a shardedMap that replaces the value of every item with the
+// result of fn, like the TransformAll method of a managedMap. Each shard holds its write
+// lock only while its own items are transformed. fn must not call back into the
+// shardedMap. TransformAll will always panic when called after the Close method has been
+// called.
+func (t *shardedMap) TransformAll(fn func(key, value interface{}) interface{}) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    for _, shard := range t.shards {
+        shard.TransformAll(fn)
+    }
+}
+
+// OlderThan is a method of a shardedMap that returns the keys of every item inserted more
+// than d ago across all shards, like the OlderThan method of a managedMap. OlderThan will
+// always panic when called after the Close method has been called.
+func (t *shardedMap) OlderThan(d time.Duration) []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    keys := []interface{}{}
+    for _, shard := range t.shards {
+        keys = append(keys, shard.OlderThan(d)...)
+    }
+    return keys
+}
+
+// PendingDeletion is a method of a shardedMap that returns the keys of every item across
+// all shards whose accesses have run out but that has not yet been deleted, like the
+// PendingDeletion method of a managedMap. PendingDeletion will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) PendingDeletion() []interface{} {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    keys := []interface{}{}
+    for _, shard := range t.shards {
+        keys = append(keys, shard.PendingDeletion()...)
+    }
+    return keys
+}
+
+// Flush is a method of a shardedMap that flushes every dirty item of every shard, like
+// the Flush method of a managedMap, and returns the errors of every failed flush joined
+// together. Flush will always panic when called after the Close method has been called.
+func (t *shardedMap) Flush() error {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    var errs []error
+    for _, shard := range t.shards {
+        errs = append(errs, shard.Flush())
+    }
+    return errors.Join(errs...)
+}
+
+// Save is a method of a shardedMap that writes every readable item of every shard to w
+// as a single snapshot, in the format written by the Save method of a managedMap and
+// compressed as the shards' WithSnapshotCompression sets, so it can be read by the Load
+// method of either. The shards are copied one after another. Save will always panic when
+// called after the Close method has been called.
+func (t *shardedMap) Save(w io.Writer) error {
+    t.lock.RLock()
+    var items []persistedItem
+    for _, shard := range t.shards {
+        items = append(items, shard.persisted(true)...)
+    }
+    compression := t.shards[0].compression
+    t.lock.RUnlock()
+    return writeSnapshot(w, compression, items)
+}
+
+// Load is a method of a shardedMap that reads items written by Save from r and stores
+// each in the shard holding its key, like the Load method of a managedMap. The shards are
+// loaded one after another, so if the items of one shard can not be restored the shards
+// before it keep the items already stored. Load will always panic when called after the
+// Close method has been called. ErrInvalidSnapshot is returned if r does not hold a
+// snapshot.
+func (t *shardedMap) Load(r io.Reader) error {
+    items, err := readSnapshot(r)
+    if err != nil {
+        return err
+    }
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if shardedMap is closed
+    t.shards[0].closed()
+    groups := make(map[*managedMap][]persistedItem)
+    for _, i := range items {
+        shard := t.shard(i.Key)
+        groups[shard] = append(groups[shard], i)
+    }
+    for shard, items := range groups {
+        if err := shard.storePersisted(items); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Stats is a method of a shardedMap that returns the Stats of every shard added together.
+// The shards are read one after another like Size. Stats will always panic when called
+// after the Close method has been called.
+func (t *shardedMap) Stats() Stats {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    var total Stats
+    for _, shard := range t.shards {
+        s := shard.Stats()
+        total.ActiveGoroutines += s.ActiveGoroutines
+        total.RetryQueueDepth += s.RetryQueueDepth
+        total.Vetoes += s.Vetoes
+        total.InFlightLoads += s.InFlightLoads
+        total.PendingDeletes += s.PendingDeletes
+        total.Compactions += s.Compactions
+        total.Hits += s.Hits
+        total.Misses += s.Misses
+        total.Expirations += s.Expirations
+        total.AccessExhaustions += s.AccessExhaustions
+        total.Removals += s.Removals
+        total.CapacityEvictions += s.CapacityEvictions
+    }
+    return total
+}
+
+// HitCount is a method of a shardedMap that returns the hits of every shard added
+// together, like the HitCount method of a managedMap.
+func (t *shardedMap) HitCount() uint64 {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    var hits uint64
+    for _, shard := range t.shards {
+        hits += shard.HitCount()
+    }
+    return hits
+}
+
+// MissCount is a method of a shardedMap that returns the misses of every shard added
+// together, like the MissCount method of a managedMap.
+func (t *shardedMap) MissCount() uint64 {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    var misses uint64
+    for _, shard := range t.shards {
+        misses += shard.MissCount()
+    }
+    return misses
+}
+
+// EvictionCount is a method of a shardedMap that returns the evictions of every shard
+// added together, like the EvictionCount method of a managedMap. Reshard moving an item
+// to another shard is not an eviction.
+func (t *shardedMap) EvictionCount() uint64 {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    var evictions uint64
+    for _, shard := range t.shards {
+        evictions += shard.EvictionCount()
+    }
+    return evictions
+}
+
+// Features is a method of a shardedMap that returns the FeatureSet every shard was
+// configured with. Its MaxSize is the MaxSize of a single shard.
+func (t *shardedMap) Features() FeatureSet {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shards[0].Features()
+}
+
+// IsClosed is a method of a shardedMap that returns whether Close has been called.
+func (t *shardedMap) IsClosed() bool {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    return t.shards[0].IsClosed()
+}
@@ -0,0 +1,138 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// Stats is a point in time snapshot of the counters kept by a managedMap.
+type Stats struct {
+    // ActiveGoroutines is the number of per-item goroutines currently running. In a
+    // healthy map it closely tracks the number of items with a finite timeout and is
+    // zero when items share timers. A count that keeps growing past the number of
+    // items indicates leaked goroutines.
+    ActiveGoroutines int64
+    // RetryQueueDepth is the number of failed flushes of evicted items waiting to be
+    // retried when write-back retries are enabled.
+    RetryQueueDepth int64
+    // Vetoes is the number of evictions cancelled by the WithEvictVeto callback. A
+    // count that grows with every expiry indicates items that are never released.
+    Vetoes int64
+    // InFlightLoads is the number of Loader calls currently running for GetLoad.
+    InFlightLoads int64
+    // PendingDeletes is the number of items that had run out of accesses or time but
+    // were not yet deleted when the compaction monitor enabled by WithCompactThreshold
+    // last checked. It is always zero without the monitor.
+    PendingDeletes int64
+    // Compactions is the number of compaction passes run by the compaction monitor.
+    Compactions int64
+    // Hits and Misses are the number of calls to Get that found a value and that did not.
+    // A miss that is then loaded by a Loader still counts as a miss.
+    Hits int64
+    Misses int64
+    // Expirations is the number of items deleted because their timeout passed or their
+    // maximum lifetime ended.
+    Expirations int64
+    // AccessExhaustions is the number of items deleted because they ran out of accesses.
+    AccessExhaustions int64
+    // Removals is the number of items removed explicitly, by Remove, RemoveSilent,
+    // RemoveMany, Clear, SwapOut, EvictWhere, an UnsafeMap or being replaced by Load or
+    // MoveEntry.
+    Removals int64
+    // CapacityEvictions is the number of items evicted to keep the map within its MaxSize.
+    CapacityEvictions int64
+}
+
+// Stats is a method of a managedMap that returns a snapshot of its counters. The
+// counters are read atomically without taking the map's lock, so Stats never blocks
+// other operations and may be called after the Close method has been called.
+func (t *managedMap) Stats() Stats {
+    return Stats{
+        ActiveGoroutines: atomic.LoadInt64(&t.goroutines),
+        RetryQueueDepth: atomic.LoadInt64(&t.retryDepth),
+        Vetoes: atomic.LoadInt64(&t.vetoes),
+        InFlightLoads: atomic.LoadInt64(&t.loading),
+        PendingDeletes: atomic.LoadInt64(&t.pending),
+        Compactions: atomic.LoadInt64(&t.compactions),
+        Hits: atomic.LoadInt64(&t.hits),
+        Misses: atomic.LoadInt64(&t.misses),
+        Expirations: atomic.LoadInt64(&t.expirations),
+        AccessExhaustions: atomic.LoadInt64(&t.exhaustions),
+        Removals: atomic.LoadInt64(&t.removals),
+        CapacityEvictions: atomic.LoadInt64(&t.capacityEvictions),
+    }
+}
+
+// HitCount is a method of a managedMap that returns the number of calls to Get that found
+// a value. Like Stats it reads an atomic counter without taking the map's lock, so it
+// suits metric collectors that are called on every scrape, and may be called after the
+// Close method has been called.
+func (t *managedMap) HitCount() uint64 {
+    return uint64(atomic.LoadInt64(&t.hits))
+}
+
+// MissCount is a method of a managedMap that returns the number of calls to Get that did
+// not find a value. Like HitCount it never takes the map's lock.
+func (t *managedMap) MissCount() uint64 {
+    return uint64(atomic.LoadInt64(&t.misses))
+}
+
+// EvictionCount is a method of a managedMap that returns the number of items the map
+// removed by itself: those that expired, ran out of accesses or were evicted to stay
+// within its MaxSize. Explicit removals are not included, they are counted by the
+// Removals field of Stats. Like HitCount it never takes the map's lock.
+func (t *managedMap) EvictionCount() uint64 {
+    return uint64(atomic.LoadInt64(&t.expirations) + atomic.LoadInt64(&t.exhaustions) + atomic.LoadInt64(&t.capacityEvictions))
+}
+
+// countGet is a private method of a managedMap that counts the result of a Get as a hit
+// or a miss and passes it through.
+func (t *managedMap) countGet(value interface{}, has bool) (interface{}, bool) {
+    if has {
+        atomic.AddInt64(&t.hits, 1)
+    } else {
+        atomic.AddInt64(&t.misses, 1)
+    }
+    return value, has
+}
+
+// countEviction is a private method of a managedMap that counts an item leaving the map
+// for the passed reason. Items torn down by Close are not counted.
+func (t *managedMap) countEviction(reason EvictReason) {
+    switch reason {
+    case EvictExpired, EvictLifetimeExceeded:
+        atomic.AddInt64(&t.expirations, 1)
+    case EvictAccessExhausted:
+        atomic.AddInt64(&t.exhaustions, 1)
+    case EvictRemoved:
+        atomic.AddInt64(&t.removals, 1)
+    case EvictCapacity:
+        atomic.AddInt64(&t.capacityEvictions, 1)
+    }
+}
+
+// WithMetricsInterval returns an Option that starts a goroutine calling emit with a
+// snapshot of the map's Stats every d, for example to log them. The goroutine is stopped
+// by the Close method. emit is called from that goroutine, so a slow emit delays the
+// next snapshot but never blocks the map.
+func WithMetricsInterval(d time.Duration, emit func(Stats)) Option {
+    return func(t *managedMap) {
+        t.metricsInterval = d
+        t.emit = emit
+    }
+}
+
+// emitMetrics is a private method of a managedMap run in the goroutine started by
+// WithMetricsInterval. It emits the map's Stats on every tick until the map is closed.
+func (t *managedMap) emitMetrics() {
+    ticker := time.NewTicker(t.metricsInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-t.stop:
+            return
+        case <-ticker.C:
+            t.emit(t.Stats())
+        }
+    }
+}
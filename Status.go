@@ -0,0 +1,61 @@
+package ManagedMap
+
+import (
+    "sync/atomic"
+)
+
+// EntryStatus describes the state of the item stored at a key as reported by Status.
+type EntryStatus int
+
+const (
+    // StatusAbsent means no item is stored at the key.
+    StatusAbsent EntryStatus = iota
+    // StatusLive means the item is stored, has accesses remaining and has not expired.
+    StatusLive
+    // StatusExpiredPendingDelete means the item's timeout has passed but the expiry
+    // that deletes it has not run yet.
+    StatusExpiredPendingDelete
+    // StatusAccessExhaustedPendingDelete means the item has no accesses remaining and
+    // is waiting for the write lock to be deleted. It is already reported as absent.
+    StatusAccessExhaustedPendingDelete
+)
+
+// String returns the name of the EntryStatus.
+func (s EntryStatus) String() string {
+    switch s {
+    case StatusAbsent:
+        return "Absent"
+    case StatusLive:
+        return "Live"
+    case StatusExpiredPendingDelete:
+        return "ExpiredPendingDelete"
+    case StatusAccessExhaustedPendingDelete:
+        return "AccessExhaustedPendingDelete"
+    }
+    return "Unknown"
+}
+
+// Status is a method of a managedMap, intended as a debugging aid, that returns the true
+// state of the item stored at key, including the transient states between an item
+// running out of accesses or time and it being deleted. An item that is both out of
+// accesses and expired reports StatusAccessExhaustedPendingDelete. Pinned items are
+// always live. Status does not consume an access and will always panic when called
+// after the Close method has been called.
+func (t *managedMap) Status(key interface{}) EntryStatus {
+    t.checkKeyType(key)
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has {
+        return StatusAbsent
+    }
+    if atomic.LoadUint64(&value.accessRemaining) == 0 {
+        return StatusAccessExhaustedPendingDelete
+    }
+    if value.remaining() == 0 {
+        return StatusExpiredPendingDelete
+    }
+    return StatusLive
+}
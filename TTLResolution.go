@@ -0,0 +1,80 @@
+package ManagedMap
+
+import (
+    "time"
+)
+
+// bucket is a private struct that groups every item whose deadline rounds up to the
+// same multiple of a map's TTL resolution so they share a single timer.
+type bucket struct {
+    slot int64
+    timer *time.Timer
+    items map[*item] interface{}
+}
+
+// WithTTLResolution is an Option that rounds every item's expiry deadline up to the
+// next multiple of d. Items whose deadlines round to the same instant share one timer
+// and are deleted together, and no goroutine is kept per item, which greatly reduces
+// the number of active timers and goroutines in large maps. The tradeoff is precision:
+// an item is deleted up to d after its deadline rather than at it.
+func WithTTLResolution(d time.Duration) Option {
+    return func(t *managedMap) {
+        if d <= 0 {
+            return
+        }
+        t.resolution = d
+        t.buckets = make(map[int64] *bucket)
+    }
+}
+
+// joinBucket is a private method of a managedMap that moves the item stored at key into
+// the bucket covering its deadline, creating the bucket and its timer if needed. The
+// caller must hold the write lock.
+func (t *managedMap) joinBucket(key interface{}, it *item) {
+    t.leaveBucket(it)
+    resolution := int64(t.resolution)
+    slot := (it.deadlineAt().UnixNano() + resolution - 1) / resolution
+    b, has := t.buckets[slot]
+    if !has {
+        b = &bucket{
+            slot: slot,
+            items: make(map[*item] interface{}),
+        }
+        b.timer = time.AfterFunc(time.Until(time.Unix(0, slot * resolution)), func() {
+            t.expireBucket(b)
+        })
+        t.buckets[slot] = b
+    }
+    b.items[it] = key
+    it.bucket = b
+}
+
+// leaveBucket is a private method of a managedMap that removes an item from its bucket,
+// stopping the bucket's timer once it is empty. The caller must hold the write lock.
+func (t *managedMap) leaveBucket(it *item) {
+    b := it.bucket
+    if b == nil {
+        return
+    }
+    delete(b.items, it)
+    it.bucket = nil
+    if len(b.items) == 0 {
+        b.timer.Stop()
+        if t.buckets[b.slot] == b {
+            delete(t.buckets, b.slot)
+        }
+    }
+}
+
+// expireBucket is a private method of a managedMap called when a bucket's timer fires.
+// It acquires the write lock and deletes every item still in the bucket.
+func (t *managedMap) expireBucket(b *bucket) {
+    t.lock.Lock()
+    defer t.unlock()
+    if t.m == nil {
+        return
+    }
+    for it, key := range b.items {
+        t.evict(key, it, EvictExpired)
+    }
+}
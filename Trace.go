@@ -0,0 +1,50 @@
+package ManagedMap
+
+import (
+    "fmt"
+)
+
+// Tracer is the interface used by a managedMap to emit a span around its
+// operations. It is intentionally small so that an adapter for a tracing
+// library such as OpenTelemetry can be written by the user without this
+// package depending on it.
+type Tracer interface {
+    // Start begins a span for the named operation. The returned Span is ended
+    // by the managedMap once the operation completes.
+    Start(operation string) Span
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+    SetAttribute(key string, value interface{})
+    End()
+}
+
+// SpanLinker is an optional interface of a Span that can be linked to another Span, as
+// OpenTelemetry spans can with AddLink. When several callers miss on the same key at once
+// only the first runs the Loader, and the Load spans of the others, tagged with
+// load.shared, are linked to the Load span of that caller. Maps sharing a Group through
+// WithLoaderGroup may have different Tracers, so the linked span may come from another
+// Tracer and AddLink must accept any Span.
+type SpanLinker interface {
+    AddLink(span Span)
+}
+
+// WithTracer is an Option that causes Get and Put operations to be wrapped in
+// a span started by the passed Tracer. Get spans are tagged with whether
+// the lookup was a hit. All spans are tagged with the key class, the go type
+// of the key. Loads that wait on another caller's load are linked to its span
+// if their Span is a SpanLinker. Without this Option no spans are started.
+func WithTracer(tracer Tracer) Option {
+    return func(t *managedMap) {
+        t.tracer = tracer
+    }
+}
+
+// startSpan is a private method of a managedMap that starts a span for the
+// passed operation and tags it with the class of key.
+func (t *managedMap) startSpan(operation string, key interface{}) Span {
+    span := t.tracer.Start(operation)
+    span.SetAttribute("key.class", fmt.Sprintf("%T", key))
+    return span
+}
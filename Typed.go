@@ -0,0 +1,78 @@
+package ManagedMap
+
+// ManagedMap is a strongly typed wrapper around a managedMap for keys of type K and
+// values of type V. For a concrete K, such as a struct holding a slice, the comparable
+// constraint turns the use of a key that can not be used as a go map key into a compile
+// time error rather than a runtime panic. An interface K, such as interface{}, still
+// accepts keys whose dynamic type is not comparable, which panic as they would in a
+// managedMap. Values come back as V without type assertions. Every method behaves like
+// the managedMap method of the same name.
+type ManagedMap[K comparable, V any] struct {
+    m *managedMap
+}
+
+// NewTypedManagedMap returns a pointer to a ManagedMap with the default timeout and
+// accessCount as defined by the DefaultTimeout and DefaultAccessCount constants. Any
+// passed Options are applied to the underlying managedMap.
+func NewTypedManagedMap[K comparable, V any](opts ...Option) *ManagedMap[K, V] {
+    return &ManagedMap[K, V]{m: NewManagedMap(opts...)}
+}
+
+// NewCustomTypedManagedMap returns a pointer to a ManagedMap with the timeout and
+// accessCount defined by the passed Config struct. Any passed Options are applied to the
+// underlying managedMap.
+func NewCustomTypedManagedMap[K comparable, V any](conf Config, opts ...Option) *ManagedMap[K, V] {
+    return &ManagedMap[K, V]{m: NewCustomManagedMap(conf, opts...)}
+}
+
+// Get is a method of a ManagedMap that returns the value associated with key and
+// whether it exists, returning the zero V when it does not. A value that is not a V,
+// which a Loader or Load of the underlying map can store, is reported as missing.
+func (t *ManagedMap[K, V]) Get(key K) (V, bool) {
+    var zero V
+    value, has := t.m.Get(key)
+    if !has {
+        return zero, false
+    }
+    // A nil value does not assert, but is a V if V is an interface type
+    if value == nil {
+        return zero, interface{}(zero) == nil
+    }
+    typed, ok := value.(V)
+    if !ok {
+        return zero, false
+    }
+    return typed, true
+}
+
+// Put is a method of a ManagedMap that inserts or updates the value of key.
+func (t *ManagedMap[K, V]) Put(key K, value V) {
+    t.m.Put(key, value)
+}
+
+// PutCustom is a method of a ManagedMap that inserts or updates the value of key with
+// the timeout and access count of the passed Config struct.
+func (t *ManagedMap[K, V]) PutCustom(key K, value V, config Config) {
+    t.m.PutCustom(key, value, config)
+}
+
+// Has is a method of a ManagedMap that reports whether key exists.
+func (t *ManagedMap[K, V]) Has(key K) bool {
+    return t.m.Has(key)
+}
+
+// Remove is a method of a ManagedMap that removes key and its value.
+func (t *ManagedMap[K, V]) Remove(key K) {
+    t.m.Remove(key)
+}
+
+// Size is a method of a ManagedMap that returns the number of items stored.
+func (t *ManagedMap[K, V]) Size() int {
+    return t.m.Size()
+}
+
+// Close is a method of a ManagedMap that cleans the map like the Close method of a
+// managedMap.
+func (t *ManagedMap[K, V]) Close() {
+    t.m.Close()
+}
@@ -0,0 +1,82 @@
+package ManagedMap
+
+// UnsafeMap is the handle passed to the function given to the WithLock method of a
+// managedMap. Its methods work directly on the map's items without taking the lock, which
+// is already held for them, and without any of the bookkeeping of the ordinary methods:
+// reads do not consume accesses, nothing is traced or loaded and values are not checked
+// against the maximum value size. A handle is only valid until the function it was passed
+// to returns and any use after that panics.
+type UnsafeMap struct {
+    t *managedMap
+    valid *bool
+}
+
+// WithLock is a method of a managedMap that calls fn with an UnsafeMap while holding the
+// write lock, as an escape hatch for compound operations that must be atomic and are not
+// covered by the other methods. The sharp edges are:
+//  - fn must not call any method of the map, or of another map moved between with
+//    MoveEntry, as the lock is not reentrant and the call deadlocks.
+//  - every other caller, readers included, blocks until fn returns, so fn should be short.
+//  - the UnsafeMap must not be kept or passed to another goroutine, it panics once fn has
+//    returned.
+//  - the UnsafeMap bypasses access counting, Loaders and value size limits, so it can
+//    leave the map in states the ordinary methods would not.
+// fn is not called during the close grace period. WithLock will always panic when called
+// after the Close method has been called.
+func (t *managedMap) WithLock(fn func(u UnsafeMap)) {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    if t.m == nil {
+        return
+    }
+    valid := true
+    defer func() {
+        valid = false
+    }()
+    fn(UnsafeMap{t: t, valid: &valid})
+}
+
+// check is a private method of an UnsafeMap that panics if its WithLock call has returned.
+func (u UnsafeMap) check() {
+    if u.valid == nil || !*u.valid {
+        panic("ManagedMap: UnsafeMap used outside of its WithLock call")
+    }
+}
+
+// GetRaw is a method of an UnsafeMap that returns the value of key and whether it exists
+// without consuming an access. Items that have run out of accesses or time are absent.
+func (u UnsafeMap) GetRaw(key interface{}) (interface{}, bool) {
+    u.check()
+    it, has := u.t.m[key]
+    if !has || it.pending() {
+        return nil, false
+    }
+    return u.t.decode(it.load()), true
+}
+
+// PutRaw is a method of an UnsafeMap that stores value at key as a new item with the
+// timeout and access count of the passed Config struct, replacing any item already stored
+// there along with its timer and accesses.
+func (u UnsafeMap) PutRaw(key, value interface{}, config Config) {
+    u.check()
+    data := u.t.mustEncode(value)
+    if old, has := u.t.m[key]; has {
+        u.t.drop(key, old, EvictRemoved)
+    }
+    config = config.resolve()
+    it := u.t.insert(key, data, config.Timeout, config.Timeout, config.AccessCount)
+    it.slide.Store(config.SlideOnAccess)
+    u.t.prioritize(it, config.Priority)
+    u.t.markDirty(it)
+}
+
+// DeleteRaw is a method of an UnsafeMap that removes key and its item, as Remove would.
+func (u UnsafeMap) DeleteRaw(key interface{}) {
+    u.check()
+    if it, has := u.t.m[key]; has {
+        u.t.drop(key, it, EvictRemoved)
+    }
+    delete(u.t.stale, key)
+}
@@ -0,0 +1,175 @@
+package ManagedMap
+
+import (
+    "errors"
+    "math/rand/v2"
+    "sync/atomic"
+    "time"
+)
+
+// deadLetterBuffer is the number of failed flushes kept on the dead letter channel
+// before further failures are dropped.
+const deadLetterBuffer = 64
+
+// retryQueueSize is the maximum number of failed flushes waiting to be retried. A
+// failed flush that finds the queue full is dead lettered straight away.
+const retryQueueSize = 1024
+
+// DeadLetter describes a dirty item that could not be flushed when it was evicted.
+type DeadLetter struct {
+    Key   interface{}
+    Value interface{}
+    Err   error
+}
+
+// WithWriteBack is an Option that turns the map into a write-back buffer in front of a
+// slower store. Every Put marks its item dirty. A dirty item is passed to flush before it
+// is evicted by its timeout or by running out of accesses, and before it is discarded
+// by Close, so it is still readable in the map until flush returns. Flush and FlushKey
+// flush dirty items on demand. Remove discards an item without flushing it. flush is
+// called while the map's write lock is held so it must not call any method of the map.
+// When flush fails during an eviction the item is still evicted and is sent to the
+// channel returned by DeadLetters.
+func WithWriteBack(flush func(key, value interface{}) error) Option {
+    return func(t *managedMap) {
+        t.writeBack = flush
+        t.deadLetters = make(chan DeadLetter, deadLetterBuffer)
+    }
+}
+
+// DeadLetters is a method of a managedMap that returns the channel receiving items
+// whose flush failed when they were evicted. The channel is buffered and failures are
+// dropped while it is full. DeadLetters returns nil when write-back is not enabled.
+func (t *managedMap) DeadLetters() <-chan DeadLetter {
+    return t.deadLetters
+}
+
+// Flush is a method of a managedMap that synchronously flushes every dirty item under the
+// write lock. Items that flush successfully are no longer dirty. Flush returns the errors of
+// every failed flush joined together, and those items stay dirty. Flush will always panic
+// when called after the Close method has been called.
+func (t *managedMap) Flush() error {
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    errs := []error{}
+    for key, value := range t.m {
+        if err := t.flushItem(key, value, false); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// FlushKey is a method of a managedMap that synchronously flushes the item stored at key
+// if it is dirty. An absent or clean key is not flushed. FlushKey will always panic when
+// called after the Close method has been called.
+func (t *managedMap) FlushKey(key interface{}) error {
+    t.checkKeyType(key)
+    t.lock.Lock()
+    defer t.unlock()
+    // Panic if managedMap is closed
+    t.closed()
+    value, has := t.m[key]
+    if !has {
+        return nil
+    }
+    return t.flushItem(key, value, false)
+}
+
+// markDirty is a private method of a managedMap that marks an item as needing a flush
+// when write-back is enabled.
+func (t *managedMap) markDirty(it *item) {
+    if t.writeBack != nil {
+        it.dirty.Store(true)
+    }
+}
+
+// WithFlushRetry is an Option that makes a failed flush of an evicted item be retried up
+// to maxRetries times in the background before the item is dead lettered, so a store that
+// is briefly unavailable doesn't lose writes. The n-th retry waits a random duration
+// between half and all of baseDelay * 2^(n-1). At most retryQueueSize flushes wait to be
+// retried at once, further failures are dead lettered straight away, and the current
+// number is reported as RetryQueueDepth in Stats. Retries run without holding the map's
+// lock and keep running after Close, but never at the same time as another flush of the
+// map. A pending retry is dropped once a newer flush of its key starts, so a retried
+// value never overwrites a newer value of the key that was flushed in the meantime.
+func WithFlushRetry(maxRetries int, baseDelay time.Duration) Option {
+    return func(t *managedMap) {
+        t.flushRetries = maxRetries
+        t.flushRetryDelay = baseDelay
+    }
+}
+
+// flushItem is a private method of a managedMap that flushes the item stored at key if
+// it is dirty. If the flush fails and evicting is set the item is queued to be retried or
+// sent to the dead letter channel. The caller must hold the write lock.
+func (t *managedMap) flushItem(key interface{}, it *item, evicting bool) error {
+    if t.writeBack == nil || !it.dirty.Load() {
+        return nil
+    }
+    value := t.decode(it.load())
+    t.flushLock.Lock()
+    defer t.flushLock.Unlock()
+    // This flush supersedes any retry still pending for the key
+    delete(t.retries, key)
+    if err := t.writeBack(key, value); err != nil {
+        if evicting {
+            t.retryGen++
+            t.retryFlush(key, value, t.retryGen, 1, err)
+        }
+        return err
+    }
+    it.dirty.Store(false)
+    return nil
+}
+
+// retryFlush is a private method of a managedMap that schedules the given attempt to
+// flush an evicted key and value after a jittered backoff, or dead letters it with err
+// once the retries are exhausted or the retry queue is full. The retry is identified by
+// gen and is dropped if another flush of key starts before it runs. The caller must hold
+// the flush lock.
+func (t *managedMap) retryFlush(key, value interface{}, gen uint64, attempt int, err error) {
+    delete(t.retries, key)
+    if attempt > t.flushRetries {
+        t.deadLetter(key, value, err)
+        return
+    }
+    if atomic.AddInt64(&t.retryDepth, 1) > retryQueueSize {
+        atomic.AddInt64(&t.retryDepth, -1)
+        t.deadLetter(key, value, err)
+        return
+    }
+    if t.retries == nil {
+        t.retries = make(map[interface{}] uint64)
+    }
+    t.retries[key] = gen
+    delay := t.flushRetryDelay << (attempt - 1)
+    if delay > 1 {
+        delay = delay / 2 + rand.N(delay / 2)
+    }
+    time.AfterFunc(delay, func() {
+        t.flushLock.Lock()
+        defer t.flushLock.Unlock()
+        defer atomic.AddInt64(&t.retryDepth, -1)
+        // A newer flush of the key has started so this value is stale
+        if current, has := t.retries[key]; !has || current != gen {
+            return
+        }
+        if err := t.writeBack(key, value); err != nil {
+            t.retryFlush(key, value, gen, attempt + 1, err)
+            return
+        }
+        delete(t.retries, key)
+    })
+}
+
+// deadLetter is a private method of a managedMap that sends a failed flush to the dead
+// letter channel, dropping it if the channel is full.
+func (t *managedMap) deadLetter(key, value interface{}, err error) {
+    select {
+    case t.deadLetters <- DeadLetter{Key: key, Value: value, Err: err}:
+    default:
+    }
+}